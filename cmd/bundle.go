@@ -0,0 +1,15 @@
+package cmd
+
+import (
+	"github.com/modularise/modularise/cmd/config"
+	"github.com/modularise/modularise/internal/repohandler"
+)
+
+func RunApplyBundles(c *config.CLIConfig) error {
+	c.Logger.Info("Pushing split bundles to remote repositories.")
+	if err := repohandler.ApplyBundles(c.Logger, &c.Splits, c.BundleDirectory); err != nil {
+		return err
+	}
+	c.Logger.Info("Split repositories were successfully updated from bundles.")
+	return nil
+}
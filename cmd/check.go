@@ -1,12 +1,31 @@
 package cmd
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+
 	"github.com/modularise/modularise/cmd/config"
+	"github.com/modularise/modularise/internal/filecache"
+	"github.com/modularise/modularise/internal/filecache/overlay"
 	"github.com/modularise/modularise/internal/parser"
+	"github.com/modularise/modularise/internal/repohandler"
+	"github.com/modularise/modularise/internal/residuals"
 	"github.com/modularise/modularise/internal/splitapi"
 )
 
 func RunCheck(c *config.CLIConfig) error {
+	if c.Patch != "" {
+		c.Logger.Info("Applying patch to the source module's files.", zap.String("patch", c.Patch))
+		fc, err := patchFilecache(c.Logger, c.Filecache, &c.Splits, c.Patch)
+		if err != nil {
+			return err
+		}
+		c.Filecache = fc
+	}
+
 	c.Logger.Info("Parsing split configuration.")
 	if err := parser.Parse(c.Logger, c.Filecache, &c.Splits); err != nil {
 		return err
@@ -16,6 +35,55 @@ func RunCheck(c *config.CLIConfig) error {
 	if err := splitapi.AnalyseAPI(c.Logger, c.Filecache, &c.Splits); err != nil {
 		return err
 	}
+	if err := residuals.ComputeResiduals(c.Logger, c.Filecache, &c.Splits); err != nil {
+		return err
+	}
+
+	c.Logger.Info("Looking for residual packages shared by several splits.")
+	if err := residuals.ReportSharedResiduals(c.Logger, c.Filecache, &c.Splits); err != nil {
+		return err
+	}
 	c.Logger.Info("The split configuration in " + c.ConfigFile + " is valid.")
 	return nil
 }
+
+// patchFilecache overlays the changes of a patch on top of the source module's files. The patch is
+// either a unified diff whose paths are relative to the root of the source project's repository or
+// a directory that mirrors the layout of the source module.
+func patchFilecache(log *zap.Logger, fc filecache.FileCache, sp *config.Splits, patch string) (filecache.FileCache, error) {
+	fi, err := os.Stat(patch)
+	if err != nil {
+		log.Error("Unable to access patch.", zap.String("patch", patch), zap.Error(err))
+		return nil, err
+	}
+	if fi.IsDir() {
+		return overlay.FromDir(log, fc, patch)
+	}
+
+	b, err := ioutil.ReadFile(patch)
+	if err != nil {
+		log.Error("Unable to read patch.", zap.String("patch", patch), zap.Error(err))
+		return nil, err
+	}
+
+	var prefix string
+	if repo, err := repohandler.OpenSource(fc, sp); err != nil {
+		log.Debug("Source module is not part of a git repository. Paths in the patch are relative to its root.", zap.Error(err))
+	} else if wt, err := repo.Worktree(); err == nil {
+		root, err := filepath.EvalSymlinks(wt.Filesystem.Root())
+		if err != nil {
+			log.Error("Could not resolve the root of the source repository.", zap.String("directory", wt.Filesystem.Root()), zap.Error(err))
+			return nil, err
+		}
+		mod, err := filepath.EvalSymlinks(fc.Root())
+		if err != nil {
+			log.Error("Could not resolve the root of the source module.", zap.String("directory", fc.Root()), zap.Error(err))
+			return nil, err
+		}
+		if prefix, err = filepath.Rel(root, mod); err != nil {
+			log.Error("Could not determine the source module's location within its repository.", zap.Error(err))
+			return nil, err
+		}
+	}
+	return overlay.FromPatch(log, fc, b, prefix)
+}
@@ -16,6 +16,7 @@ import (
 
 	"github.com/modularise/modularise/internal/filecache"
 	"github.com/modularise/modularise/internal/filecache/cache"
+	"github.com/modularise/modularise/internal/filecache/listcache"
 	"github.com/modularise/modularise/internal/logger"
 )
 
@@ -30,15 +31,41 @@ type CLIConfig struct {
 	LogFile string
 	// Directory to which to write all split content.
 	WorkDirectory string
+	// Directory in which to persist mirrors of split repositories across runs.
+	MirrorDirectory string
+	// Name of the source branch to use for branch mapping instead of detecting it.
+	SourceBranch string
+	// Directory to which to write git bundles of new split content, or from which to read them.
+	BundleDirectory string
 	// If set do not push new split content to the associated remotes.
 	DryRun bool
+	// If set push new split content in an all-or-nothing fashion, reverting any already updated
+	// remotes if the content of one of the splits fails to be pushed.
+	Atomic bool
+	// If set overwrite commits in split repositories that were not produced by modularise instead
+	// of refusing to update such splits.
+	OverwriteManualChanges bool
 	// If set emit verbose debug logs.
 	Verbose bool
+	// Unified diff, or directory mirroring the source module, whose changes are applied on top of
+	// the source module's files before checking the split configuration.
+	Patch string
+	// Approximate memory, in MiB, that the file cache may use for file content.
+	CacheMemory int
+	// Determines how the packages of the source module are discovered. Either 'walk' to infer them
+	// from the directory layout or 'golist' to load them via 'go list'. Defaults to 'walk'.
+	FileCache string
 
 	// Internal state.
 	cliConfigData
 }
 
+// Values for CLIConfig.FileCache.
+const (
+	FileCacheWalk   = "walk"
+	FileCacheGoList = "golist"
+)
+
 type cliConfigData struct {
 	Logger    *zap.Logger
 	Filecache filecache.FileCache
@@ -58,16 +85,117 @@ func (c *CLIConfig) CheckConfig() error {
 	if c.WorkDirectory != "" {
 		c.Splits.WorkTree = c.WorkDirectory
 	}
+	c.Splits.OverwriteManualChanges = c.OverwriteManualChanges
+	c.Splits.SourceBranch = c.SourceBranch
+	if c.MirrorDirectory != "" {
+		p, err := filepath.Abs(c.MirrorDirectory)
+		if err != nil {
+			c.Logger.Error("Unable to determine the absolute path of the mirror directory.", zap.String("directory", c.MirrorDirectory), zap.Error(err))
+			return err
+		}
+		c.Splits.MirrorDirectory = p
+	}
+	if err := c.checkBundleDirectory(); err != nil {
+		return err
+	}
+	if err := c.Splits.UnmatchedBranch.Validate(); err != nil {
+		c.Logger.Error("Invalid branch mapping configuration.", zap.Error(err))
+		return err
+	}
+	if err := c.Splits.Metafiles.Validate(); err != nil {
+		c.Logger.Error("Invalid metafiles configuration.", zap.Error(err))
+		return err
+	}
 	for n, s := range c.Splits.Splits {
 		s.Name = n
+		for _, r := range s.Remotes {
+			if r.URL == "" {
+				c.Logger.Error("A remote without URL is configured for split.", zap.String("split", n))
+				return fmt.Errorf("split %q has a remote without URL", n)
+			}
+			if err := r.Policy.Validate(); err != nil {
+				c.Logger.Error("Invalid push policy for remote of split.", zap.String("split", n), zap.String("url", r.URL), zap.Error(err))
+				return err
+			}
+		}
+		if err := s.ResidualPlacement.Validate(); err != nil {
+			c.Logger.Error("Invalid residual placement for split.", zap.String("split", n), zap.Error(err))
+			return err
+		}
+		if err := s.Tests.Validate(); err != nil {
+			c.Logger.Error("Invalid test policy for split.", zap.String("split", n), zap.Error(err))
+			return err
+		}
+		if err := s.Metafiles.Validate(); err != nil {
+			c.Logger.Error("Invalid metafiles for split.", zap.String("split", n), zap.Error(err))
+			return err
+		}
+		for _, e := range s.ExtraFiles {
+			if err := e.Validate(); err != nil {
+				c.Logger.Error("Invalid extra file for split.", zap.String("split", n), zap.Error(err))
+				return err
+			}
+		}
 	}
 
-	fc, err := cache.NewCache(c.Logger, filepath.Dir(c.ConfigFile))
-	if err != nil {
+	opts := cache.Options{
+		TrackedOnly:  c.Splits.SourceFiles.TrackedOnly,
+		GitIgnore:    c.Splits.SourceFiles.GitIgnore,
+		MemoryBudget: int64(c.CacheMemory) << 20,
+	}
+	switch c.FileCache {
+	case "", FileCacheWalk:
+		fc, err := cache.NewCache(c.Logger, filepath.Dir(c.ConfigFile), opts)
+		if err != nil {
+			return err
+		}
+		c.Filecache = fc
+	case FileCacheGoList:
+		fc, err := listcache.NewListCache(c.Logger, filepath.Dir(c.ConfigFile), opts)
+		if err != nil {
+			return err
+		}
+		c.Filecache = fc
+	default:
+		c.Logger.Error("Unknown filecache type.", zap.String("filecache", c.FileCache))
+		return fmt.Errorf("unknown filecache %q, expected one of %q or %q", c.FileCache, FileCacheWalk, FileCacheGoList)
+	}
+
+	return nil
+}
+
+// CheckBundleConfig is the counterpart of CheckConfig for commands that only operate on previously
+// written split bundles. Such commands may run on a machine without access to the source project,
+// hence only the credentials and remotes of the configuration file are used and no filecache is set
+// up. If no configuration file is specified the global credentials are empty.
+func (c *CLIConfig) CheckBundleConfig() error {
+	if err := c.checkLogger(); err != nil {
 		return err
 	}
-	c.Filecache = fc
 
+	if c.ConfigFile != "" {
+		if err := c.checkConfigFile(); err != nil {
+			return err
+		}
+		for n, s := range c.Splits.Splits {
+			s.Name = n
+		}
+	} else {
+		c.Logger.Info("No configuration file specified. Split remotes are accessed without credentials.")
+	}
+	return c.checkBundleDirectory()
+}
+
+func (c *CLIConfig) checkBundleDirectory() error {
+	if c.BundleDirectory == "" {
+		return nil
+	}
+	p, err := filepath.Abs(c.BundleDirectory)
+	if err != nil {
+		c.Logger.Error("Unable to determine the absolute path of the bundle directory.", zap.String("directory", c.BundleDirectory), zap.Error(err))
+		return err
+	}
+	c.BundleDirectory = p
 	return nil
 }
 
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/go-git/go-git/v5/plumbing/object"
@@ -22,11 +24,51 @@ type Splits struct {
 	Author AuthorData `yaml:"author,omitempty"`
 	// Map of all configured splits.
 	Splits map[string]*Split `yaml:"splits,omitempty"`
+	// Rules mapping the branch of the source project on which modularise is run to the branch of
+	// the split repositories that should be updated. The first matching rule applies. If no rules
+	// are configured each split's Branch is used regardless of the source branch.
+	BranchMapping []BranchRule `yaml:"branch_mapping,omitempty"`
+	// Determines what happens if the source branch does not match any of the BranchMapping rules.
+	// Defaults to 'error'.
+	UnmatchedBranch UnmatchedBranchPolicy `yaml:"unmatched_branch,omitempty"`
+	// Rules that the content of all splits is checked against before it is published.
+	LeakGuard LeakGuard `yaml:"leak_guard,omitempty"`
+	// Globs, relative to the source module's root, of non-Go files in which the paths of packages
+	// that are part of a split are rewritten. Defaults to '**/*.md', '**/*.proto', '**/Makefile' and
+	// '**/*.mk'. Paths in the comments and directives of Go files are always rewritten.
+	RewriteFiles []string `yaml:"rewrite_files,omitempty"`
+	// If set, Go string literals that consist exactly of the path of a package that is part of a
+	// split, optionally followed by a symbol name as in 'example.com/project/pkg.Version', are
+	// rewritten as well. Each such rewrite is reported for review.
+	RewriteStringLiterals bool `yaml:"rewrite_string_literals,omitempty"`
+	// If set, the package clause of every non-test Go file in a split is given a canonical import
+	// comment with the package's path in the split. Such comments are removed from residual
+	// packages relocated under 'internal/residuals'.
+	CanonicalImportComments bool `yaml:"canonical_import_comments,omitempty"`
+	// Metafiles, such as README or LICENSE files, that are added to each split.
+	Metafiles Metafiles `yaml:"metafiles,omitempty"`
+	// Build targets for which the API and residuals of splits are analysed. Go files that are
+	// excluded by their build constraints on all targets, such as 'ignore'-tagged tools, are not
+	// analysed. Defaults to the common combinations of linux, darwin and windows with amd64 and
+	// arm64.
+	BuildTargets []BuildTarget `yaml:"build_targets,omitempty"`
+	// Restrictions on the files of the source module's directory tree that are taken into account.
+	// Files matched by the patterns of '.modulariseignore' files, which use the '.gitignore' syntax,
+	// are never taken into account.
+	SourceFiles SourceFiles `yaml:"source_files,omitempty"`
 
 	// Internal state.
 	splits.DataSplits `yaml:"-"`
 }
 
+type SourceFiles struct {
+	// If set, only files tracked by git are taken into account. This excludes build outputs, editor
+	// swap files and other untracked content of the working tree.
+	TrackedOnly bool `yaml:"tracked_only,omitempty"`
+	// If set, files matched by the patterns of '.gitignore' files are not taken into account.
+	GitIgnore bool `yaml:"gitignore,omitempty"`
+}
+
 type Split struct {
 	// Module path for the split
 	ModulePath string `yaml:"module_path,omitempty"`
@@ -34,20 +76,258 @@ type Split struct {
 	// made part of this split, unless:
 	// - they are explicitly exluded by a longer prefix path in the Excludes list.
 	// - they are explicitly included in another split.
+	// Entries containing any of '*', '?' or '[' are interpreted as globs and entries prefixed with
+	// 'regexp:' as regular expressions. Such patterns only match the directories they describe.
+	// Entries prefixed with '!' exclude the matched directories from this split. Competing entries
+	// are ranked by the length of their literal prefix.
 	Includes []string `yaml:"includes,omitempty"`
 	// List of paths relative to the source module's root. Any Go packages below these paths will
 	// not be made part of this split, unless they are explicitly included by a longer prefix path
-	// in the Includes list.
+	// in the Includes list. Globs and regular expressions are supported as for Includes.
 	Excludes []string `yaml:"excludes,omitempty"`
+	// Additional files, such as shared schemas, CODEOWNERS or CI workflows, that should be copied into
+	// the split regardless of the directories that it includes.
+	ExtraFiles []ExtraFile `yaml:"extra_files,omitempty"`
+	// List of globs or paths relative to the source module's root of files that must not be copied
+	// into the split, even if they reside in an included directory or match an ExtraFiles entry.
+	// A pattern matching a directory applies to all files below it.
+	ExcludeFiles []string `yaml:"exclude_files,omitempty"`
+	// Determines where residual packages that need to be relocated are placed within the split.
+	ResidualPlacement ResidualPlacement `yaml:"residual_placement,omitempty"`
+	// Determines which of the test files of the split are retained and how the packages that are
+	// only imported by them are handled, defaults to 'all'.
+	Tests TestPolicy `yaml:"tests,omitempty"`
+	// Produce a vendored split module by running 'go mod vendor' once the split's dependencies have
+	// been resolved.
+	Vendor bool `yaml:"vendor,omitempty"`
+	// List of globs, relative to the split's root, of files that are exempt from the LeakGuard rules.
+	LeakGuardAllow []string `yaml:"leak_guard_allow,omitempty"`
+	// Metafiles for this split. Templates are merged with the global ones, taking precedence for
+	// identical destinations. If set, Copy replaces the global list.
+	Metafiles Metafiles `yaml:"metafiles,omitempty"`
 	// URL of the Git VCS where this split resides.
 	URL string `yaml:"url,omitempty"`
 	// Branch on the remote VCS that should be cloned from / pushed to for split content, defaults to 'master'.
 	Branch string `yaml:"branch,omitempty"`
+	// Additional remote repositories, such as read-only mirrors, to which split content should be
+	// pushed after it has been pushed to the one specified by URL.
+	Remotes []Remote `yaml:"remotes,omitempty"`
 
 	// Internal state.
 	splits.DataSplit `yaml:"-"`
 }
 
+type ExtraFile struct {
+	// Path or glob relative to the source module's root. A path may designate a single file or a
+	// directory, in which case all files below it are copied.
+	Source string `yaml:"source,omitempty"`
+	// Path relative to the split's root at which the files matched by Source are placed. If Source
+	// is a single file this is the path of the copied file, otherwise it is a directory in which
+	// matched files are placed relative to the leading path elements of Source that do not contain
+	// any glob meta-characters. Defaults to the location of the files in the source module.
+	Destination string `yaml:"destination,omitempty"`
+}
+
+// Validate returns an error if the ExtraFile has no Source or if its Destination is not a relative
+// path within the split.
+func (e ExtraFile) Validate() error {
+	if e.Source == "" {
+		return errors.New("extra file without source")
+	}
+	if d := filepath.Clean(e.Destination); filepath.IsAbs(d) || d == ".." || strings.HasPrefix(d, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("destination %q of extra file %q is not within the split", e.Destination, e.Source)
+	}
+	return nil
+}
+
+type BuildTarget struct {
+	GOOS   string `yaml:"goos,omitempty"`
+	GOARCH string `yaml:"goarch,omitempty"`
+	// Additional build tags that are satisfied for this target.
+	Tags []string `yaml:"tags,omitempty"`
+	// Whether cgo is enabled for this target, defaults to true.
+	Cgo *bool `yaml:"cgo,omitempty"`
+}
+
+func (t BuildTarget) String() string {
+	s := t.GOOS + "/" + t.GOARCH
+	if len(t.Tags) > 0 {
+		s += "," + strings.Join(t.Tags, ",")
+	}
+	if t.Cgo != nil && !*t.Cgo {
+		s += ",!cgo"
+	}
+	return s
+}
+
+type ResidualPlacement struct {
+	// Strategy used to place residual packages, defaults to 'flatten'.
+	Strategy ResidualStrategy `yaml:"strategy,omitempty"`
+	// Map from the directory of a residual package, relative to the source module's root, to its
+	// directory relative to the split's root. Only used by the 'mapping' strategy. Residual packages
+	// that are not listed are placed as by the 'flatten' strategy.
+	Mapping map[string]string `yaml:"mapping,omitempty"`
+}
+
+type ResidualStrategy string
+
+const (
+	// Residual packages are placed under 'internal/residuals' at their path relative to the common
+	// root of all residuals, with any 'internal' path elements removed.
+	ResidualStrategyFlatten ResidualStrategy = "flatten"
+	// Residual packages are placed under 'internal' at their full path relative to the source
+	// module's root. Packages already within the source module's top-level 'internal' directory keep
+	// their path as is. Test-only residuals are placed under 'internal/testresiduals' instead.
+	ResidualStrategyPreserve ResidualStrategy = "preserve"
+	// Residual packages are placed according to a user-provided mapping.
+	ResidualStrategyMapping ResidualStrategy = "mapping"
+)
+
+type TestPolicy string
+
+const (
+	// All test files are retained and the packages they import are treated as any other residual.
+	TestPolicyAll TestPolicy = "all"
+	// All test files are dropped, including those of residual packages.
+	TestPolicyNone TestPolicy = "none"
+	// Only test files that are part of the package under test are retained, excluding external
+	// '_test' packages and tests that would require packages not otherwise part of the split.
+	TestPolicyPackage TestPolicy = "package"
+	// All test files of the split's packages are retained and packages that are only imported by
+	// them are placed under 'internal/testresiduals', separately from other residuals.
+	TestPolicySeparate TestPolicy = "separate"
+)
+
+// Validate returns an error if the TestPolicy is unknown.
+func (t TestPolicy) Validate() error {
+	switch t {
+	case "", TestPolicyAll, TestPolicyNone, TestPolicyPackage, TestPolicySeparate:
+		return nil
+	default:
+		return fmt.Errorf("unknown test policy %q", t)
+	}
+}
+
+// KeepsAllTests returns whether all test files, including those of residual packages, are retained.
+func (t TestPolicy) KeepsAllTests() bool {
+	return t == "" || t == TestPolicyAll
+}
+
+// Validate returns an error if the ResidualPlacement has an unknown strategy or if any of its
+// mapped directories is not a relative path within the split.
+func (r ResidualPlacement) Validate() error {
+	switch r.Strategy {
+	case "", ResidualStrategyFlatten, ResidualStrategyPreserve, ResidualStrategyMapping:
+	default:
+		return fmt.Errorf("unknown residual placement strategy %q", r.Strategy)
+	}
+	for src, dst := range r.Mapping {
+		if d := filepath.Clean(dst); filepath.IsAbs(d) || d == ".." || strings.HasPrefix(d, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("destination %q of residual package %q is not within the split", dst, src)
+		}
+	}
+	return nil
+}
+
+type Metafiles struct {
+	// Map from a path relative to a split's root to the path, relative to the source module's root,
+	// of a Go text/template that is rendered to that location. The template has access to the
+	// split's Name, ModulePath, Packages and Dependencies as well as the SourceModule and the
+	// SourceVersion, i.e. the revision of the source project from which the split is generated. A
+	// 'README.md' template replaces the default README.
+	Templates map[string]string `yaml:"templates,omitempty"`
+	// Paths relative to the source module's root of files that are copied as-is to the root of a
+	// split if they exist. Defaults to the usual spellings of LICENSE files.
+	Copy []string `yaml:"copy,omitempty"`
+	// If set, a README.md file at the root of a split's content in the source project is kept
+	// instead of being replaced with the default README.
+	KeepReadme bool `yaml:"keep_readme,omitempty"`
+}
+
+// Validate returns an error if the destination of any of the Metafiles' templates is not a relative
+// path within the split.
+func (m Metafiles) Validate() error {
+	for dst, tmpl := range m.Templates {
+		if d := filepath.Clean(dst); filepath.IsAbs(d) || d == "." || d == ".." || strings.HasPrefix(d, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("destination %q of metafile template %q is not within the split", dst, tmpl)
+		}
+	}
+	return nil
+}
+
+type LeakGuard struct {
+	// Globs, relative to a split's root, of files that must not be published.
+	DenyPaths []string `yaml:"deny_paths,omitempty"`
+	// Regular expressions, such as secret patterns or 'INTERNAL ONLY' markers, that must not match
+	// the content of any published file.
+	DenyContent []string `yaml:"deny_content,omitempty"`
+	// Maximum size in bytes of any published file. No limit applies if it is zero.
+	MaxFileSize int64 `yaml:"max_file_size,omitempty"`
+}
+
+type BranchRule struct {
+	// Regular expression that must match the entire name of the source branch.
+	Source string `yaml:"source,omitempty"`
+	// Name of the branch in the split repositories. It may reference capture groups of the Source
+	// expression, e.g. '$1' or '${name}'. If empty each split's configured Branch is used.
+	Target string `yaml:"target,omitempty"`
+	// If set, runs on a matching source branch do not update any split repositories.
+	Skip bool `yaml:"skip,omitempty"`
+}
+
+type UnmatchedBranchPolicy string
+
+const (
+	// Runs on a source branch that matches no rule fail.
+	UnmatchedBranchError UnmatchedBranchPolicy = "error"
+	// Runs on a source branch that matches no rule do not update any split repositories.
+	UnmatchedBranchSkip UnmatchedBranchPolicy = "skip"
+	// Runs on a source branch that matches no rule update each split's configured Branch.
+	UnmatchedBranchDefault UnmatchedBranchPolicy = "default"
+)
+
+// Validate returns an error if the UnmatchedBranchPolicy is neither empty nor one of the known
+// policies.
+func (p UnmatchedBranchPolicy) Validate() error {
+	switch p {
+	case "", UnmatchedBranchError, UnmatchedBranchSkip, UnmatchedBranchDefault:
+		return nil
+	default:
+		return fmt.Errorf("unknown policy for unmatched branches %q", p)
+	}
+}
+
+type Remote struct {
+	// URL of the Git VCS to which split content should be pushed.
+	URL string `yaml:"url,omitempty"`
+	// Branch on the remote VCS to which split content should be pushed, defaults to the branch of
+	// the split.
+	Branch string `yaml:"branch,omitempty"`
+	// Authentication setup to push to this remote. If not set the global credentials are used.
+	Credentials *AuthConfig `yaml:"credentials,omitempty"`
+	// Policy determining how failures to push to this remote are handled, defaults to 'required'.
+	Policy PushPolicy `yaml:"policy,omitempty"`
+}
+
+type PushPolicy string
+
+const (
+	// A failure to push to a remote with this policy fails the entire push operation.
+	PushPolicyRequired PushPolicy = "required"
+	// A failure to push to a remote with this policy is reported but otherwise ignored.
+	PushPolicyBestEffort PushPolicy = "best-effort"
+)
+
+// Validate returns an error if the PushPolicy is neither empty nor one of the known policies.
+func (p PushPolicy) Validate() error {
+	switch p {
+	case "", PushPolicyRequired, PushPolicyBestEffort:
+		return nil
+	default:
+		return fmt.Errorf("unknown push policy %q", p)
+	}
+}
+
 type AuthConfig struct {
 	PubKey      *string       `yaml:"pub_key,omitempty"`
 	TokenEnvVar *string       `yaml:"token_envvar,omitempty"`
@@ -3,6 +3,7 @@ package cmd
 import (
 	"github.com/modularise/modularise/cmd/config"
 	"github.com/modularise/modularise/internal/chopper"
+	"github.com/modularise/modularise/internal/leakguard"
 	"github.com/modularise/modularise/internal/modworks"
 	"github.com/modularise/modularise/internal/parser"
 	"github.com/modularise/modularise/internal/repohandler"
@@ -11,6 +12,14 @@ import (
 )
 
 func RunSplit(c *config.CLIConfig) error {
+	c.Logger.Info("Determining split branches.")
+	skip, err := repohandler.MapBranches(c.Logger, c.Filecache, &c.Splits)
+	if err != nil {
+		return err
+	} else if skip {
+		return nil
+	}
+
 	c.Logger.Info("Parsing split configuration.")
 	if err := parser.Parse(c.Logger, c.Filecache, &c.Splits); err != nil {
 		return err
@@ -41,6 +50,20 @@ func RunSplit(c *config.CLIConfig) error {
 		return err
 	}
 
+	c.Logger.Info("Checking split content against the leak guard policy.")
+	if err := leakguard.CheckSplits(c.Logger, &c.Splits); err != nil {
+		return err
+	}
+
+	if c.BundleDirectory != "" {
+		c.Logger.Info("Writing bundles with new split content.")
+		if err := repohandler.WriteBundles(c.Logger, &c.Splits, c.BundleDirectory); err != nil {
+			return err
+		}
+		c.Logger.Info("Split bundles can be found in " + c.BundleDirectory + ".")
+		return nil
+	}
+
 	if c.DryRun {
 		c.Logger.Info("Dry-run mode: not pushing new content to remotes.")
 		c.Logger.Info("Split content can be found locally in " + c.Splits.WorkTree + ".")
@@ -48,7 +71,11 @@ func RunSplit(c *config.CLIConfig) error {
 	}
 
 	c.Logger.Info("Pushing new split content to remote repositories.")
-	if err := repohandler.PushSplits(c.Logger, &c.Splits); err != nil {
+	push := repohandler.PushSplits
+	if c.Atomic {
+		push = repohandler.PushSplitsAtomic
+	}
+	if err := push(c.Logger, &c.Splits); err != nil {
 		return err
 	}
 	c.Logger.Info("Split repositories were successfully updated.")
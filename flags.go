@@ -4,6 +4,7 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/modularise/modularise/cmd/config"
+	"github.com/modularise/modularise/internal/filecache/cache"
 )
 
 func attachGlobalFlags(command *cobra.Command, c *config.CLIConfig) {
@@ -34,6 +35,21 @@ func attachGlobalFlags(command *cobra.Command, c *config.CLIConfig) {
 		false,
 		"Print (very) verbose debug logs.",
 	)
+	command.PersistentFlags().IntVar(
+		&c.CacheMemory,
+		"cache-memory",
+		cache.DefaultMemoryBudget>>20,
+		"Approximate memory in MiB that may be used to cache the content of source files. "+
+			"Least recently used data is evicted once the budget is exceeded.",
+	)
+	command.PersistentFlags().StringVar(
+		&c.FileCache,
+		"filecache",
+		config.FileCacheWalk,
+		"How to discover the packages of the source module: '"+config.FileCacheWalk+"' infers them from the directory layout "+
+			"while '"+config.FileCacheGoList+"' loads them via 'go list', which excludes directories such as 'testdata' that the "+
+			"Go tool does not consider to be packages.",
+	)
 }
 
 func attachSplitFlags(command *cobra.Command, c *config.CLIConfig) {
@@ -44,6 +60,27 @@ func attachSplitFlags(command *cobra.Command, c *config.CLIConfig) {
 		false,
 		"Perform the full split flow but do not push results to the remote split repositories",
 	)
+	command.Flags().StringVar(
+		&c.BundleDirectory,
+		"bundle-directory",
+		"",
+		"Directory to which to write a git bundle with the new content of each split as well as a manifest, instead of "+
+			"pushing to the remote split repositories. The bundles can be pushed later on via the 'apply-bundles' command.",
+	)
+	command.Flags().BoolVar(
+		&c.Atomic,
+		"atomic",
+		false,
+		"Push the results to the remote split repositories in an all-or-nothing fashion. Remotes are checked before "+
+			"anything is pushed and already pushed splits are reverted if any push fails.",
+	)
+	command.Flags().BoolVar(
+		&c.OverwriteManualChanges,
+		"overwrite-manual-changes",
+		false,
+		"Overwrite commits in split repositories that were not produced by modularise. By default the split is aborted "+
+			"when such commits are detected.",
+	)
 	command.Flags().StringVarP(
 		&c.WorkDirectory,
 		"work-directory",
@@ -52,4 +89,40 @@ func attachSplitFlags(command *cobra.Command, c *config.CLIConfig) {
 		"Directory to which to write all newly created content for all configured splits. Any existing content will be removed. "+
 			"If not specified a temporary folder will be used.",
 	)
+	command.Flags().StringVar(
+		&c.SourceBranch,
+		"source-branch",
+		"",
+		"Name of the source project's branch used to select the split branches via the configured branch mapping. "+
+			"If not specified it is detected from the source project's repository, e.g. if HEAD is detached on CI.",
+	)
+	command.Flags().StringVarP(
+		&c.MirrorDirectory,
+		"mirror-directory",
+		"m",
+		"",
+		"Directory in which to persist bare mirrors of the split repositories across runs. Mirrors are only updated with "+
+			"new remote content instead of being cloned from scratch. Must not be located inside the work directory.",
+	)
+}
+
+func attachCheckFlags(command *cobra.Command, c *config.CLIConfig) {
+	command.Flags().StringVar(
+		&c.Patch,
+		"patch",
+		"",
+		"Unified diff, as produced by 'git diff', to apply on top of the source module's files before checking the split "+
+			"configuration. Paths are relative to the root of the source repository. A directory mirroring the layout of "+
+			"the source module can be provided instead, in which case its files replace or add to those of the module.",
+	)
+}
+
+func attachApplyBundlesFlags(command *cobra.Command, c *config.CLIConfig) {
+	command.Flags().StringVar(
+		&c.BundleDirectory,
+		"bundle-directory",
+		"",
+		"Directory containing the split bundles and manifest written by the 'split' command.",
+	)
+	_ = command.MarkFlagRequired("bundle-directory")
 }
@@ -6,8 +6,8 @@ import (
 	"go/ast"
 	"go/parser"
 	"go/printer"
-	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -16,10 +16,14 @@ import (
 
 	"github.com/modularise/modularise/cmd/config"
 	"github.com/modularise/modularise/internal/filecache"
+	"github.com/modularise/modularise/internal/glob"
+	"github.com/modularise/modularise/internal/platforms"
 )
 
 // CleaveSplits will create the content of the configured splits in their respective working
-// directories. This includes the rewriting of import paths where needed.
+// directories. This includes the rewriting of import paths where needed. Go files that are not
+// included in the build for any of the configured build targets are not copied, as their imports
+// have not been taken into account when computing the splits' residuals.
 //
 // The prequisites on the fields of a config.Splits object for CleaveSplits to be able to operate
 // are:
@@ -40,8 +44,10 @@ func CleaveSplits(log *zap.Logger, fc filecache.FileCache, sp *config.Splits) er
 			delete(s.ResidualFiles, f)
 		}
 	}
+	sv := sourceVersion(log, fc, sp)
+	m := platforms.NewMatcher(fc, sp.BuildTargets)
 	for _, s := range sp.Splits {
-		c := cleaver{log: log.With(zap.String("split", s.Name)), fc: fc, s: s, sp: sp}
+		c := cleaver{log: log.With(zap.String("split", s.Name)), fc: fc, s: s, sp: sp, sourceVersion: sv, matcher: m}
 		if err := c.cleaveSplit(); err != nil {
 			return err
 		}
@@ -88,53 +94,110 @@ func computeSplitRoot(fs map[string]bool) string {
 }
 
 type cleaver struct {
-	log *zap.Logger
-	fc  filecache.FileCache
-	s   *config.Split
-	sp  *config.Splits
+	log           *zap.Logger
+	fc            filecache.FileCache
+	s             *config.Split
+	sp            *config.Splits
+	sourceVersion string
+	matcher       *platforms.Matcher
+	excludes      []*regexp.Regexp
+	rewriteFiles  []*regexp.Regexp
+	pathRE        *regexp.Regexp
+	native        *nativeDeps
 }
 
 func (c cleaver) cleaveSplit() error {
 	c.log.Debug("Cleaving split.")
-	for f := range c.s.Files {
-		if err := c.copyFileToWorkDir(f, false); err != nil {
-			return err
-		}
+	if err := c.checkPlacements(); err != nil {
+		return err
 	}
-	for f := range c.s.ResidualFiles {
-		if err := c.copyFileToWorkDir(f, true); err != nil {
+	for _, e := range c.s.ExcludeFiles {
+		re, err := glob.Compile(strings.TrimSuffix(filepath.ToSlash(e), "/") + "/**")
+		if err != nil {
+			c.log.Error("Invalid file exclusion pattern.", zap.String("pattern", e), zap.Error(err))
 			return err
 		}
+		c.excludes = append(c.excludes, re)
+	}
+	if err := c.setupRewrites(); err != nil {
+		return err
+	}
+	c.native = newNativeDeps()
+
+	if err := c.copyFiles(c.s.Files, false); err != nil {
+		return err
+	}
+	if err := c.copyFiles(c.s.ResidualFiles, true); err != nil {
+		return err
+	}
+	if err := c.copyNativeDeps(); err != nil {
+		return err
 	}
 
 	if err := c.copyMetafiles(); err != nil {
 		return err
 	}
+	// Extra files are copied last so that they may override any of the generated metafiles.
+	if err := c.copyExtraFiles(); err != nil {
+		return err
+	}
 	return nil
 }
 
-var internalPathRE = regexp.MustCompile(`(^|/)internal($|/)`)
+func (c cleaver) copyFiles(fs map[string]bool, residual bool) error {
+	for f := range fs {
+		if c.isExcluded(f) {
+			if dir, ok := c.s.EmbedFiles[f]; ok {
+				c.log.Error("Excluded file is embedded by a package of the split.", zap.String("file", f), zap.String("embedded-by", dir))
+				return fmt.Errorf("file %q embedded by %q is excluded from split %q", f, dir, c.s.Name)
+			}
+			continue
+		}
+		if ok, err := c.isBuilt(f); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		if err := c.copyFileToWorkDir(f, residual); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-func (c cleaver) copyFileToWorkDir(source string, residual bool) error {
-	var target string
+// isBuilt determines whether the given file is included in the build for any of the build targets.
+// Files other than Go files are always considered to be built.
+func (c cleaver) isBuilt(f string) (bool, error) {
+	if filepath.Ext(f) != ".go" {
+		return true, nil
+	}
+	ok, err := c.matcher.Match(f)
+	if err != nil {
+		c.log.Error("Failed to evaluate build constraints.", zap.String("file", f), zap.Error(err))
+		return false, err
+	}
+	if !ok {
+		c.log.Debug("Skipping file excluded by build constraints for all build targets.", zap.String("file", f))
+	}
+	return ok, nil
+}
 
-	if !residual || (strings.HasPrefix(source, c.s.Root+string(os.PathSeparator)) && !internalPathRE.MatchString(strings.TrimPrefix(source, c.s.Root))) {
-		target = strings.TrimPrefix(source, c.s.Root+string(os.PathSeparator))
-	} else {
-		target = filepath.Join(
-			"internal",
-			"residuals",
-			strings.ReplaceAll(strings.TrimPrefix(source, c.s.ResidualsRoot+string(os.PathSeparator)), "internal"+string(os.PathSeparator), ""),
-		)
+func (c cleaver) isExcluded(f string) bool {
+	for _, re := range c.excludes {
+		if re.MatchString(filepath.ToSlash(f)) {
+			c.log.Debug("Excluded file from split.", zap.String("file", f))
+			return true
+		}
 	}
-	target = filepath.Join(c.s.WorkDir, target)
+	return false
+}
 
-	c.log.Debug("Copying over file.", zap.String("source", source), zap.String("targer", target))
+func (c cleaver) copyFileToWorkDir(source string, residual bool) error {
+	dir, relocated := c.filePlacement(source, residual)
+	rel := filepath.Join(filepath.FromSlash(dir), filepath.Base(source))
+	target := filepath.Join(c.s.WorkDir, rel)
 
-	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-		c.log.Error("Failed to create a new directory.", zap.String("path", target), zap.Error(err))
-		return err
-	}
+	c.log.Debug("Copying over file.", zap.String("source", source), zap.String("targer", target))
 
 	var content []byte
 	if filepath.Ext(source) == ".go" {
@@ -143,6 +206,20 @@ func (c cleaver) copyFileToWorkDir(source string, residual bool) error {
 			return err
 		}
 		c.rewriteImports(a)
+		c.rewriteCgoPreamble(source, a)
+		c.rewriteComments(fs, a)
+		if c.sp.RewriteStringLiterals {
+			c.rewriteStringLiterals(fs, a)
+		}
+		if c.sp.CanonicalImportComments && !strings.HasSuffix(source, "_test.go") {
+			// Residual packages under 'internal/residuals' are not meant to be imported by anyone
+			// but the split itself, hence they should not advertise any import path.
+			var canonical string
+			if !relocated {
+				canonical = path.Join(c.s.ModulePath, filepath.ToSlash(filepath.Dir(rel)))
+			}
+			c.setImportComment(fs, a, canonical)
+		}
 		buf := bytes.Buffer{}
 		if err = printer.Fprint(&buf, fs, a); err != nil {
 			c.log.Error("Failed to format Go source content.", zap.String("file", target), zap.Error(err))
@@ -155,9 +232,24 @@ func (c cleaver) copyFileToWorkDir(source string, residual bool) error {
 		if err != nil {
 			return err
 		}
+		if c.rewritesFile(source) {
+			content = c.rewriteText(content)
+		}
+		if nativeExts[filepath.Ext(source)] {
+			content = []byte(c.rewriteNativeText(source, string(content), false))
+		}
+	}
+
+	return c.writeFile(target, content)
+}
+
+func (c cleaver) writeFile(target string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		c.log.Error("Failed to create a new directory.", zap.String("path", target), zap.Error(err))
+		return err
 	}
 
-	fd, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+	fd, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
 		c.log.Error("Failed to open file.", zap.String("file", target), zap.Error(err))
 		return err
@@ -175,62 +267,105 @@ func (c cleaver) copyFileToWorkDir(source string, residual bool) error {
 
 func (c cleaver) rewriteImports(a *ast.File) {
 	for _, imp := range a.Imports {
-		p := strings.Trim(imp.Path.Value, `"`)
-		if c.sp.PkgToSplit[p] != "" {
-			ts := c.sp.Splits[c.sp.PkgToSplit[p]]
-			p = strings.Replace(p, filepath.Join(c.fc.ModulePath(), ts.Root), ts.ModulePath, 1)
-		} else if c.s.Residuals[p] {
-			rp := strings.Join([]string{c.fc.ModulePath(), c.s.Root, ""}, "/")
-			if strings.HasPrefix(p, rp) && internalPathRE.MatchString(strings.TrimPrefix(p, rp)) {
-				p = strings.Replace(p, filepath.Join(c.fc.ModulePath(), c.s.Root), c.s.ModulePath, 1)
-			} else {
-				p = filepath.Join(
-					c.s.ModulePath,
-					"internal",
-					"residuals",
-					strings.ReplaceAll(strings.TrimPrefix(p, filepath.Join(c.fc.ModulePath(), c.s.ResidualsRoot)), "/internal", ""),
-				)
-			}
-		}
+		p := c.rewritePath(strings.Trim(imp.Path.Value, `"`))
 		c.log.Debug("Rewrote import.", zap.String("old", imp.Path.Value), zap.String("new", p))
 		imp.Path.Value = fmt.Sprintf(`"%s"`, p)
 	}
 }
 
-func (c cleaver) copyMetafiles() error {
-	metaFiles := []string{
-		"license",
-		"license.md",
-		"licence",
-		"licence.md",
-		"LICENSE",
-		"LICENSE.md",
-		"LICENCE",
-		"LICENCE.md",
-	}
-
-	for _, fn := range metaFiles {
-		if !c.fc.Files()[fn] {
-			continue
+// rewritePath maps the path of a package of the source module to its path in the split that it is
+// part of, either as a regular package or as a residual of the current split. The path is returned
+// unchanged if the package is not part of any split.
+func (c cleaver) rewritePath(p string) string {
+	if c.sp.PkgToSplit[p] != "" {
+		ts := c.sp.Splits[c.sp.PkgToSplit[p]]
+		p = strings.Replace(p, filepath.Join(c.fc.ModulePath(), ts.Root), ts.ModulePath, 1)
+	} else if c.s.Residuals[p] {
+		dir := "."
+		if p != c.fc.ModulePath() {
+			dir = strings.TrimPrefix(p, c.fc.ModulePath()+"/")
 		}
+		d, _ := c.placement(dir, true)
+		p = path.Join(c.s.ModulePath, d)
+	}
+	return p
+}
 
-		var b []byte
-		b, err := c.fc.ReadFile(fn)
+func (c cleaver) copyExtraFiles() error {
+	for _, e := range c.s.ExtraFiles {
+		fs, err := c.resolveExtraFile(e)
 		if err != nil {
 			return err
 		}
-		p := filepath.Join(c.s.WorkDir, fn)
-		if err = ioutil.WriteFile(p, b, 0644); err != nil {
-			c.log.Error("Failed to write metadata file.", zap.String("file", p), zap.Error(err))
-			return err
+
+		for source, target := range fs {
+			if c.isExcluded(source) {
+				continue
+			}
+			b, err := c.fc.ReadFile(source)
+			if err != nil {
+				return err
+			}
+			if c.rewritesFile(source) {
+				b = c.rewriteText(b)
+			}
+			target = filepath.Join(c.s.WorkDir, target)
+			c.log.Debug("Copying over extra file.", zap.String("source", source), zap.String("target", target))
+			if err = c.writeFile(target, b); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
+}
 
-	rmc := fmt.Sprintf(splitReadmeTemplate, c.fc.ModulePath())
-	p := filepath.Join(c.s.WorkDir, "README.md")
-	if err := ioutil.WriteFile(p, []byte(rmc), 0644); err != nil {
-		c.log.Error("Failed to write the default README.md file.", zap.String("path", p), zap.Error(err))
-		return err
+// resolveExtraFile computes the files matched by the ExtraFile's source and maps each of them to
+// its target path relative to the split's root.
+func (c cleaver) resolveExtraFile(e config.ExtraFile) (map[string]string, error) {
+	source := filepath.ToSlash(filepath.Clean(e.Source))
+
+	var re *regexp.Regexp
+	var base string
+	if glob.IsGlob(source) {
+		var err error
+		if re, err = glob.Compile(source); err != nil {
+			c.log.Error("Invalid extra file pattern.", zap.String("pattern", e.Source), zap.Error(err))
+			return nil, err
+		}
+		base = glob.LiteralDir(source)
+	} else if c.fc.Files()[source] {
+		target := e.Destination
+		if target == "" {
+			target = source
+		}
+		return map[string]string{source: target}, nil
+	} else if source != "." {
+		base = source
 	}
-	return nil
+
+	target := e.Destination
+	if target == "" {
+		target = base
+	}
+	fs := map[string]string{}
+	for f := range c.fc.Files() {
+		f = filepath.ToSlash(f)
+		if re != nil && !re.MatchString(f) {
+			continue
+		}
+		if base != "" && !strings.HasPrefix(f, base+"/") {
+			continue
+		}
+		fs[f] = filepath.Join(target, strings.TrimPrefix(f, base))
+	}
+
+	if len(fs) == 0 {
+		if re != nil {
+			c.log.Warn("Extra file pattern does not match any file.", zap.String("pattern", e.Source))
+			return fs, nil
+		}
+		c.log.Error("Extra file does not exist in the source module.", zap.String("path", e.Source))
+		return nil, fmt.Errorf("extra file %q of split %q does not exist", e.Source, c.s.Name)
+	}
+	return fs, nil
 }
@@ -3,6 +3,8 @@ package chopper
 import (
 	"fmt"
 	"go/ast"
+	"go/parser"
+	"go/token"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -15,6 +17,7 @@ import (
 	"github.com/modularise/modularise/cmd/config"
 	"github.com/modularise/modularise/internal/filecache/testcache"
 	"github.com/modularise/modularise/internal/filecache/uncache"
+	"github.com/modularise/modularise/internal/platforms"
 	"github.com/modularise/modularise/internal/splits"
 	"github.com/modularise/modularise/internal/testlib"
 )
@@ -202,6 +205,151 @@ func TestRewriteImports(t *testing.T) {
 	}
 }
 
+func TestResolveExtraFile(t *testing.T) {
+	t.Parallel()
+
+	fc, err := testcache.NewFakeFileCache("invalid-root", map[string]testcache.FakeFileCacheEntry{
+		"go.mod":             {Data: []byte("module foo.com/bar")},
+		"CODEOWNERS":         {Data: []byte("* @owner")},
+		"proto/api.proto":    {Data: []byte("syntax = \"proto3\";")},
+		"proto/v1/api.proto": {Data: []byte("syntax = \"proto3\";")},
+	})
+	testlib.NoError(t, true, err)
+
+	tcs := map[string]struct {
+		extra    config.ExtraFile
+		expected map[string]string
+		err      bool
+	}{
+		"File":             {extra: config.ExtraFile{Source: "CODEOWNERS", Destination: ".github/CODEOWNERS"}, expected: map[string]string{"CODEOWNERS": ".github/CODEOWNERS"}},
+		"Directory":        {extra: config.ExtraFile{Source: "proto/v1"}, expected: map[string]string{"proto/v1/api.proto": "proto/v1/api.proto"}},
+		"Glob":             {extra: config.ExtraFile{Source: "proto/**/*.proto", Destination: "api"}, expected: map[string]string{"proto/api.proto": "api/api.proto", "proto/v1/api.proto": "api/v1/api.proto"}},
+		"ModuleRoot":       {extra: config.ExtraFile{Source: ".", Destination: "source"}, expected: map[string]string{"go.mod": "source/go.mod", "CODEOWNERS": "source/CODEOWNERS", "proto/api.proto": "source/proto/api.proto", "proto/v1/api.proto": "source/proto/v1/api.proto"}},
+		"ModuleRootGlob":   {extra: config.ExtraFile{Source: "*.proto"}, expected: map[string]string{}},
+		"MissingDirectory": {extra: config.ExtraFile{Source: "docs"}, err: true},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			c := cleaver{log: testlib.NewTestLogger(), fc: fc, s: &config.Split{DataSplit: splits.DataSplit{Name: "a"}}}
+			fs, err := c.resolveExtraFile(tc.extra)
+			if tc.err {
+				testlib.Error(t, false, err)
+				return
+			}
+			testlib.NoError(t, true, err)
+			testlib.Equal(t, false, tc.expected, fs)
+		})
+	}
+}
+
+func TestRewriteText(t *testing.T) {
+	t.Parallel()
+
+	fc, err := testcache.NewFakeFileCache("invalid-root", map[string]testcache.FakeFileCacheEntry{
+		"go.mod": {Data: []byte("module foo.com/bar")},
+	})
+	testlib.NoError(t, true, err)
+
+	a := &config.Split{ModulePath: "split.com/root/a", DataSplit: splits.DataSplit{
+		Name:          "a",
+		Root:          "a",
+		ResidualsRoot: ".",
+		Residuals:     map[string]bool{"foo.com/bar/util": true},
+	}}
+	c := cleaver{
+		log: testlib.NewTestLogger(),
+		fc:  fc,
+		s:   a,
+		sp: &config.Splits{
+			Splits: map[string]*config.Split{"a": a},
+			DataSplits: splits.DataSplits{
+				PkgToSplit: map[string]string{"foo.com/bar/a": "a", "foo.com/bar/a/pkg": "a"},
+			},
+		},
+	}
+	testlib.NoError(t, true, c.setupRewrites())
+
+	tcs := map[string]struct {
+		text     string
+		expected string
+	}{
+		"NoPaths":          {text: "nothing to see here", expected: "nothing to see here"},
+		"Package":          {text: "import foo.com/bar/a/pkg", expected: "import split.com/root/a/pkg"},
+		"Quoted":           {text: `go_package = "foo.com/bar/a/pkg";`, expected: `go_package = "split.com/root/a/pkg";`},
+		"SentenceEnd":      {text: "See foo.com/bar/a.", expected: "See split.com/root/a."},
+		"FileInPackage":    {text: "foo.com/bar/a/pkg/doc.go", expected: "split.com/root/a/pkg/doc.go"},
+		"UnknownSubpath":   {text: "foo.com/bar/a/unknown", expected: "split.com/root/a/unknown"},
+		"Residual":         {text: "go run foo.com/bar/util", expected: "go run split.com/root/a/internal/residuals/util"},
+		"NotInSplit":       {text: "foo.com/bar/b/pkg", expected: "foo.com/bar/b/pkg"},
+		"LongerModulePath": {text: "foo.com/barn/a foo.com/bar-x/a", expected: "foo.com/barn/a foo.com/bar-x/a"},
+		"Multiple":         {text: "foo.com/bar/a and foo.com/bar/a/pkg", expected: "split.com/root/a and split.com/root/a/pkg"},
+		"LdflagsSymbol":    {text: "-X foo.com/bar/a/pkg.Version=1.0", expected: "-X split.com/root/a/pkg.Version=1.0"},
+		"Linkname":         {text: "//go:linkname now foo.com/bar/a.now", expected: "//go:linkname now split.com/root/a.now"},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			testlib.Equal(t, false, tc.expected, string(c.rewriteText([]byte(tc.text))))
+		})
+	}
+}
+
+func TestRewriteStringLiterals(t *testing.T) {
+	t.Parallel()
+
+	fc, err := testcache.NewFakeFileCache("invalid-root", map[string]testcache.FakeFileCacheEntry{
+		"go.mod": {Data: []byte("module foo.com/bar")},
+	})
+	testlib.NoError(t, true, err)
+
+	a := &config.Split{ModulePath: "split.com/root/a", DataSplit: splits.DataSplit{Name: "a", Root: "a"}}
+	c := cleaver{
+		log: testlib.NewTestLogger(),
+		fc:  fc,
+		s:   a,
+		sp: &config.Splits{
+			Splits: map[string]*config.Split{"a": a},
+			DataSplits: splits.DataSplits{
+				PkgToSplit: map[string]string{"foo.com/bar/a": "a", "foo.com/bar/a/version": "a"},
+			},
+		},
+	}
+
+	tcs := map[string]struct {
+		literal  string
+		expected string
+	}{
+		"Package":        {literal: `"foo.com/bar/a"`, expected: `"split.com/root/a"`},
+		"RawString":      {literal: "`foo.com/bar/a/version`", expected: "`split.com/root/a/version`"},
+		"Symbol":         {literal: `"foo.com/bar/a/version.Version"`, expected: `"split.com/root/a/version.Version"`},
+		"Method":         {literal: `"foo.com/bar/a.(*Type).Method"`, expected: `"split.com/root/a.(*Type).Method"`},
+		"NotExact":       {literal: `"see foo.com/bar/a"`, expected: `"see foo.com/bar/a"`},
+		"UnknownPackage": {literal: `"foo.com/bar/a/other"`, expected: `"foo.com/bar/a/other"`},
+		"OtherModule":    {literal: `"foo.com/baz/a"`, expected: `"foo.com/baz/a"`},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			fs := token.NewFileSet()
+			f, err := parser.ParseFile(fs, "test.go", "package a\n\nvar v = "+tc.literal+"\n", 0)
+			testlib.NoError(t, true, err)
+
+			c.rewriteStringLiterals(fs, f)
+			testlib.Equal(t, false, tc.expected, f.Decls[0].(*ast.GenDecl).Specs[0].(*ast.ValueSpec).Values[0].(*ast.BasicLit).Value)
+		})
+	}
+}
+
 func TestCleaveSplit(t *testing.T) {
 	t.Parallel()
 
@@ -251,7 +399,7 @@ func TestCleaveSplit(t *testing.T) {
 				WorkDir:   p,
 			}}
 			sp := config.Splits{
-				Splits: map[string]*config.Split{"test": &s},
+				Splits: map[string]*config.Split{s.Name: &s},
 				DataSplits: splits.DataSplits{
 					PkgToSplit: map[string]string{},
 				},
@@ -271,6 +419,27 @@ func TestCleaveSplit(t *testing.T) {
 					sp.PkgToSplit[filepath.Join(fc.ModulePath(), filepath.Dir(f))] = s.Name
 				case strings.HasPrefix(l, "residual:"):
 					s.Residuals[strings.TrimSpace(strings.TrimPrefix(l, "residual:"))] = true
+				case strings.HasPrefix(l, "extra_file:"):
+					e := strings.SplitN(strings.TrimPrefix(l, "extra_file:"), "=>", 2)
+					ef := config.ExtraFile{Source: strings.TrimSpace(e[0])}
+					if len(e) > 1 {
+						ef.Destination = strings.TrimSpace(e[1])
+					}
+					s.ExtraFiles = append(s.ExtraFiles, ef)
+				case strings.HasPrefix(l, "template:"):
+					e := strings.SplitN(strings.TrimPrefix(l, "template:"), "=>", 2)
+					if s.Metafiles.Templates == nil {
+						s.Metafiles.Templates = map[string]string{}
+					}
+					s.Metafiles.Templates[strings.TrimSpace(e[0])] = strings.TrimSpace(e[1])
+				case strings.HasPrefix(l, "copy_metafile:"):
+					s.Metafiles.Copy = append(s.Metafiles.Copy, strings.TrimSpace(strings.TrimPrefix(l, "copy_metafile:")))
+				case l == "canonical_import_comments":
+					sp.CanonicalImportComments = true
+				case l == "keep_readme":
+					s.Metafiles.KeepReadme = true
+				case strings.HasPrefix(l, "exclude_file:"):
+					s.ExcludeFiles = append(s.ExcludeFiles, strings.TrimSpace(strings.TrimPrefix(l, "exclude_file:")))
 				default:
 					// ignore comments
 				}
@@ -286,10 +455,11 @@ func TestCleaveSplit(t *testing.T) {
 			}
 
 			cl := cleaver{
-				log: l,
-				fc:  fc,
-				s:   &s,
-				sp:  &sp,
+				log:     l,
+				fc:      fc,
+				s:       &s,
+				sp:      &sp,
+				matcher: platforms.NewMatcher(fc, nil),
 			}
 			err = cl.cleaveSplit()
 			testlib.NoError(t, true, err)
@@ -0,0 +1,159 @@
+package chopper
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"go.uber.org/zap"
+
+	"github.com/modularise/modularise/cmd/config"
+	"github.com/modularise/modularise/internal/filecache"
+	"github.com/modularise/modularise/internal/repohandler"
+)
+
+var defaultMetafiles = []string{
+	"license",
+	"license.md",
+	"licence",
+	"licence.md",
+	"LICENSE",
+	"LICENSE.md",
+	"LICENCE",
+	"LICENCE.md",
+}
+
+// metafileData is the data that is available to metafile templates.
+type metafileData struct {
+	Name          string
+	ModulePath    string
+	SourceModule  string
+	SourceVersion string
+	// Import paths of the packages in the split.
+	Packages []string
+	// Module paths of the splits on which the split depends.
+	Dependencies []string
+}
+
+// sourceVersion determines the revision of the source project. An empty string is returned if it
+// can not be determined.
+func sourceVersion(log *zap.Logger, fc filecache.FileCache, sp *config.Splits) string {
+	repo, err := repohandler.OpenSource(fc, sp)
+	if err != nil {
+		log.Debug("Could not open the source project's git repository.", zap.String("directory", fc.Root()), zap.Error(err))
+		return ""
+	}
+	h, err := repo.Head()
+	if err != nil {
+		log.Debug("Could not determine the source project's HEAD commit.", zap.String("directory", fc.Root()), zap.Error(err))
+		return ""
+	}
+	return h.Hash().String()[:12]
+}
+
+func (c cleaver) copyMetafiles() error {
+	metaFiles := defaultMetafiles
+	if c.s.Metafiles.Copy != nil {
+		metaFiles = c.s.Metafiles.Copy
+	} else if c.sp.Metafiles.Copy != nil {
+		metaFiles = c.sp.Metafiles.Copy
+	}
+
+	for _, fn := range metaFiles {
+		if !c.fc.Files()[fn] || c.isExcluded(fn) {
+			continue
+		}
+
+		var b []byte
+		b, err := c.fc.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		if err = c.writeFile(filepath.Join(c.s.WorkDir, filepath.Base(fn)), b); err != nil {
+			return err
+		}
+	}
+
+	templates := map[string]string{}
+	for dst, src := range c.sp.Metafiles.Templates {
+		templates[dst] = src
+	}
+	for dst, src := range c.s.Metafiles.Templates {
+		templates[dst] = src
+	}
+
+	data := c.metafileData()
+	if _, ok := templates["README.md"]; !ok && !c.keepReadme() {
+		if err := c.renderMetafile("README.md", "default README.md", splitReadmeTemplate, data); err != nil {
+			return err
+		}
+	}
+	for dst, src := range templates {
+		b, err := c.fc.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		if err = c.renderMetafile(dst, src, string(b), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c cleaver) keepReadme() bool {
+	if !c.s.Metafiles.KeepReadme && !c.sp.Metafiles.KeepReadme {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(c.s.WorkDir, "README.md"))
+	return err == nil
+}
+
+func (c cleaver) renderMetafile(dst string, name string, content string, data metafileData) error {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(content)
+	if err != nil {
+		c.log.Error("Failed to parse metafile template.", zap.String("template", name), zap.Error(err))
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, data); err != nil {
+		c.log.Error("Failed to render metafile template.", zap.String("template", name), zap.Error(err))
+		return err
+	}
+
+	p := filepath.Join(c.s.WorkDir, dst)
+	c.log.Debug("Rendered metafile.", zap.String("template", name), zap.String("file", p))
+	return c.writeFile(p, buf.Bytes())
+}
+
+func (c cleaver) metafileData() metafileData {
+	d := metafileData{
+		Name:          c.s.Name,
+		ModulePath:    c.s.ModulePath,
+		SourceModule:  c.fc.ModulePath(),
+		SourceVersion: c.sourceVersion,
+	}
+
+	pkgs := map[string]bool{}
+	for f := range c.s.Files {
+		if filepath.Ext(f) != ".go" || c.isExcluded(f) {
+			continue
+		}
+		rel := strings.TrimPrefix(filepath.ToSlash(filepath.Dir(f)), filepath.ToSlash(c.s.Root))
+		pkgs[path.Join(c.s.ModulePath, rel)] = true
+	}
+	for p := range pkgs {
+		d.Packages = append(d.Packages, p)
+	}
+	sort.Strings(d.Packages)
+
+	for sn := range c.s.SplitDeps {
+		d.Dependencies = append(d.Dependencies, c.sp.Splits[sn].ModulePath)
+	}
+	sort.Strings(d.Dependencies)
+	return d
+}
@@ -12,7 +12,7 @@ const splitReadmeTemplate = `# Modularised project
 > **!!! WARNING !!!**
 
 The Go module contained within this repository has been automatically generated to provide an
-independent and coherent subset of the functionality exposed by the larger scale ` + "`%s`" + ` Go
+independent and coherent subset of the functionality exposed by the larger scale ` + "`{{ .SourceModule }}`" + ` Go
 module.
 
 ## Documentation
@@ -0,0 +1,293 @@
+package chopper
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// nativeDir is the directory, relative to a split's root, in which C headers, sources and other
+// native dependencies that are not part of the split are placed at their path in the source module.
+const nativeDir = "internal/cgo"
+
+// nativeExts are the extensions of the non-Go source files that may be part of a Go package, either
+// via cgo or as assembly, and that may include other files.
+var nativeExts = map[string]bool{
+	".c":   true,
+	".cc":  true,
+	".cpp": true,
+	".cxx": true,
+	".h":   true,
+	".hh":  true,
+	".hpp": true,
+	".hxx": true,
+	".m":   true,
+	".s":   true,
+	".S":   true,
+	".sx":  true,
+}
+
+// toolchainHeaders are provided by the Go toolchain or generated by cgo and are hence never part of
+// the source module.
+var toolchainHeaders = map[string]bool{
+	"_cgo_export.h": true,
+	"funcdata.h":    true,
+	"go_asm.h":      true,
+	"go_tls.h":      true,
+	"textflag.h":    true,
+}
+
+var (
+	includeRE      = regexp.MustCompile(`(?m)^([ \t]*(?://|/\*)?[ \t]*#[ \t]*include[ \t]*")([^"\n]+)(")`)
+	cgoDirectiveRE = regexp.MustCompile(`(?m)^([ \t]*(?://)?[ \t]*#cgo\b[^:\n]*:)(.*)$`)
+	cgoPathFlagRE  = regexp.MustCompile(`(-[IL])([ \t]*)([^ \t]+)`)
+)
+
+// nativeDeps tracks the native files that are not part of a split but which are referenced by the
+// split's files and hence need to be copied into it.
+type nativeDeps struct {
+	files       map[string]bool
+	pending     []string
+	includeDirs map[string][]string
+}
+
+func newNativeDeps() *nativeDeps {
+	return &nativeDeps{files: map[string]bool{}, includeDirs: map[string][]string{}}
+}
+
+// rewriteCgoPreamble adjusts the relative paths in the '#include' and '#cgo' directives of the cgo
+// preamble of a Go file to the location of the file and of the referenced files in the split.
+func (c cleaver) rewriteCgoPreamble(source string, a *ast.File) {
+	for _, cg := range cgoPreambles(a) {
+		for _, cm := range cg.List {
+			cm.Text = c.rewriteNativeText(source, cm.Text, true)
+		}
+	}
+}
+
+// rewriteNativeText adjusts the relative paths of the '#include' directives, and if requested of
+// the '#cgo' directives, in the given content of a source file.
+func (c cleaver) rewriteNativeText(source string, text string, cgo bool) string {
+	text = includeRE.ReplaceAllStringFunc(text, func(m string) string {
+		sm := includeRE.FindStringSubmatch(m)
+		return sm[1] + c.rewriteInclude(source, sm[2]) + sm[3]
+	})
+	if !cgo {
+		return text
+	}
+	return cgoDirectiveRE.ReplaceAllStringFunc(text, func(m string) string {
+		sm := cgoDirectiveRE.FindStringSubmatch(m)
+		return sm[1] + cgoPathFlagRE.ReplaceAllStringFunc(sm[2], func(f string) string {
+			fm := cgoPathFlagRE.FindStringSubmatch(f)
+			return fm[1] + fm[2] + c.rewriteCgoPath(source, fm[1], fm[3])
+		})
+	})
+}
+
+func (c cleaver) rewriteInclude(source string, inc string) string {
+	if toolchainHeaders[path.Base(inc)] || path.IsAbs(inc) {
+		return inc
+	}
+
+	dir := filepath.ToSlash(filepath.Dir(source))
+	if f := path.Join(dir, inc); c.fc.Files()[filepath.FromSlash(f)] {
+		if !c.addNativeDep(source, f) {
+			return inc
+		}
+		r := relPath(path.Dir(c.locate(source)), c.locate(f))
+		if r != path.Clean(inc) {
+			c.log.Debug("Rewrote include.", zap.String("file", source), zap.String("old", inc), zap.String("new", r))
+			return r
+		}
+		return inc
+	}
+
+	// Files found via an include directory are relocated together with it.
+	for _, d := range c.includeDirs(dir) {
+		if f := path.Join(d, inc); c.fc.Files()[filepath.FromSlash(f)] {
+			c.addNativeDep(source, f)
+			return inc
+		}
+	}
+
+	c.log.Warn("Unable to resolve native dependency.", zap.String("file", source), zap.String("include", inc))
+	return inc
+}
+
+func (c cleaver) rewriteCgoPath(source string, flag string, p string) string {
+	var srcDir bool
+	rel := p
+	if strings.HasPrefix(p, "${SRCDIR}") {
+		srcDir = true
+		rel = strings.TrimPrefix(strings.TrimPrefix(p, "${SRCDIR}"), "/")
+	} else if path.IsAbs(p) {
+		return p
+	}
+	if rel == "" {
+		rel = "."
+	}
+
+	d := path.Join(filepath.ToSlash(filepath.Dir(source)), rel)
+	if d == ".." || strings.HasPrefix(d, "../") {
+		c.log.Warn("Native dependency is outside of the source module.", zap.String("file", source), zap.String("path", p))
+		return p
+	}
+	if flag == "-L" && !c.hasSplitFilesIn(d) {
+		// Libraries to link against can not be determined precisely, hence copy the entire directory.
+		for f := range c.fc.Files() {
+			if filepath.ToSlash(filepath.Dir(f)) == d {
+				c.addNativeDep(source, filepath.ToSlash(f))
+			}
+		}
+	}
+
+	r := relPath(path.Dir(c.locate(source)), c.locateDir(d))
+	if r == path.Clean(rel) {
+		return p
+	}
+	c.log.Debug("Rewrote cgo directive path.", zap.String("file", source), zap.String("old", p), zap.String("new", r))
+	if !srcDir {
+		return r
+	} else if r == "." {
+		return "${SRCDIR}"
+	}
+	return "${SRCDIR}/" + r
+}
+
+// addNativeDep registers a file referenced by a native directive in the given source file. Files
+// that are not part of the split are copied into it. It returns false if the file is excluded from
+// the split.
+func (c cleaver) addNativeDep(source string, f string) bool {
+	if c.isExcluded(filepath.FromSlash(f)) {
+		c.log.Warn("Native dependency is excluded from the split.", zap.String("file", source), zap.String("dependency", f))
+		return false
+	}
+	if c.s.Files[filepath.FromSlash(f)] || c.s.ResidualFiles[filepath.FromSlash(f)] || c.native.files[f] {
+		return true
+	}
+	c.log.Info("Copying native dependency into split.", zap.String("file", source), zap.String("dependency", f))
+	c.native.files[f] = true
+	c.native.pending = append(c.native.pending, f)
+	return true
+}
+
+// copyNativeDeps copies the native dependencies that are not part of the split, including those that
+// they reference themselves.
+func (c cleaver) copyNativeDeps() error {
+	for len(c.native.pending) > 0 {
+		f := c.native.pending[0]
+		c.native.pending = c.native.pending[1:]
+
+		b, err := c.fc.ReadFile(filepath.FromSlash(f))
+		if err != nil {
+			return err
+		}
+		if nativeExts[path.Ext(f)] {
+			b = []byte(c.rewriteNativeText(f, string(b), false))
+		}
+		if err = c.writeFile(filepath.Join(c.s.WorkDir, filepath.FromSlash(c.locate(f))), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// locate returns the path of a file of the source module within the split.
+func (c cleaver) locate(f string) string {
+	of := filepath.FromSlash(f)
+	if c.s.Files[of] || c.s.ResidualFiles[of] {
+		d, _ := c.filePlacement(of, !c.s.Files[of])
+		return path.Join(d, path.Base(f))
+	}
+	return path.Join(nativeDir, filepath.ToSlash(f))
+}
+
+// locateDir returns the path of a directory of the source module within the split.
+func (c cleaver) locateDir(d string) string {
+	for f := range c.s.Files {
+		if filepath.ToSlash(filepath.Dir(f)) == d {
+			p, _ := c.placement(d, false)
+			return p
+		}
+	}
+	for f := range c.s.ResidualFiles {
+		if filepath.ToSlash(filepath.Dir(f)) == d {
+			p, _ := c.placement(d, true)
+			return p
+		}
+	}
+	return path.Join(nativeDir, d)
+}
+
+func (c cleaver) hasSplitFilesIn(d string) bool {
+	return c.locateDir(d) != path.Join(nativeDir, d)
+}
+
+// includeDirs returns the directories, relative to the source module's root, that are specified via
+// '-I' flags in the cgo preambles of the Go files in the given directory.
+func (c cleaver) includeDirs(dir string) []string {
+	if ds, ok := c.native.includeDirs[dir]; ok {
+		return ds
+	}
+
+	var ds []string
+	for f := range c.fc.Files() {
+		if filepath.Ext(f) != ".go" || filepath.ToSlash(filepath.Dir(f)) != dir {
+			continue
+		}
+		a, _, err := c.fc.ReadGoFile(f, parser.ParseComments)
+		if err != nil {
+			continue
+		}
+		for _, cg := range cgoPreambles(a) {
+			for _, m := range cgoDirectiveRE.FindAllStringSubmatch(cg.Text(), -1) {
+				for _, fm := range cgoPathFlagRE.FindAllStringSubmatch(m[2], -1) {
+					p := strings.TrimPrefix(strings.TrimPrefix(fm[3], "${SRCDIR}"), "/")
+					if fm[1] == "-I" && !path.IsAbs(fm[3]) {
+						ds = append(ds, path.Join(dir, p))
+					}
+				}
+			}
+		}
+	}
+	c.native.includeDirs[dir] = ds
+	return ds
+}
+
+// cgoPreambles returns the comments preceding any 'import "C"' statement of a Go file.
+func cgoPreambles(a *ast.File) []*ast.CommentGroup {
+	var cgs []*ast.CommentGroup
+	for _, d := range a.Decls {
+		gd, ok := d.(*ast.GenDecl)
+		if !ok || gd.Tok != token.IMPORT {
+			continue
+		}
+		for _, sp := range gd.Specs {
+			is := sp.(*ast.ImportSpec)
+			if is.Path.Value != `"C"` {
+				continue
+			}
+			if is.Doc != nil {
+				cgs = append(cgs, is.Doc)
+			} else if gd.Doc != nil && len(gd.Specs) == 1 {
+				cgs = append(cgs, gd.Doc)
+			}
+		}
+	}
+	return cgs
+}
+
+// relPath returns the relative path from one directory of a split to a path of the same split.
+func relPath(from string, to string) string {
+	r, err := filepath.Rel(filepath.FromSlash(from), filepath.FromSlash(to))
+	if err != nil {
+		return to
+	}
+	return filepath.ToSlash(r)
+}
@@ -0,0 +1,143 @@
+package chopper
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/modularise/modularise/cmd/config"
+)
+
+var internalPathRE = regexp.MustCompile(`(^|/)internal($|/)`)
+
+// placement computes the directory, relative to the split's root, at which the content of the given
+// source directory is placed. Directories of packages that are part of the split, as well as those
+// of residual packages within an 'internal' directory below the split's root, retain their relative
+// position. Other residual packages are relocated according to the split's ResidualPlacement, which
+// is indicated by the returned boolean. Packages that are only required by the split's tests are
+// relocated under 'internal/testresiduals' instead of 'internal/residuals'. All paths use forward
+// slashes.
+func (c cleaver) placement(dir string, residual bool) (string, bool) {
+	root := filepath.ToSlash(c.s.Root)
+
+	rel, inRoot := dir, true
+	switch {
+	case root == "" || root == ".":
+	case dir == root:
+		rel = "."
+	case strings.HasPrefix(dir, root+"/"):
+		rel = strings.TrimPrefix(dir, root+"/")
+	default:
+		inRoot = false
+	}
+	if !residual || (inRoot && internalPathRE.MatchString(rel)) {
+		return rel, false
+	}
+	return c.residualPlacement(dir), true
+}
+
+// filePlacement computes the directory, relative to the split's root, at which the given file is
+// placed. Files embedded via '//go:embed' directives are placed relative to the embedding package.
+func (c cleaver) filePlacement(f string, residual bool) (string, bool) {
+	dir := filepath.ToSlash(filepath.Dir(f))
+	owner, ok := c.s.EmbedFiles[f]
+	if !ok {
+		return c.placement(dir, residual)
+	}
+
+	owner = filepath.ToSlash(owner)
+	d, relocated := c.placement(owner, residual)
+	switch {
+	case dir == owner:
+		return d, relocated
+	case owner == ".":
+		return path.Join(d, dir), relocated
+	default:
+		return path.Join(d, strings.TrimPrefix(dir, owner+"/")), relocated
+	}
+}
+
+func (c cleaver) residualPlacement(dir string) string {
+	base := "residuals"
+	pkg := c.fc.ModulePath()
+	if dir != "." {
+		pkg = path.Join(pkg, dir)
+	}
+	if c.s.TestResiduals[pkg] {
+		base = "testresiduals"
+	}
+
+	rp := c.s.ResidualPlacement
+	switch rp.Strategy {
+	case config.ResidualStrategyMapping:
+		if d, ok := rp.Mapping[dir]; ok {
+			return path.Clean(filepath.ToSlash(d))
+		}
+	case config.ResidualStrategyPreserve:
+		// Residuals that already reside in the source module's top-level 'internal' directory are not
+		// nested in a second one.
+		if base == "residuals" {
+			if dir == "internal" || strings.HasPrefix(dir, "internal/") {
+				return dir
+			}
+			return path.Join("internal", dir)
+		}
+		return path.Join("internal", base, dir)
+	}
+
+	rel := dir
+	if r := filepath.ToSlash(c.s.ResidualsRoot); r != "" && r != "." {
+		rel = strings.TrimPrefix(strings.TrimPrefix(dir, r), "/")
+	}
+	elems := []string{"internal", base}
+	for _, e := range strings.Split(rel, "/") {
+		if e != "internal" && e != "." {
+			elems = append(elems, e)
+		}
+	}
+	return path.Join(elems...)
+}
+
+// checkPlacements verifies that no two source directories are placed at the same location within
+// the split.
+func (c cleaver) checkPlacements() error {
+	placed := map[string]map[string]bool{}
+	add := func(fs map[string]bool, residual bool) {
+		for f := range fs {
+			src := filepath.ToSlash(filepath.Dir(f))
+			dst, _ := c.filePlacement(f, residual)
+			if placed[dst] == nil {
+				placed[dst] = map[string]bool{}
+			}
+			placed[dst][src] = true
+		}
+	}
+	add(c.s.Files, false)
+	add(c.s.ResidualFiles, true)
+
+	var collisions []string
+	for dst, srcs := range placed {
+		if len(srcs) < 2 {
+			continue
+		}
+		var ss []string
+		for s := range srcs {
+			ss = append(ss, s)
+		}
+		sort.Strings(ss)
+		collisions = append(collisions, fmt.Sprintf("%s <= %s", dst, strings.Join(ss, ", ")))
+	}
+	if len(collisions) == 0 {
+		return nil
+	}
+
+	sort.Strings(collisions)
+	c.log.Error("Several source directories would be placed at the same location in the split. Please configure a different residual placement.")
+	for _, col := range collisions {
+		c.log.Error(" - " + col)
+	}
+	return fmt.Errorf("colliding package placements in split %q", c.s.Name)
+}
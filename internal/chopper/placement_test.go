@@ -0,0 +1,165 @@
+package chopper
+
+import (
+	"testing"
+
+	"github.com/modularise/modularise/cmd/config"
+	"github.com/modularise/modularise/internal/filecache/testcache"
+	"github.com/modularise/modularise/internal/splits"
+	"github.com/modularise/modularise/internal/testlib"
+)
+
+func TestPlacement(t *testing.T) {
+	t.Parallel()
+
+	fc, err := testcache.NewFakeFileCache("", map[string]testcache.FakeFileCacheEntry{
+		"go.mod": {Data: []byte("module example.com/repo\n")},
+	})
+	testlib.NoError(t, true, err)
+
+	tcs := map[string]struct {
+		placement    config.ResidualPlacement
+		dir          string
+		residual     bool
+		testResidual bool
+		expected     string
+		relocated    bool
+	}{
+		"SplitPackage":           {dir: "lib/pkg", expected: "pkg"},
+		"SplitRoot":              {dir: "lib", expected: "."},
+		"InternalResidual":       {dir: "lib/internal/helper", residual: true, expected: "internal/helper"},
+		"FlattenDefault":         {dir: "internal/util/internal/strings", residual: true, expected: "internal/residuals/util/strings", relocated: true},
+		"FlattenExplicit":        {placement: config.ResidualPlacement{Strategy: config.ResidualStrategyFlatten}, dir: "util", residual: true, expected: "internal/residuals/util", relocated: true},
+		"Preserve":               {placement: config.ResidualPlacement{Strategy: config.ResidualStrategyPreserve}, dir: "internal/util", residual: true, expected: "internal/util", relocated: true},
+		"PreserveNonInternal":    {placement: config.ResidualPlacement{Strategy: config.ResidualStrategyPreserve}, dir: "util/internal/strings", residual: true, expected: "internal/util/internal/strings", relocated: true},
+		"Mapping":                {placement: config.ResidualPlacement{Strategy: config.ResidualStrategyMapping, Mapping: map[string]string{"internal/util": "internal/shared/util/"}}, dir: "internal/util", residual: true, expected: "internal/shared/util", relocated: true},
+		"MappingFallback":        {placement: config.ResidualPlacement{Strategy: config.ResidualStrategyMapping}, dir: "internal/util", residual: true, expected: "internal/residuals/util", relocated: true},
+		"ResidualAboveSplitRoot": {dir: ".", residual: true, expected: "internal/residuals", relocated: true},
+		"TestResidual":           {dir: "internal/util/internal/testutil", residual: true, testResidual: true, expected: "internal/testresiduals/util/testutil", relocated: true},
+		"TestResidualPreserve":   {placement: config.ResidualPlacement{Strategy: config.ResidualStrategyPreserve}, dir: "internal/testutil", residual: true, testResidual: true, expected: "internal/testresiduals/internal/testutil", relocated: true},
+		"TestResidualMapping":    {placement: config.ResidualPlacement{Strategy: config.ResidualStrategyMapping, Mapping: map[string]string{"testutil": "testing/util"}}, dir: "testutil", residual: true, testResidual: true, expected: "testing/util", relocated: true},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			c := cleaver{fc: fc, s: &config.Split{
+				ResidualPlacement: tc.placement,
+				DataSplit:         splits.DataSplit{Root: "lib", ResidualsRoot: "."},
+			}}
+			if tc.testResidual {
+				c.s.TestResiduals = map[string]bool{"example.com/repo/" + tc.dir: true}
+			}
+			d, r := c.placement(tc.dir, tc.residual)
+			testlib.Equal(t, false, tc.expected, d)
+			testlib.Equal(t, false, tc.relocated, r)
+		})
+	}
+}
+
+func TestCheckPlacements(t *testing.T) {
+	t.Parallel()
+
+	fc, err := testcache.NewFakeFileCache("", map[string]testcache.FakeFileCacheEntry{
+		"go.mod": {Data: []byte("module example.com/repo\n")},
+	})
+	testlib.NoError(t, true, err)
+
+	tcs := map[string]struct {
+		placement config.ResidualPlacement
+		residuals map[string]bool
+		collision bool
+	}{
+		"NoCollision": {
+			residuals: map[string]bool{"internal/a/a.go": true, "internal/b/b.go": true},
+		},
+		"FlattenCollision": {
+			residuals: map[string]bool{"internal/util/util.go": true, "util/internal/util.go": true},
+			collision: true,
+		},
+		"PreserveResolvesCollision": {
+			placement: config.ResidualPlacement{Strategy: config.ResidualStrategyPreserve},
+			residuals: map[string]bool{"internal/util/util.go": true, "util/internal/util.go": true},
+		},
+		"MappingCollision": {
+			placement: config.ResidualPlacement{Strategy: config.ResidualStrategyMapping, Mapping: map[string]string{"internal/a": "internal/residuals/b"}},
+			residuals: map[string]bool{"internal/a/a.go": true, "internal/b/b.go": true},
+			collision: true,
+		},
+		"CollisionWithSplitPackage": {
+			placement: config.ResidualPlacement{Strategy: config.ResidualStrategyMapping, Mapping: map[string]string{"util": "pkg"}},
+			residuals: map[string]bool{"util/util.go": true},
+			collision: true,
+		},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			c := cleaver{
+				log: testlib.NewTestLogger(),
+				fc:  fc,
+				s: &config.Split{
+					ResidualPlacement: tc.placement,
+					DataSplit: splits.DataSplit{
+						Name:          "split",
+						Root:          "lib",
+						ResidualsRoot: ".",
+						Files:         map[string]bool{"lib/lib.go": true, "lib/pkg/pkg.go": true},
+						ResidualFiles: tc.residuals,
+					},
+				},
+			}
+			testlib.Equal(t, false, tc.collision, c.checkPlacements() != nil)
+		})
+	}
+}
+
+func TestFilePlacement(t *testing.T) {
+	t.Parallel()
+
+	fc, err := testcache.NewFakeFileCache("", map[string]testcache.FakeFileCacheEntry{
+		"go.mod": {Data: []byte("module example.com/repo\n")},
+	})
+	testlib.NoError(t, true, err)
+
+	tcs := map[string]struct {
+		placement config.ResidualPlacement
+		file      string
+		residual  bool
+		expected  string
+	}{
+		"SplitFile":          {file: "lib/pkg/pkg.go", expected: "pkg"},
+		"SplitEmbed":         {file: "lib/pkg/static/sub/a.txt", expected: "pkg/static/sub"},
+		"ResidualEmbed":      {file: "util/testdata/a.json", residual: true, expected: "internal/residuals/util/testdata"},
+		"MappedResidual":     {placement: config.ResidualPlacement{Strategy: config.ResidualStrategyMapping, Mapping: map[string]string{"util": "internal/util"}}, file: "util/util.go", residual: true, expected: "internal/util"},
+		"MappedEmbed":        {placement: config.ResidualPlacement{Strategy: config.ResidualStrategyMapping, Mapping: map[string]string{"util": "internal/util"}}, file: "util/testdata/a.json", residual: true, expected: "internal/util/testdata"},
+		"EmbedOfRootPackage": {file: "static/a.txt", residual: true, expected: "internal/residuals/static"},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			c := cleaver{fc: fc, s: &config.Split{
+				ResidualPlacement: tc.placement,
+				DataSplit: splits.DataSplit{
+					Root:          "lib",
+					ResidualsRoot: ".",
+					EmbedFiles: map[string]string{
+						"lib/pkg/static/sub/a.txt": "lib/pkg",
+						"util/testdata/a.json":     "util",
+						"static/a.txt":             ".",
+					},
+				},
+			}}
+			d, _ := c.filePlacement(tc.file, tc.residual)
+			testlib.Equal(t, false, tc.expected, d)
+		})
+	}
+}
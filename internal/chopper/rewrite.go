@@ -0,0 +1,191 @@
+package chopper
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/modularise/modularise/internal/glob"
+)
+
+// defaultRewriteFiles are the globs of non-Go files in which package paths are rewritten if no
+// RewriteFiles are configured.
+var defaultRewriteFiles = []string{"**/*.md", "**/*.proto", "**/Makefile", "**/*.mk"}
+
+func (c *cleaver) setupRewrites() error {
+	rfs := c.sp.RewriteFiles
+	if rfs == nil {
+		rfs = defaultRewriteFiles
+	}
+	for _, rf := range rfs {
+		re, err := glob.Compile(rf)
+		if err != nil {
+			c.log.Error("Invalid rewrite file pattern.", zap.String("pattern", rf), zap.Error(err))
+			return err
+		}
+		c.rewriteFiles = append(c.rewriteFiles, re)
+	}
+	c.pathRE = regexp.MustCompile(regexp.QuoteMeta(c.fc.ModulePath()) + `(?:/[A-Za-z0-9_.~+\-]+)*`)
+	return nil
+}
+
+// rewritesFile determines whether package paths should be rewritten in the non-Go file with the
+// given path relative to the source module's root.
+func (c cleaver) rewritesFile(source string) bool {
+	for _, re := range c.rewriteFiles {
+		if re.MatchString(source) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteComments rewrites package paths in all comments of a Go file. This covers documentation as
+// well as directives such as '//go:generate', '//go:linkname' and canonical import comments. Any
+// rewritten directive is reported.
+func (c cleaver) rewriteComments(fs *token.FileSet, a *ast.File) {
+	for _, cg := range a.Comments {
+		for _, cm := range cg.List {
+			nt := string(c.rewriteText([]byte(cm.Text)))
+			if nt != cm.Text && strings.HasPrefix(cm.Text, "//go:") {
+				c.log.Info("Rewrote package path in directive.", zap.String("position", fs.Position(cm.Pos()).String()), zap.String("old", cm.Text), zap.String("new", nt))
+			}
+			cm.Text = nt
+		}
+	}
+}
+
+// rewriteStringLiterals rewrites Go string literals that consist exactly of the path of a package
+// that is part of a split, optionally qualified with the name of a symbol in that package as used
+// by '-ldflags -X' or reflection-based registries. Each rewrite is reported.
+func (c cleaver) rewriteStringLiterals(fs *token.FileSet, a *ast.File) {
+	ast.Inspect(a, func(n ast.Node) bool {
+		switch l := n.(type) {
+		case *ast.ImportSpec:
+			// Import paths have already been rewritten.
+			return false
+		case *ast.BasicLit:
+			if l.Kind != token.STRING {
+				return true
+			}
+			v, err := strconv.Unquote(l.Value)
+			if err != nil {
+				return true
+			}
+			p, ok := c.packagePrefix(v)
+			if !ok || (v != p && (!strings.HasPrefix(v[len(p):], ".") || strings.Contains(v[len(p):], "/"))) {
+				return true
+			}
+
+			nv := c.rewritePath(p) + strings.TrimPrefix(v, p)
+			if strings.HasPrefix(l.Value, "`") {
+				nv = "`" + nv + "`"
+			} else {
+				nv = strconv.Quote(nv)
+			}
+			c.log.Info("Rewrote package path in string literal.", zap.String("position", fs.Position(l.Pos()).String()), zap.String("old", l.Value), zap.String("new", nv))
+			l.Value = nv
+		}
+		return true
+	})
+}
+
+// packagePrefix returns the longest prefix of m that is the path of a package that is part of a
+// split. A prefix may end in the middle of the last path element of m if it is followed by a '.',
+// as is the case for references to symbols such as 'example.com/project/pkg.Symbol'.
+func (c cleaver) packagePrefix(m string) (string, bool) {
+	isPkg := func(p string) bool { return c.sp.PkgToSplit[p] != "" || c.s.Residuals[p] }
+
+	for p := m; len(p) >= len(c.fc.ModulePath()); p = path.Dir(p) {
+		if isPkg(p) {
+			return p, true
+		}
+		for i := strings.LastIndex(p, "."); i > strings.LastIndex(p, "/"); i = strings.LastIndex(p[:i], ".") {
+			if isPkg(p[:i]) {
+				return p[:i], true
+			}
+		}
+	}
+	return "", false
+}
+
+// rewriteText replaces any occurrence of the path of a package of the source module that is part of
+// a split with the corresponding path in the split. Occurrences that reference a file, directory or
+// symbol within such a package, e.g. 'example.com/project/pkg/file.go' or
+// 'example.com/project/pkg.Version', have their package prefix rewritten.
+func (c cleaver) rewriteText(b []byte) []byte {
+	if c.pathRE == nil {
+		return b
+	}
+
+	var out bytes.Buffer
+	var last int
+	for _, loc := range c.pathRE.FindAllIndex(b, -1) {
+		s, e := loc[0], loc[1]
+		// Don't rewrite paths that are part of a longer path or identifier.
+		if (s > 0 && isPathChar(b[s-1])) || (e < len(b) && isPathChar(b[e])) {
+			continue
+		}
+		m := strings.TrimRight(string(b[s:e]), ".")
+
+		p, ok := c.packagePrefix(m)
+		if !ok {
+			continue
+		}
+		np := c.rewritePath(p) + strings.TrimPrefix(m, p)
+		c.log.Debug("Rewrote package path.", zap.String("old", m), zap.String("new", np))
+		out.Write(b[last:s])
+		out.WriteString(np)
+		last = s + len(m)
+	}
+	out.Write(b[last:])
+	return out.Bytes()
+}
+
+func isPathChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.'
+}
+
+// setImportComment sets the canonical import comment on the package clause of a Go file to the
+// given package path, replacing any existing one. If the path is empty any existing canonical
+// import comment is removed.
+func (c cleaver) setImportComment(fs *token.FileSet, a *ast.File, pkg string) {
+	line := fs.Position(a.Name.End()).Line
+
+	var found bool
+	for i := 0; i < len(a.Comments); i++ {
+		cg := a.Comments[i]
+		if cg.Pos() < a.Name.End() || fs.Position(cg.Pos()).Line != line || !importCommentRE.MatchString(cg.List[0].Text) {
+			continue
+		}
+
+		if pkg == "" {
+			c.log.Debug("Removed canonical import comment.", zap.String("comment", cg.List[0].Text))
+			a.Comments = append(a.Comments[:i], a.Comments[i+1:]...)
+			i--
+			continue
+		}
+		cg.List = []*ast.Comment{{Slash: cg.List[0].Slash, Text: fmt.Sprintf("// import %q", pkg)}}
+		found = true
+	}
+	if found || pkg == "" {
+		return
+	}
+
+	cg := &ast.CommentGroup{List: []*ast.Comment{{Slash: a.Name.End(), Text: fmt.Sprintf("// import %q", pkg)}}}
+	i := sort.Search(len(a.Comments), func(i int) bool { return a.Comments[i].Pos() > cg.Pos() })
+	a.Comments = append(a.Comments, nil)
+	copy(a.Comments[i+1:], a.Comments[i:])
+	a.Comments[i] = cg
+	c.log.Debug("Added canonical import comment.", zap.String("package", pkg))
+}
+
+var importCommentRE = regexp.MustCompile(`^(?://\s*import\s+"[^"]*"\s*$|/\*\s*import\s+"[^"]*"\s*\*/$)`)
@@ -16,6 +16,7 @@ import (
 	"sync"
 
 	"go.uber.org/zap"
+	"golang.org/x/mod/modfile"
 )
 
 type ModuleInfo struct {
@@ -23,8 +24,35 @@ type ModuleInfo struct {
 	Path string `json:"path"`
 }
 
-func NewCache(log *zap.Logger, root string) (*Cache, error) {
-	const nonModuleListErr = "go list -m: not using modules"
+// Options determine which of the files in the module's directory tree are part of a Cache and how
+// much of their data is kept in memory.
+type Options struct {
+	// Restrict the cache to files that are tracked by git, i.e. that are part of its index.
+	TrackedOnly bool
+	// Exclude the files that are matched by the patterns of '.gitignore' files.
+	GitIgnore bool
+	// Approximate number of bytes that the cached content of files may take up.
+	// Defaults to DefaultMemoryBudget if not set.
+	MemoryBudget int64
+}
+
+// DefaultMemoryBudget is the memory budget of a Cache for which no explicit budget is configured.
+const DefaultMemoryBudget = 512 << 20
+
+func (o Options) memoryBudget() int64 {
+	if o.MemoryBudget <= 0 {
+		return DefaultMemoryBudget
+	}
+	return o.MemoryBudget
+}
+
+// NewCache creates a Cache for the Go module, or GOPATH project, located at the given root.
+func NewCache(log *zap.Logger, root string, opts Options) (*Cache, error) {
+	const (
+		nonModuleListErr = "go list -m: not using modules"
+		// Recent Go versions report the GOPATH mode that is selected outside of modules instead.
+		gopathModeListErr = "list -m cannot be used with GO111MODULE=off"
+	)
 
 	var err error
 	if root, err = filepath.Abs(root); err != nil {
@@ -43,8 +71,15 @@ func NewCache(log *zap.Logger, root string) (*Cache, error) {
 	cmd.Dir = root
 	cmd.Stderr = eb
 	cmd.Stdout = ob
+
+	c := &Cache{
+		log:  log,
+		root: root,
+		opts: opts,
+		data: newLRU(opts.memoryBudget()),
+	}
 	if err = cmd.Run(); err != nil {
-		if !strings.Contains(eb.String(), nonModuleListErr) {
+		if !strings.Contains(eb.String(), nonModuleListErr) && !strings.Contains(eb.String(), gopathModeListErr) {
 			log.Error("Unable to run 'go list -m -json'", zap.String("output", eb.String()), zap.Error(err))
 			return nil, errors.New("go list error")
 		}
@@ -56,25 +91,15 @@ func NewCache(log *zap.Logger, root string) (*Cache, error) {
 			log.Error("The root of the filecache is not inside the configured GOPATH.", zap.String("gopath", gp))
 			return nil, errors.New("provided root not part of GOPATH")
 		}
-
-		return &Cache{
-			log:  log,
-			root: root,
-			path: filepath.ToSlash(strings.TrimPrefix(root, gp)),
-		}, nil
-	}
-
-	var mi ModuleInfo
-	if err = json.Unmarshal(ob.Bytes(), &mi); err != nil {
-		log.Error("Unexpected output from 'go list -m -json'.", zap.String("output", ob.String()), zap.Error(err))
-		return nil, errors.New("go list error")
-	}
-
-	c := &Cache{
-		log:      log,
-		root:     mi.Dir,
-		path:     mi.Path,
-		fileData: map[string][]byte{},
+		c.path = filepath.ToSlash(strings.TrimPrefix(root, gp))
+	} else {
+		var mi ModuleInfo
+		if err = json.Unmarshal(ob.Bytes(), &mi); err != nil {
+			log.Error("Unexpected output from 'go list -m -json'.", zap.String("output", ob.String()), zap.Error(err))
+			return nil, errors.New("go list error")
+		}
+		c.root = mi.Dir
+		c.path = mi.Path
 	}
 
 	if err := c.populateFilesAndPkgs(); err != nil {
@@ -87,12 +112,18 @@ type Cache struct {
 	log  *zap.Logger
 	root string
 	path string
+	opts Options
 
-	files map[string]bool
-	pkgs  map[string]bool
+	files    map[string]bool
+	pkgs     map[string]bool
+	pkgFiles map[string]map[string]bool
+	nested   map[string]string
 
-	lock     sync.Mutex
-	fileData map[string][]byte
+	// File content is kept in a memory-bounded cache. ASTs are not cached as parsing a file's cached
+	// content is cheaper than copying an AST, which would be required to hand out ASTs that callers
+	// may modify.
+	lock sync.Mutex
+	data *lru
 }
 
 func (c *Cache) Root() string {
@@ -111,16 +142,18 @@ func (c *Cache) Files() map[string]bool {
 	return c.files
 }
 
+func (c *Cache) NestedModules() map[string]string {
+	return c.nested
+}
+
 func (c *Cache) FilesInPkg(pkg string) (map[string]bool, error) {
 	if !c.pkgs[pkg] {
 		c.log.Error("Supplied package is not part of module abstracted by this filecache.", zap.String("package", pkg), zap.String("module", c.path))
 		return nil, fmt.Errorf("package %q is not part of module %q", pkg, c.path)
 	}
-	fs := map[string]bool{}
-	for f := range c.files {
-		if filepath.Join(c.path, filepath.Dir(f)) == pkg {
-			fs[f] = true
-		}
+	fs := make(map[string]bool, len(c.pkgFiles[pkg]))
+	for f := range c.pkgFiles[pkg] {
+		fs[f] = true
 	}
 	return fs, nil
 }
@@ -134,14 +167,15 @@ func (c *Cache) ReadFile(path string) ([]byte, error) {
 
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	if c.fileData[path] == nil {
-		b, err := ioutil.ReadFile(filepath.Join(c.root, path))
-		if err != nil {
-			return nil, err
-		}
-		c.fileData[path] = b
+	if v, ok := c.data.get(path); ok {
+		return v.([]byte), nil
 	}
-	return c.fileData[path], nil
+	b, err := ioutil.ReadFile(filepath.Join(c.root, path))
+	if err != nil {
+		return nil, err
+	}
+	c.data.add(path, b, int64(len(b)))
+	return b, nil
 }
 
 func (c *Cache) ReadGoFile(path string, loadFlags parser.Mode) (*ast.File, *token.FileSet, error) {
@@ -171,8 +205,15 @@ func (c *Cache) populateFilesAndPkgs() (err error) {
 		return nil
 	}
 
+	filter, err := newFileFilter(c.log, c.root, c.opts)
+	if err != nil {
+		return err
+	}
+
 	files := map[string]bool{}
 	pkgs := map[string]bool{}
+	pkgFiles := map[string]map[string]bool{}
+	nested := map[string]string{}
 	err = filepath.Walk(c.root, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			c.log.Error("Failed to walk sub-directories of uncache.", zap.Error(err))
@@ -181,20 +222,38 @@ func (c *Cache) populateFilesAndPkgs() (err error) {
 
 		if fi.IsDir() {
 			if path == c.root {
-				return nil
+				return filter.loadDir(path)
 			} else if filepath.Base(path) == ".git" {
 				return filepath.SkipDir
+			} else if path == filepath.Join(c.root, "vendor") {
+				// Vendored packages are not part of the module itself.
+				return filepath.SkipDir
+			} else if filter.skip(path, strings.TrimPrefix(path, c.root+"/"), true) {
+				return filepath.SkipDir
 			}
-			if _, err = os.Stat(filepath.Join(path, "go.mod")); err == nil {
+			if b, err := ioutil.ReadFile(filepath.Join(path, "go.mod")); err == nil {
+				mp := modfile.ModulePath(b)
+				rel := strings.TrimPrefix(path, c.root+"/")
+				c.log.Info("Discovered nested module. Its packages are not part of the module and are treated as an external dependency.", zap.String("module", mp), zap.String("directory", rel))
+				nested[mp] = rel
 				return filepath.SkipDir
 			} else if !os.IsNotExist(err) {
 				c.log.Error("Could not gather information about a go.mod in uncache.", zap.Error(err))
 				return err
 			}
-			return nil
+			return filter.loadDir(path)
 		}
 
-		files[strings.TrimPrefix(path, c.root+"/")] = true
+		if filter.skip(path, strings.TrimPrefix(path, c.root+"/"), false) {
+			return nil
+		}
+		rel := strings.TrimPrefix(path, c.root+"/")
+		files[rel] = true
+		pkg := filepath.Join(c.path, filepath.Dir(rel))
+		if pkgFiles[pkg] == nil {
+			pkgFiles[pkg] = map[string]bool{}
+		}
+		pkgFiles[pkg][rel] = true
 		if filepath.Base(path) != "go.mod" && filepath.Ext(path) == ".go" {
 			pkgs[strings.Replace(filepath.Dir(path), c.root, c.path, 1)] = true
 		}
@@ -203,8 +262,11 @@ func (c *Cache) populateFilesAndPkgs() (err error) {
 	if err != nil {
 		return err
 	}
+	filter.report()
 
 	c.files = files
 	c.pkgs = pkgs
+	c.pkgFiles = pkgFiles
+	c.nested = nested
 	return nil
 }
@@ -0,0 +1,208 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"go.uber.org/zap"
+)
+
+const (
+	gitIgnoreFile    = ".gitignore"
+	moduleIgnoreFile = ".modulariseignore"
+)
+
+// Reasons for which a file is not part of a Cache.
+const (
+	skipModuleIgnore = "modulariseignore"
+	skipGitIgnore    = "gitignore"
+	skipUntracked    = "untracked"
+)
+
+// fileFilter decides which of the files encountered while walking the module's directory tree are
+// skipped. Files matched by the patterns of '.modulariseignore' files are always skipped, while
+// the other criteria are determined by the cache's Options.
+type fileFilter struct {
+	log  *zap.Logger
+	opts Options
+	// Directory against which the paths of tracked files and the domains of ignore patterns are
+	// resolved. This is the root of the git working tree if there is one and the module's root
+	// otherwise.
+	base string
+
+	tracked     map[string]bool
+	trackedDirs map[string]bool
+	gitIgnores  []gitignore.Pattern
+	modIgnores  []gitignore.Pattern
+	// Matchers for the patterns loaded so far. They are rebuilt whenever new patterns are loaded.
+	gitMatcher gitignore.Matcher
+	modMatcher gitignore.Matcher
+
+	skipped map[string]string
+}
+
+func newFileFilter(log *zap.Logger, root string, opts Options) (*fileFilter, error) {
+	f := &fileFilter{
+		log:        log,
+		opts:       opts,
+		base:       root,
+		gitMatcher: gitignore.NewMatcher(nil),
+		modMatcher: gitignore.NewMatcher(nil),
+		skipped:    map[string]string{},
+	}
+	if !opts.TrackedOnly && !opts.GitIgnore {
+		return f, nil
+	}
+
+	repo, err := git.PlainOpenWithOptions(root, &git.PlainOpenOptions{DetectDotGit: true})
+	if err == git.ErrRepositoryNotExists && !opts.TrackedOnly {
+		log.Debug("Module is not part of a git repository. Only its own '.gitignore' files are taken into account.")
+		return f, nil
+	} else if err != nil {
+		log.Error("Could not open the git repository containing the module.", zap.Error(err))
+		return nil, err
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		log.Error("Failed to load the git working tree containing the module.", zap.Error(err))
+		return nil, err
+	}
+	f.base = wt.Filesystem.Root()
+
+	if opts.TrackedOnly {
+		idx, err := repo.Storer.Index()
+		if err != nil {
+			log.Error("Failed to read the git index.", zap.Error(err))
+			return nil, err
+		}
+		f.tracked = map[string]bool{}
+		f.trackedDirs = map[string]bool{}
+		for _, e := range idx.Entries {
+			f.tracked[e.Name] = true
+			for d := filepath.ToSlash(filepath.Dir(e.Name)); d != "."; d = filepath.ToSlash(filepath.Dir(d)) {
+				f.trackedDirs[d] = true
+			}
+		}
+	}
+
+	// Ignore files located between the root of the working tree and the module's root apply as well.
+	rel, err := filepath.Rel(f.base, root)
+	if err != nil {
+		log.Error("Could not determine the module's location within its git working tree.", zap.Error(err))
+		return nil, err
+	}
+	if rel != "." {
+		d := f.base
+		for _, e := range strings.Split(filepath.ToSlash(rel), "/") {
+			if err = f.loadDir(d); err != nil {
+				return nil, err
+			}
+			d = filepath.Join(d, e)
+		}
+	}
+	return f, nil
+}
+
+// loadDir reads the patterns of the ignore files in the given directory, if any.
+func (f *fileFilter) loadDir(dir string) error {
+	domain := f.split(dir)
+	ps, err := readIgnoreFile(filepath.Join(dir, moduleIgnoreFile), domain)
+	if err != nil {
+		f.log.Error("Failed to read ignore file.", zap.String("file", filepath.Join(dir, moduleIgnoreFile)), zap.Error(err))
+		return err
+	}
+	if len(ps) > 0 {
+		f.modIgnores = append(f.modIgnores, ps...)
+		f.modMatcher = gitignore.NewMatcher(f.modIgnores)
+	}
+
+	if !f.opts.GitIgnore {
+		return nil
+	}
+	if ps, err = readIgnoreFile(filepath.Join(dir, gitIgnoreFile), domain); err != nil {
+		f.log.Error("Failed to read ignore file.", zap.String("file", filepath.Join(dir, gitIgnoreFile)), zap.Error(err))
+		return err
+	}
+	if len(ps) > 0 {
+		f.gitIgnores = append(f.gitIgnores, ps...)
+		f.gitMatcher = gitignore.NewMatcher(f.gitIgnores)
+	}
+	return nil
+}
+
+// skip determines whether the given file or directory should be skipped. Skipped paths are recorded
+// for reporting via the given path relative to the module's root.
+func (f *fileFilter) skip(path string, rel string, isDir bool) bool {
+	p := f.split(path)
+	var reason string
+	switch {
+	case f.modMatcher.Match(p, isDir):
+		reason = skipModuleIgnore
+	case f.opts.GitIgnore && f.gitMatcher.Match(p, isDir):
+		reason = skipGitIgnore
+	case f.tracked != nil && isDir && !f.trackedDirs[strings.Join(p, "/")]:
+		reason = skipUntracked
+	case f.tracked != nil && !isDir && !f.tracked[strings.Join(p, "/")]:
+		reason = skipUntracked
+	default:
+		return false
+	}
+
+	if isDir {
+		rel += "/"
+	}
+	f.skipped[rel] = reason
+	return true
+}
+
+// report logs the paths that were skipped, grouped by the reason for which they were skipped.
+func (f *fileFilter) report() {
+	if len(f.skipped) == 0 {
+		return
+	}
+
+	byReason := map[string][]string{}
+	for p, r := range f.skipped {
+		byReason[r] = append(byReason[r], p)
+	}
+	fields := []zap.Field{zap.Int("count", len(f.skipped))}
+	for _, r := range []string{skipModuleIgnore, skipGitIgnore, skipUntracked} {
+		if len(byReason[r]) > 0 {
+			sort.Strings(byReason[r])
+			fields = append(fields, zap.Strings(r, byReason[r]))
+		}
+	}
+	f.log.Info("Skipped files that are ignored or not tracked by git. Directories are skipped as a whole.", fields...)
+}
+
+func (f *fileFilter) split(path string) []string {
+	rel, err := filepath.Rel(f.base, path)
+	if err != nil || rel == "." {
+		return []string{}
+	}
+	return strings.Split(filepath.ToSlash(rel), "/")
+}
+
+func readIgnoreFile(path string, domain []string) ([]gitignore.Pattern, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var ps []gitignore.Pattern
+	for _, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimRight(l, "\r")
+		if strings.HasPrefix(l, "#") || strings.TrimSpace(l) == "" {
+			continue
+		}
+		ps = append(ps, gitignore.ParsePattern(l, domain))
+	}
+	return ps, nil
+}
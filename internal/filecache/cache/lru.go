@@ -0,0 +1,54 @@
+package cache
+
+import "container/list"
+
+// lru holds values of an approximately known size and evicts the least recently used ones once
+// their total size exceeds its budget.
+type lru struct {
+	budget int64
+	size   int64
+	order  *list.List
+	items  map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+	size  int64
+}
+
+func newLRU(budget int64) *lru {
+	return &lru{budget: budget, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (l *lru) get(key string) (interface{}, bool) {
+	e, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+// add stores a value under the given key. Values that are larger than the entire budget are not
+// stored at all.
+func (l *lru) add(key string, value interface{}, size int64) {
+	if e, ok := l.items[key]; ok {
+		l.remove(e)
+	}
+	if size > l.budget {
+		return
+	}
+
+	l.items[key] = l.order.PushFront(&lruEntry{key: key, value: value, size: size})
+	l.size += size
+	for l.size > l.budget {
+		l.remove(l.order.Back())
+	}
+}
+
+func (l *lru) remove(e *list.Element) {
+	le := l.order.Remove(e).(*lruEntry)
+	delete(l.items, le.key)
+	l.size -= le.size
+}
@@ -6,6 +6,7 @@ import (
 	"go/token"
 
 	"github.com/modularise/modularise/internal/filecache/cache"
+	"github.com/modularise/modularise/internal/filecache/listcache"
 	"github.com/modularise/modularise/internal/filecache/testcache"
 	"github.com/modularise/modularise/internal/filecache/uncache"
 )
@@ -13,6 +14,7 @@ import (
 // Ensure that we implement the required interface.
 var (
 	_ FileCache = &cache.Cache{}
+	_ FileCache = &listcache.ListCache{}
 	_ FileCache = &uncache.Uncache{}
 	_ FileCache = &testcache.FakeFileCache{}
 )
@@ -42,6 +44,10 @@ type FileCache interface {
 	// part of the module abstracted by this filecache. The returned paths are all relative to the
 	// module's root.
 	FilesInPkg(pkg string) (map[string]bool, error)
+	// Module paths of the Go modules nested within the module abstracted by this filecache, mapped to
+	// their root directory relative to the module's root. The files and packages of nested modules
+	// are not part of the module.
+	NestedModules() map[string]string
 
 	// Retrieve the content of an arbitrary file if it exists within the module abstracted by this
 	// filecache. The path argument is interpreted as relative to the root of the module.
@@ -4,12 +4,16 @@ import (
 	"encoding/json"
 	"go/parser"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/go-git/go-git/v5"
 	"github.com/rogpeppe/go-internal/txtar"
 
+	"github.com/modularise/modularise/internal/filecache/cache"
+	"github.com/modularise/modularise/internal/filecache/listcache"
 	"github.com/modularise/modularise/internal/testlib"
 )
 
@@ -81,6 +85,202 @@ func TestFiles(t *testing.T) {
 	})
 }
 
+func TestNestedModules(t *testing.T) {
+	t.Parallel()
+
+	tc, err := ioutil.ReadFile("./testdata/nested_modules.txtar")
+	testlib.NoError(t, true, err)
+
+	a := txtar.Parse(tc)
+
+	enm := map[string]string{}
+	for _, l := range strings.Split(strings.TrimSpace(string(a.Comment)), "\n") {
+		if strings.HasPrefix(l, "#") || l == "" {
+			continue
+		}
+		f := strings.Fields(l)
+		enm[f[0]] = f[1]
+	}
+
+	parallelTestAllCacheTypes(t, a, func(t *testing.T, fc FileCache) {
+		t.Parallel()
+
+		testlib.Equal(t, false, enm, fc.NestedModules())
+		testlib.Equal(t, false, map[string]bool{"go.mod": true, "main.go": true, "cmd/main.go": true}, fc.Files())
+		testlib.Equal(t, false, map[string]bool{"example.com/module": true, "example.com/module/cmd": true}, fc.Pkgs())
+	})
+}
+
+func TestSourceFileOptions(t *testing.T) {
+	t.Parallel()
+
+	tc, err := ioutil.ReadFile("./testdata/source_files.txtar")
+	testlib.NoError(t, true, err)
+
+	a := txtar.Parse(tc)
+
+	var tracked []string
+	for _, f := range strings.Split(strings.TrimSpace(string(a.Comment)), "\n") {
+		if strings.HasPrefix(f, "#") || f == "" {
+			continue
+		}
+		tracked = append(tracked, f)
+	}
+
+	tcs := map[string]struct {
+		opts     cache.Options
+		expected []string
+	}{
+		"Default": {
+			expected: []string{"go.mod", "main.go", ".gitignore", ".modulariseignore", "main.go.swp", "bin/tool", "pkg/.gitignore", "pkg/pkg.go", "pkg/generated.go", "pkg/new.go"},
+		},
+		"GitIgnore": {
+			opts:     cache.Options{GitIgnore: true},
+			expected: []string{"go.mod", "main.go", ".gitignore", ".modulariseignore", "pkg/.gitignore", "pkg/pkg.go", "pkg/new.go"},
+		},
+		"TrackedOnly": {
+			opts:     cache.Options{TrackedOnly: true},
+			expected: tracked,
+		},
+		"TrackedAndGitIgnore": {
+			opts:     cache.Options{TrackedOnly: true, GitIgnore: true},
+			expected: []string{"go.mod", "main.go", ".gitignore", ".modulariseignore", "pkg/.gitignore", "pkg/pkg.go"},
+		},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			cd, err := ioutil.TempDir("", "modularise-source-files-test")
+			testlib.NoError(t, true, err)
+			defer func() { _ = os.RemoveAll(cd) }()
+
+			testlib.NoError(t, true, txtar.Write(a, cd))
+			repo, err := git.PlainInit(cd, false)
+			testlib.NoError(t, true, err)
+			wt, err := repo.Worktree()
+			testlib.NoError(t, true, err)
+			for _, f := range tracked {
+				_, err = wt.Add(f)
+				testlib.NoError(t, true, err)
+			}
+
+			c, err := cache.NewCache(testlib.NewTestLogger(), cd, tc.opts)
+			testlib.NoError(t, true, err)
+
+			efs := map[string]bool{}
+			for _, f := range tc.expected {
+				efs[f] = true
+			}
+			testlib.Equal(t, false, efs, c.Files())
+		})
+	}
+}
+
+func TestCacheMemoryBudget(t *testing.T) {
+	t.Parallel()
+
+	tc, err := ioutil.ReadFile("./testdata/read_go_file.txtar")
+	testlib.NoError(t, true, err)
+
+	a := txtar.Parse(tc)
+
+	tcs := map[string]struct {
+		budget int64
+		shared bool
+	}{
+		"Default": {shared: true},
+		// Nothing fits within the budget so all content is read and parsed anew.
+		"Tiny": {budget: 1},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			cd, err := ioutil.TempDir("", "modularise-cache-budget-test")
+			testlib.NoError(t, true, err)
+			defer func() { _ = os.RemoveAll(cd) }()
+			testlib.NoError(t, true, txtar.Write(a, cd))
+
+			c, err := cache.NewCache(testlib.NewTestLogger(), cd, cache.Options{MemoryBudget: tc.budget})
+			testlib.NoError(t, true, err)
+
+			for _, f := range a.Files {
+				b, err := c.ReadFile(f.Name)
+				testlib.NoError(t, true, err)
+				testlib.Equal(t, false, string(f.Data), string(b))
+			}
+
+			b1, err := c.ReadFile("lib/util.go")
+			testlib.NoError(t, true, err)
+			b2, err := c.ReadFile("lib/util.go")
+			testlib.NoError(t, true, err)
+			testlib.Equal(t, false, tc.shared, &b1[0] == &b2[0])
+
+			// ASTs are parsed anew for each call.
+			fa1, _, err := c.ReadGoFile("lib/util.go", parser.ImportsOnly)
+			testlib.NoError(t, true, err)
+			fa2, _, err := c.ReadGoFile("lib/util.go", parser.ImportsOnly)
+			testlib.NoError(t, true, err)
+			testlib.True(t, false, fa1 != fa2)
+			testlib.Equal(t, false, fa1, fa2)
+		})
+	}
+}
+
+func TestListCache(t *testing.T) {
+	t.Parallel()
+
+	tc, err := ioutil.ReadFile("./testdata/list_cache.txtar")
+	testlib.NoError(t, true, err)
+
+	a := txtar.Parse(tc)
+
+	eps := map[string]bool{}
+	for _, p := range strings.Split(strings.TrimSpace(string(a.Comment)), "\n") {
+		if strings.HasPrefix(p, "#") || p == "" {
+			continue
+		}
+		eps[p] = true
+	}
+
+	cd, err := ioutil.TempDir("", "modularise-list-cache-test")
+	testlib.NoError(t, true, err)
+	defer func() { _ = os.RemoveAll(cd) }()
+	testlib.NoError(t, true, txtar.Write(a, cd))
+
+	c, err := listcache.NewListCache(testlib.NewTestLogger(), cd, cache.Options{})
+	testlib.NoError(t, true, err)
+
+	testlib.Equal(t, false, eps, c.Pkgs())
+	// Files outside of packages remain accessible.
+	testlib.True(t, false, c.Files()["lib/testdata/fixture.go"])
+	testlib.True(t, false, c.Files()["_tools/tool.go"])
+
+	p, ok := c.Package("example.com/module/lib")
+	testlib.True(t, true, ok)
+	testlib.Equal(t, false, []string{"lib/lib.go"}, p.GoFiles)
+	testlib.Equal(t, false, []string{"lib/lib_test.go"}, p.TestGoFiles)
+	testlib.Equal(t, false, []string{"lib/static/data.txt"}, p.EmbedFiles)
+	testlib.Equal(t, false, []string{"embed"}, p.Imports)
+
+	p, ok = c.Package("example.com/module/windows")
+	testlib.True(t, true, ok)
+	testlib.Equal(t, false, 0, len(p.GoFiles))
+	testlib.Equal(t, false, []string{"windows/windows.go"}, p.IgnoredGoFiles)
+
+	fs, err := c.FilesInPkg("example.com/module/lib")
+	testlib.NoError(t, true, err)
+	testlib.Equal(t, false, map[string]bool{"lib/lib.go": true, "lib/lib_test.go": true, "lib/README.md": true, "lib/static/data.txt": true}, fs)
+
+	_, err = c.FilesInPkg("example.com/module/lib/testdata")
+	testlib.Error(t, false, err)
+}
+
 func TestFilesInPkg(t *testing.T) {
 	t.Parallel()
 
@@ -181,6 +381,11 @@ func TestReadGoFile(t *testing.T) {
 				fa3, _, err := fc.ReadGoFile(tf, parser.AllErrors|parser.ParseComments)
 				testlib.NoError(t, true, err)
 				testlib.Equal(t, false, fa3, fa)
+
+				fa4, _, err := fc.ReadGoFile(tf, parser.ImportsOnly)
+				testlib.NoError(t, true, err)
+				testlib.Equal(t, false, len(fa.Imports), len(fa4.Imports))
+				testlib.True(t, false, len(fa4.Decls) <= len(fa.Decls))
 			}
 		}
 		testlib.True(t, false, astInvarianceTested)
@@ -255,3 +460,34 @@ func parallelBenchmarkAllCacheTypes(b *testing.B, a *txtar.Archive, test func(*t
 		})
 	}
 }
+
+// The GOPATH is modified for the duration of this test, hence it can not be run in parallel.
+func TestGopathCache(t *testing.T) {
+	gp, err := ioutil.TempDir("", "modularise-gopath-test")
+	testlib.NoError(t, true, err)
+	defer func() { _ = os.RemoveAll(gp) }()
+
+	root := filepath.Join(gp, "src", "example.com", "project")
+	testlib.NoError(t, true, txtar.Write(&txtar.Archive{Files: []txtar.File{
+		{Name: "main.go", Data: []byte("package main\n")},
+		{Name: "pkg/pkg.go", Data: []byte("package pkg\n")},
+		{Name: "pkg/generated.go", Data: []byte("package pkg\n")},
+		{Name: ".gitignore", Data: []byte("generated.go\n")},
+	}}, root))
+
+	old, ok := os.LookupEnv("GOPATH")
+	testlib.NoError(t, true, os.Setenv("GOPATH", gp))
+	defer func() {
+		if ok {
+			testlib.NoError(t, false, os.Setenv("GOPATH", old))
+		} else {
+			testlib.NoError(t, false, os.Unsetenv("GOPATH"))
+		}
+	}()
+
+	c, err := cache.NewCache(testlib.NewTestLogger(), root, cache.Options{GitIgnore: true})
+	testlib.NoError(t, true, err)
+	testlib.Equal(t, false, "example.com/project", c.ModulePath())
+	testlib.Equal(t, false, map[string]bool{"main.go": true, "pkg/pkg.go": true, ".gitignore": true}, c.Files())
+	testlib.Equal(t, false, map[string]bool{"example.com/project": true, "example.com/project/pkg": true}, c.Pkgs())
+}
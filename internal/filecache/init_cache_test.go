@@ -110,7 +110,7 @@ func populateCache(a *txtar.Archive) (c *cache.Cache, err error) {
 		return nil, err
 	}
 
-	c, err = cache.NewCache(testlib.NewTestLogger(), cd)
+	c, err = cache.NewCache(testlib.NewTestLogger(), cd, cache.Options{})
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,286 @@
+package listcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/modularise/modularise/internal/filecache/cache"
+)
+
+// Package holds the metadata of a Go package of the module as reported by 'go list'. All file paths
+// are relative to the module's root.
+type Package struct {
+	ImportPath string
+	Name       string
+	Dir        string
+
+	// Go files that are built for the current platform, including those using cgo.
+	GoFiles []string
+	// Test files of the package itself and of its external '_test' package.
+	TestGoFiles  []string
+	XTestGoFiles []string
+	// Files that are excluded by build constraints for the current platform. These may still be
+	// built for other targets.
+	IgnoredGoFiles    []string
+	IgnoredOtherFiles []string
+	// Non-Go sources such as C, assembly or syso files.
+	OtherFiles []string
+	// Files matched by '//go:embed' directives of the package and of its tests.
+	EmbedFiles     []string
+	TestEmbedFiles []string
+
+	Imports      []string
+	TestImports  []string
+	XTestImports []string
+}
+
+// listPackage is the subset of the output of 'go list -json' that is relevant to a ListCache.
+type listPackage struct {
+	Dir        string
+	ImportPath string
+	Name       string
+	Module     *struct {
+		Path string
+		Main bool
+	}
+	Error *struct {
+		Err string
+	}
+
+	GoFiles           []string
+	CgoFiles          []string
+	InvalidGoFiles    []string
+	CFiles            []string
+	CXXFiles          []string
+	MFiles            []string
+	HFiles            []string
+	FFiles            []string
+	SFiles            []string
+	SwigFiles         []string
+	SwigCXXFiles      []string
+	SysoFiles         []string
+	TestGoFiles       []string
+	XTestGoFiles      []string
+	IgnoredGoFiles    []string
+	IgnoredOtherFiles []string
+	EmbedFiles        []string
+	TestEmbedFiles    []string
+	XTestEmbedFiles   []string
+
+	Imports      []string
+	TestImports  []string
+	XTestImports []string
+}
+
+// ListCache is a filecache whose packages are determined by the Go tool via 'go list' instead of
+// being inferred from the directory layout. Directories that the Go tool does not consider to be
+// packages, such as 'testdata' directories or directories whose name starts with '_' or '.', are
+// hence not part of its packages even if they contain Go files. Their files remain accessible.
+//
+// The files of a package are those reported by the Go tool, including the files that it embeds and
+// that may reside in sub-directories, together with the other non-Go files located in the package's
+// directory. The content of files is served by an underlying cache.Cache.
+//
+// Packages are loaded with 'go list -e -json' for the module's own patterns only. The '-deps' flag
+// is not used as packages outside of the module are treated as external dependencies, so listing
+// the full dependency graph, including the standard library, would only add cost. Likewise
+// 'golang.org/x/tools/go/packages' is not used: it is a wrapper around the same 'go list'
+// invocation that would add a dependency while not exposing the files ignored by build constraints.
+type ListCache struct {
+	*cache.Cache
+
+	log      *zap.Logger
+	pkgs     map[string]bool
+	packages map[string]*Package
+}
+
+func NewListCache(log *zap.Logger, root string, opts cache.Options) (*ListCache, error) {
+	c, err := cache.NewCache(log, root, opts)
+	if err != nil {
+		return nil, err
+	}
+	if c.Files() == nil || !c.Files()["go.mod"] {
+		log.Error("Package metadata can only be loaded via 'go list' for Go modules.", zap.String("root", c.Root()))
+		return nil, errors.New("go list filecache requires a Go module")
+	}
+
+	l := &ListCache{
+		Cache:    c,
+		log:      log.With(zap.String("root", c.Root())),
+		pkgs:     map[string]bool{},
+		packages: map[string]*Package{},
+	}
+	if err = l.loadPackages(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *ListCache) Pkgs() map[string]bool {
+	return l.pkgs
+}
+
+func (l *ListCache) FilesInPkg(pkg string) (map[string]bool, error) {
+	p, ok := l.Package(pkg)
+	if !ok {
+		l.log.Error("Supplied package is not part of module abstracted by this filecache.", zap.String("package", pkg), zap.String("module", l.ModulePath()))
+		return nil, fmt.Errorf("package %q is not part of module %q", pkg, l.ModulePath())
+	}
+
+	dfs, err := l.Cache.FilesInPkg(pkg)
+	if err != nil {
+		return nil, err
+	}
+	fs := map[string]bool{}
+	for f := range dfs {
+		if filepath.Ext(f) != ".go" {
+			fs[f] = true
+		}
+	}
+	for _, list := range [][]string{p.GoFiles, p.TestGoFiles, p.XTestGoFiles, p.IgnoredGoFiles, p.IgnoredOtherFiles, p.OtherFiles, p.EmbedFiles, p.TestEmbedFiles} {
+		for _, f := range list {
+			fs[f] = true
+		}
+	}
+	return fs, nil
+}
+
+// Package returns the metadata reported by the Go tool for a package of the module.
+func (l *ListCache) Package(pkg string) (*Package, bool) {
+	p, ok := l.packages[pkg]
+	return p, ok
+}
+
+func (l *ListCache) loadPackages() error {
+	if err := l.list("./..."); err != nil {
+		return err
+	}
+
+	// Packages whose files are all excluded by build constraints for the current platform are not
+	// matched by './...' but may still be built for other targets, hence they need to be listed
+	// explicitly.
+	var excluded, notPkgs []string
+	for p := range l.Cache.Pkgs() {
+		if l.pkgs[p] {
+			continue
+		} else if ignoredByGoTool(strings.TrimPrefix(p, l.ModulePath())) {
+			notPkgs = append(notPkgs, p)
+		} else {
+			excluded = append(excluded, p)
+		}
+	}
+	if len(excluded) > 0 {
+		sort.Strings(excluded)
+		if err := l.list(excluded...); err != nil {
+			return err
+		}
+	}
+
+	if len(notPkgs) > 0 {
+		sort.Strings(notPkgs)
+		l.log.Info("Some directories contain Go files but are not packages according to the Go tool.", zap.Strings("directories", notPkgs))
+	}
+	return nil
+}
+
+// list runs 'go list' for the given patterns and records the resulting packages of the module.
+func (l *ListCache) list(patterns ...string) error {
+	eb, ob := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := exec.Command("go", append([]string{"list", "-e", "-json"}, patterns...)...)
+	cmd.Env = append(os.Environ(), "GODEBUG=") // Don't pass any debug options to the lower-level invocation.
+	cmd.Dir = l.Root()
+	cmd.Stderr = eb
+	cmd.Stdout = ob
+	l.log.Debug("Loading package metadata via 'go list -e -json'.", zap.Strings("patterns", patterns))
+	if err := cmd.Run(); err != nil {
+		l.log.Error("Unable to run 'go list -e -json'.", zap.Strings("patterns", patterns), zap.String("output", eb.String()), zap.Error(err))
+		return errors.New("go list error")
+	}
+
+	d := json.NewDecoder(ob)
+	for {
+		var lp listPackage
+		if err := d.Decode(&lp); err == io.EOF {
+			break
+		} else if err != nil {
+			l.log.Error("Unexpected output from 'go list -e -json'.", zap.Error(err))
+			return errors.New("go list error")
+		}
+		if lp.Module == nil || !lp.Module.Main {
+			continue
+		}
+		if lp.Error != nil {
+			l.log.Debug("The Go tool reported an error for package.", zap.String("package", lp.ImportPath), zap.String("error", lp.Error.Err))
+		}
+
+		p, err := l.convert(lp)
+		if err != nil {
+			return err
+		}
+		if len(p.GoFiles)+len(p.TestGoFiles)+len(p.XTestGoFiles)+len(p.IgnoredGoFiles) == 0 {
+			continue
+		}
+		l.pkgs[p.ImportPath] = true
+		l.packages[p.ImportPath] = p
+	}
+	return nil
+}
+
+// ignoredByGoTool determines whether the Go tool ignores a directory, given as a slash-separated
+// path, when matching package patterns.
+func ignoredByGoTool(dir string) bool {
+	for _, e := range strings.Split(dir, "/") {
+		if e == "testdata" || strings.HasPrefix(e, "_") || strings.HasPrefix(e, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// convert maps the output of 'go list' for a package to a Package with paths relative to the module's
+// root. Files that are not part of the underlying cache, e.g. because they are ignored, are dropped.
+func (l *ListCache) convert(lp listPackage) (*Package, error) {
+	dir, err := filepath.Rel(l.Root(), lp.Dir)
+	if err != nil {
+		l.log.Error("Package directory is not located within the module.", zap.String("package", lp.ImportPath), zap.String("directory", lp.Dir))
+		return nil, err
+	}
+
+	files := func(lists ...[]string) []string {
+		var fs []string
+		for _, list := range lists {
+			for _, f := range list {
+				if f = filepath.Join(dir, f); l.Files()[f] {
+					fs = append(fs, f)
+				}
+			}
+		}
+		return fs
+	}
+	return &Package{
+		ImportPath:        lp.ImportPath,
+		Name:              lp.Name,
+		Dir:               dir,
+		GoFiles:           files(lp.GoFiles, lp.CgoFiles, lp.InvalidGoFiles),
+		TestGoFiles:       files(lp.TestGoFiles),
+		XTestGoFiles:      files(lp.XTestGoFiles),
+		IgnoredGoFiles:    files(lp.IgnoredGoFiles),
+		IgnoredOtherFiles: files(lp.IgnoredOtherFiles),
+		OtherFiles:        files(lp.CFiles, lp.CXXFiles, lp.MFiles, lp.HFiles, lp.FFiles, lp.SFiles, lp.SwigFiles, lp.SwigCXXFiles, lp.SysoFiles),
+		EmbedFiles:        files(lp.EmbedFiles),
+		TestEmbedFiles:    files(lp.TestEmbedFiles, lp.XTestEmbedFiles),
+		Imports:           lp.Imports,
+		TestImports:       lp.TestImports,
+		XTestImports:      lp.XTestImports,
+	}, nil
+}
@@ -0,0 +1,295 @@
+package overlay
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/modularise/modularise/internal/filecache"
+)
+
+// Ensure that we implement the required interface.
+var _ filecache.FileCache = &Overlay{}
+
+// Overlay is a filecache that presents the content of an underlying filecache with a set of added,
+// modified and deleted files applied on top of it. It allows the analysis of changes that have not
+// been written to the underlying module, such as the patch of a pull request.
+type Overlay struct {
+	log  *zap.Logger
+	base filecache.FileCache
+
+	changes  map[string][]byte
+	deleted  map[string]bool
+	files    map[string]bool
+	pkgs     map[string]bool
+	pkgFiles map[string]map[string]bool
+}
+
+// New creates an Overlay from a map of file paths, relative to the module's root, to their new
+// content. A nil content denotes a deleted file.
+func New(log *zap.Logger, base filecache.FileCache, changes map[string][]byte) (*Overlay, error) {
+	o := &Overlay{
+		log:     log,
+		base:    base,
+		changes: map[string][]byte{},
+		deleted: map[string]bool{},
+		files:   map[string]bool{},
+	}
+
+	var added, deleted []string
+	for f, b := range changes {
+		f = filepath.Clean(filepath.FromSlash(f))
+		if filepath.IsAbs(f) || f == ".." || strings.HasPrefix(f, ".."+string(filepath.Separator)) {
+			log.Error("Overlaid file is not located within the module.", zap.String("file", f))
+			return nil, fmt.Errorf("overlaid file %q is outside of the module", f)
+		}
+		if nm := o.nestedModule(f); nm != "" {
+			log.Debug("Ignoring overlaid file that is part of a nested module.", zap.String("file", f), zap.String("module", nm))
+			continue
+		}
+
+		if b == nil {
+			if !base.Files()[f] {
+				log.Warn("Overlay deletes a file that does not exist in the module.", zap.String("file", f))
+				continue
+			}
+			o.deleted[f] = true
+			deleted = append(deleted, f)
+		} else {
+			o.changes[f] = b
+			if !base.Files()[f] {
+				added = append(added, f)
+			}
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(deleted)
+	log.Info(
+		"Overlaying changes on top of the module's files.",
+		zap.Int("modified", len(o.changes)-len(added)),
+		zap.Strings("added", added),
+		zap.Strings("deleted", deleted),
+	)
+
+	o.index()
+	return o, nil
+}
+
+// FromDir creates an Overlay from the content of a directory that mirrors the layout of the
+// module. Each file in the directory adds or replaces the file at the same relative path.
+func FromDir(log *zap.Logger, base filecache.FileCache, dir string) (*Overlay, error) {
+	changes := map[string][]byte{}
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			log.Error("Failed to walk overlay directory.", zap.String("directory", dir), zap.Error(err))
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Error("Failed to read overlay file.", zap.String("file", path), zap.Error(err))
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		changes[rel] = b
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return New(log, base, changes)
+}
+
+// FromPatch creates an Overlay by applying a unified diff, as produced by 'git diff', to the files of
+// the module. The given prefix is the path of the module's root relative to the root of the paths in
+// the diff, e.g. to the root of a git repository that contains the module in a sub-directory.
+// Changes to files outside of the module are ignored.
+func FromPatch(log *zap.Logger, base filecache.FileCache, patch []byte, prefix string) (*Overlay, error) {
+	fps, err := parsePatch(string(patch))
+	if err != nil {
+		log.Error("Failed to parse patch.", zap.Error(err))
+		return nil, err
+	}
+
+	prefix = strings.Trim(filepath.ToSlash(filepath.Clean(prefix)), "/")
+	if prefix == "." {
+		prefix = ""
+	}
+	modulePath := func(p string) (string, bool) {
+		if p == "" || prefix == "" {
+			return p, true
+		}
+		if !strings.HasPrefix(p, prefix+"/") {
+			return "", false
+		}
+		return strings.TrimPrefix(p, prefix+"/"), true
+	}
+
+	changes := map[string][]byte{}
+	for _, fp := range fps {
+		oldPath, oldIn := modulePath(fp.oldPath)
+		newPath, newIn := modulePath(fp.newPath)
+		if !oldIn || !newIn {
+			log.Debug("Ignoring patched file that is outside of the module.", zap.String("old", fp.oldPath), zap.String("new", fp.newPath))
+			continue
+		}
+
+		var content string
+		if oldPath != "" {
+			b, err := base.ReadFile(filepath.FromSlash(oldPath))
+			if err != nil {
+				log.Error("Patched file does not exist in the module.", zap.String("file", oldPath), zap.Error(err))
+				return nil, err
+			}
+			content = string(b)
+		}
+		if content, err = fp.apply(content); err != nil {
+			log.Error("Failed to apply patch.", zap.String("file", oldPath), zap.Error(err))
+			return nil, err
+		}
+
+		if oldPath != "" && oldPath != newPath {
+			changes[oldPath] = nil
+		}
+		if newPath != "" {
+			changes[newPath] = []byte(content)
+		}
+	}
+	return New(log, base, changes)
+}
+
+func (o *Overlay) Root() string {
+	return o.base.Root()
+}
+
+func (o *Overlay) ModulePath() string {
+	return o.base.ModulePath()
+}
+
+func (o *Overlay) Pkgs() map[string]bool {
+	return o.pkgs
+}
+
+func (o *Overlay) Files() map[string]bool {
+	return o.files
+}
+
+func (o *Overlay) NestedModules() map[string]string {
+	return o.base.NestedModules()
+}
+
+func (o *Overlay) FilesInPkg(pkg string) (map[string]bool, error) {
+	if !o.pkgs[pkg] {
+		o.log.Error("Supplied package is not part of module abstracted by this filecache.", zap.String("package", pkg), zap.String("module", o.ModulePath()))
+		return nil, fmt.Errorf("package %q is not part of module %q", pkg, o.ModulePath())
+	}
+	fs := make(map[string]bool, len(o.pkgFiles[pkg]))
+	for f := range o.pkgFiles[pkg] {
+		fs[f] = true
+	}
+	return fs, nil
+}
+
+func (o *Overlay) ReadFile(path string) ([]byte, error) {
+	path = filepath.Clean(path)
+	if !o.files[path] {
+		o.log.Error("File does not exist or is not part of module.", zap.String("file", path), zap.String("module", o.ModulePath()))
+		return nil, fmt.Errorf("could not access %s", path)
+	}
+	if b, ok := o.changes[path]; ok {
+		return b, nil
+	}
+	return o.base.ReadFile(path)
+}
+
+func (o *Overlay) ReadGoFile(path string, loadFlags parser.Mode) (*ast.File, *token.FileSet, error) {
+	path = filepath.Clean(path)
+	if !o.files[path] {
+		o.log.Error("File does not exist or is not part of module.", zap.String("file", path), zap.String("module", o.ModulePath()))
+		return nil, nil, fmt.Errorf("could not access %s", path)
+	}
+
+	b, ok := o.changes[path]
+	if !ok {
+		return o.base.ReadGoFile(path, loadFlags)
+	}
+	if filepath.Ext(path) != ".go" {
+		o.log.Error("File is not a Go source.", zap.String("file", path))
+		return nil, nil, fmt.Errorf("%s is not a go file", path)
+	}
+	fset := token.NewFileSet()
+	a, err := parser.ParseFile(fset, path, b, loadFlags)
+	return a, fset, err
+}
+
+// index computes the files and packages of the module with the overlay applied. Directories whose Go
+// files are all deleted are no longer packages, while new directories with Go files become packages.
+// Directories that contain Go files in the underlying filecache without being one of its packages,
+// e.g. because the underlying filecache follows the Go tool's rules, are left as they are.
+func (o *Overlay) index() {
+	for f := range o.base.Files() {
+		if !o.deleted[f] {
+			o.files[f] = true
+		}
+	}
+	for f := range o.changes {
+		o.files[f] = true
+	}
+
+	baseGoDirs := map[string]bool{}
+	for f := range o.base.Files() {
+		if isGoFile(f) {
+			baseGoDirs[filepath.Dir(f)] = true
+		}
+	}
+
+	o.pkgFiles = map[string]map[string]bool{}
+	goDirs := map[string]bool{}
+	for f := range o.files {
+		d := filepath.Dir(f)
+		pkg := filepath.Join(o.ModulePath(), d)
+		if o.pkgFiles[pkg] == nil {
+			o.pkgFiles[pkg] = map[string]bool{}
+		}
+		o.pkgFiles[pkg][f] = true
+		if isGoFile(f) {
+			goDirs[d] = true
+		}
+	}
+
+	o.pkgs = map[string]bool{}
+	for d := range goDirs {
+		pkg := filepath.Join(o.ModulePath(), d)
+		if o.base.Pkgs()[pkg] || !baseGoDirs[d] {
+			o.pkgs[pkg] = true
+		}
+	}
+}
+
+// nestedModule returns the path of the nested module that the given file belongs to, if any.
+func (o *Overlay) nestedModule(f string) string {
+	for mp, d := range o.base.NestedModules() {
+		if strings.HasPrefix(f, d+string(filepath.Separator)) {
+			return mp
+		}
+	}
+	return ""
+}
+
+func isGoFile(f string) bool {
+	return filepath.Ext(f) == ".go" && filepath.Base(f) != "go.mod"
+}
@@ -0,0 +1,114 @@
+package overlay
+
+import (
+	"go/parser"
+	"testing"
+
+	"github.com/modularise/modularise/internal/filecache/testcache"
+	"github.com/modularise/modularise/internal/testlib"
+)
+
+func TestOverlay(t *testing.T) {
+	t.Parallel()
+
+	base, err := testcache.NewFakeFileCache("fake-cache-dir", map[string]testcache.FakeFileCacheEntry{
+		"go.mod":            {Data: []byte("module example.com/mod\n")},
+		"main.go":           {Data: []byte("package main\n")},
+		"lib/lib.go":        {Data: []byte("package lib\n")},
+		"old/old.go":        {Data: []byte("package old\n")},
+		"nested/go.mod":     {Data: []byte("module example.com/nested\n")},
+		"nested/nested.go":  {Data: []byte("package nested\n")},
+		"docs/README.md":    {Data: []byte("docs\n")},
+		"lib/testdata/a.go": {Data: []byte("package a\n")},
+	})
+	testlib.NoError(t, true, err)
+
+	o, err := New(testlib.NewTestLogger(), base, map[string][]byte{
+		"lib/lib.go":         []byte("package lib\n\nimport \"example.com/mod/new\"\n"),
+		"new/new.go":         []byte("package new\n"),
+		"old/old.go":         nil,
+		"nested/extra.go":    []byte("package nested\n"),
+		"docs/guide.md":      []byte("guide\n"),
+		"lib/testdata/b.go":  []byte("package b\n"),
+		"does/not/exist.txt": nil,
+	})
+	testlib.NoError(t, true, err)
+
+	testlib.Equal(t, false, map[string]bool{
+		"go.mod":            true,
+		"main.go":           true,
+		"lib/lib.go":        true,
+		"new/new.go":        true,
+		"docs/README.md":    true,
+		"docs/guide.md":     true,
+		"lib/testdata/a.go": true,
+		"lib/testdata/b.go": true,
+	}, o.Files())
+	testlib.Equal(t, false, map[string]bool{
+		"example.com/mod":              true,
+		"example.com/mod/lib":          true,
+		"example.com/mod/new":          true,
+		"example.com/mod/lib/testdata": true,
+	}, o.Pkgs())
+
+	fs, err := o.FilesInPkg("example.com/mod/lib")
+	testlib.NoError(t, true, err)
+	testlib.Equal(t, false, map[string]bool{"lib/lib.go": true}, fs)
+	_, err = o.FilesInPkg("example.com/mod/old")
+	testlib.Error(t, false, err)
+
+	b, err := o.ReadFile("main.go")
+	testlib.NoError(t, true, err)
+	testlib.Equal(t, false, "package main\n", string(b))
+	_, err = o.ReadFile("old/old.go")
+	testlib.Error(t, false, err)
+
+	a, _, err := o.ReadGoFile("lib/lib.go", parser.ImportsOnly)
+	testlib.NoError(t, true, err)
+	testlib.Equal(t, false, 1, len(a.Imports))
+}
+
+func TestFromPatch(t *testing.T) {
+	t.Parallel()
+
+	base, err := testcache.NewFakeFileCache("fake-cache-dir", map[string]testcache.FakeFileCacheEntry{
+		"go.mod":     {Data: []byte("module example.com/mod\n")},
+		"lib/lib.go": {Data: []byte("package lib\n\nfunc Lib() {}\n")},
+		"lib/old.go": {Data: []byte("package lib\n")},
+	})
+	testlib.NoError(t, true, err)
+
+	patch := `diff --git a/module/lib/lib.go b/module/lib/lib.go
+--- a/module/lib/lib.go
++++ b/module/lib/lib.go
+@@ -1,3 +1,3 @@
+ package lib
+
+-func Lib() {}
++func Library() {}
+diff --git a/module/lib/old.go b/module/lib/renamed.go
+similarity index 100%
+rename from module/lib/old.go
+rename to module/lib/renamed.go
+diff --git a/other/other.go b/other/other.go
+new file mode 100644
+--- /dev/null
++++ b/other/other.go
+@@ -0,0 +1 @@
++package other
+`
+
+	o, err := FromPatch(testlib.NewTestLogger(), base, []byte(patch), "module")
+	testlib.NoError(t, true, err)
+
+	testlib.Equal(t, false, map[string]bool{"go.mod": true, "lib/lib.go": true, "lib/renamed.go": true}, o.Files())
+	b, err := o.ReadFile("lib/lib.go")
+	testlib.NoError(t, true, err)
+	testlib.Equal(t, false, "package lib\n\nfunc Library() {}\n", string(b))
+	b, err = o.ReadFile("lib/renamed.go")
+	testlib.NoError(t, true, err)
+	testlib.Equal(t, false, "package lib\n", string(b))
+
+	_, err = FromPatch(testlib.NewTestLogger(), base, []byte("--- a/missing.go\n+++ b/missing.go\n@@ -1 +1 @@\n-a\n+b\n"), "")
+	testlib.Error(t, false, err)
+}
@@ -0,0 +1,273 @@
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A filePatch holds the changes that a unified diff applies to a single file. An empty oldPath
+// denotes an added file and an empty newPath a deleted one.
+type filePatch struct {
+	oldPath string
+	newPath string
+	hunks   []hunk
+}
+
+type hunk struct {
+	oldStart int
+	oldLines int
+	newLines int
+	// Lines of the hunk, including their ' ', '-' or '+' prefix and their line ending if any.
+	lines []string
+}
+
+var hunkHeaderRE = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// parsePatch parses a unified diff, as produced by 'git diff' or 'diff -u', into per-file patches.
+func parsePatch(patch string) ([]*filePatch, error) {
+	var fps []*filePatch
+	var fp *filePatch
+	var err error
+	lines := strings.SplitAfter(patch, "\n")
+	for i := 0; i < len(lines); i++ {
+		l := strings.TrimRight(lines[i], "\r\n")
+		switch {
+		case strings.HasPrefix(l, "diff --git "):
+			fp = &filePatch{}
+			fps = append(fps, fp)
+			if fp.oldPath, fp.newPath, err = gitHeaderPaths(strings.TrimPrefix(l, "diff --git ")); err != nil {
+				return nil, fmt.Errorf("invalid file header on line %d: %v", i+1, err)
+			}
+		case strings.HasPrefix(l, "--- "):
+			if fp == nil || len(fp.hunks) > 0 {
+				// Diffs that are not produced by git have no header line preceding each file.
+				fp = &filePatch{}
+				fps = append(fps, fp)
+			}
+			if fp.oldPath, err = headerPath(l[4:]); err != nil {
+				return nil, fmt.Errorf("invalid file header on line %d: %v", i+1, err)
+			}
+		case strings.HasPrefix(l, "+++ ") && fp != nil:
+			if fp.newPath, err = headerPath(l[4:]); err != nil {
+				return nil, fmt.Errorf("invalid file header on line %d: %v", i+1, err)
+			}
+		case strings.HasPrefix(l, "new file mode") && fp != nil:
+			fp.oldPath = ""
+		case strings.HasPrefix(l, "deleted file mode") && fp != nil:
+			fp.newPath = ""
+		case strings.HasPrefix(l, "rename from ") && fp != nil:
+			if fp.oldPath, err = gitPath(strings.TrimPrefix(l, "rename from ")); err != nil {
+				return nil, fmt.Errorf("invalid rename on line %d: %v", i+1, err)
+			}
+		case strings.HasPrefix(l, "rename to ") && fp != nil:
+			if fp.newPath, err = gitPath(strings.TrimPrefix(l, "rename to ")); err != nil {
+				return nil, fmt.Errorf("invalid rename on line %d: %v", i+1, err)
+			}
+		case strings.HasPrefix(l, "Binary files ") || l == "GIT binary patch":
+			return nil, errors.New("binary patches are not supported")
+		case strings.HasPrefix(l, "@@ "):
+			if fp == nil {
+				return nil, fmt.Errorf("hunk without file header on line %d", i+1)
+			}
+			h, n, err := parseHunk(lines[i:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid hunk on line %d: %v", i+1, err)
+			}
+			fp.hunks = append(fp.hunks, h)
+			i += n - 1
+		}
+	}
+	for _, fp := range fps {
+		if fp.oldPath == "" && fp.newPath == "" {
+			return nil, errors.New("could not determine the path of a file in the patch")
+		}
+	}
+	return fps, nil
+}
+
+// parseHunk parses the hunk starting at the first of the given lines. It returns the number of lines
+// that make up the hunk.
+func parseHunk(lines []string) (hunk, int, error) {
+	m := hunkHeaderRE.FindStringSubmatch(lines[0])
+	if m == nil {
+		return hunk{}, 0, fmt.Errorf("malformed header %q", strings.TrimSpace(lines[0]))
+	}
+	count := func(s string) int {
+		if s == "" {
+			return 1
+		}
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	h := hunk{oldLines: count(m[2]), newLines: count(m[4])}
+	h.oldStart, _ = strconv.Atoi(m[1])
+
+	oldLeft, newLeft := h.oldLines, h.newLines
+	n := 1
+	for ; n < len(lines) && (oldLeft > 0 || newLeft > 0 || strings.HasPrefix(lines[n], `\`)); n++ {
+		l := lines[n]
+		switch {
+		case strings.HasPrefix(l, `\`):
+			// The preceding line has no line ending.
+			if len(h.lines) > 0 {
+				h.lines[len(h.lines)-1] = strings.TrimRight(h.lines[len(h.lines)-1], "\r\n")
+			}
+			continue
+		case strings.HasPrefix(l, " ") || l == "\n" || l == "\r\n":
+			if !strings.HasPrefix(l, " ") {
+				// Some tools strip the space prefix of empty context lines.
+				l = " " + l
+			}
+			oldLeft--
+			newLeft--
+		case strings.HasPrefix(l, "-"):
+			oldLeft--
+		case strings.HasPrefix(l, "+"):
+			newLeft--
+		default:
+			return hunk{}, 0, fmt.Errorf("unexpected line %q", strings.TrimSpace(l))
+		}
+		if oldLeft < 0 || newLeft < 0 {
+			return hunk{}, 0, errors.New("line counts do not match header")
+		}
+		h.lines = append(h.lines, l)
+	}
+	if oldLeft > 0 || newLeft > 0 {
+		return hunk{}, 0, errors.New("hunk is truncated")
+	}
+	return h, n, nil
+}
+
+// apply returns the result of applying the patch's hunks to the given content.
+func (fp *filePatch) apply(content string) (string, error) {
+	old := strings.SplitAfter(content, "\n")
+	if old[len(old)-1] == "" {
+		old = old[:len(old)-1]
+	}
+
+	var res []string
+	var cursor int
+	for _, h := range fp.hunks {
+		start := h.oldStart - 1
+		if h.oldLines == 0 {
+			// Pure insertions reference the line after which they occur.
+			start = h.oldStart
+		}
+		if start < cursor || start > len(old) {
+			return "", fmt.Errorf("hunk at line %d is out of range", h.oldStart)
+		}
+		res = append(res, old[cursor:start]...)
+		cursor = start
+
+		for _, l := range h.lines {
+			switch l[0] {
+			case ' ', '-':
+				if cursor >= len(old) || old[cursor] != l[1:] {
+					return "", fmt.Errorf("hunk at line %d does not match the content of the file", h.oldStart)
+				}
+				if l[0] == ' ' {
+					res = append(res, l[1:])
+				}
+				cursor++
+			case '+':
+				res = append(res, l[1:])
+			}
+		}
+	}
+	res = append(res, old[cursor:]...)
+	return strings.Join(res, ""), nil
+}
+
+// headerPath extracts the path from the '---' or '+++' header line of a file patch.
+func headerPath(p string) (string, error) {
+	if i := strings.IndexByte(p, '\t'); i >= 0 {
+		// Strip timestamps as added by 'diff -u' and the trailing tab added by git for paths that
+		// contain spaces.
+		p = p[:i]
+	}
+	if p = strings.TrimSpace(p); p == "/dev/null" {
+		return "", nil
+	}
+	p, err := gitPath(p)
+	return trimPathPrefix(p), err
+}
+
+// gitHeaderPaths extracts the old and new paths from the arguments of a 'diff --git' line. Paths
+// that git quotes because they contain special characters are unquoted. Unquoted paths may contain
+// spaces, in which case they can only be told apart if they are identical. The paths of renamed
+// files are then determined by the lines following the header instead, hence empty paths are
+// returned.
+func gitHeaderPaths(args string) (string, string, error) {
+	var oldPath, newPath string
+	var err error
+	switch {
+	case strings.HasPrefix(args, `"`):
+		var rest string
+		if oldPath, rest, err = unquotePath(args); err != nil {
+			return "", "", err
+		}
+		if newPath, err = gitPath(strings.TrimPrefix(rest, " ")); err != nil {
+			return "", "", err
+		}
+	case strings.HasSuffix(args, `"`):
+		// Unquoted paths never contain a double quote.
+		i := strings.Index(args, ` "`)
+		if i < 0 {
+			return "", "", fmt.Errorf("malformed paths %q", args)
+		}
+		oldPath = args[:i]
+		if newPath, err = gitPath(args[i+1:]); err != nil {
+			return "", "", err
+		}
+	case strings.Count(args, " ") == 1:
+		i := strings.IndexByte(args, ' ')
+		oldPath, newPath = args[:i], args[i+1:]
+	default:
+		m := len(args) / 2
+		if len(args)%2 == 0 || args[m] != ' ' || trimPathPrefix(args[:m]) != trimPathPrefix(args[m+1:]) {
+			return "", "", nil
+		}
+		oldPath, newPath = args[:m], args[m+1:]
+	}
+	return trimPathPrefix(oldPath), trimPathPrefix(newPath), nil
+}
+
+// gitPath unquotes the given path if it was quoted by git.
+func gitPath(p string) (string, error) {
+	if !strings.HasPrefix(p, `"`) {
+		return p, nil
+	}
+	p, rest, err := unquotePath(p)
+	if err == nil && rest != "" {
+		err = fmt.Errorf("unexpected content %q after quoted path", rest)
+	}
+	return p, err
+}
+
+// unquotePath unquotes the C-style quoted path at the start of the given string, as produced by git
+// for paths that contain special characters. The remainder of the string is returned as well.
+func unquotePath(s string) (string, string, error) {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			p, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", "", fmt.Errorf("malformed quoted path %q: %v", s[:i+1], err)
+			}
+			return p, s[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("unterminated quoted path %q", s)
+}
+
+func trimPathPrefix(p string) string {
+	if strings.HasPrefix(p, "a/") || strings.HasPrefix(p, "b/") {
+		return p[2:]
+	}
+	return p
+}
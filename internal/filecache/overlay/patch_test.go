@@ -0,0 +1,210 @@
+package overlay
+
+import (
+	"testing"
+
+	"github.com/modularise/modularise/internal/testlib"
+)
+
+func TestApplyPatch(t *testing.T) {
+	t.Parallel()
+
+	const original = "one\ntwo\nthree\nfour\nfive\n"
+
+	tcs := map[string]struct {
+		patch    string
+		content  string
+		expected string
+		err      bool
+	}{
+		"Modification": {
+			patch: `diff --git a/f.txt b/f.txt
+index 1111111..2222222 100644
+--- a/f.txt
++++ b/f.txt
+@@ -2,3 +2,3 @@ one
+ two
+-three
++drie
+ four
+`,
+			content:  original,
+			expected: "one\ntwo\ndrie\nfour\nfive\n",
+		},
+		"MultipleHunks": {
+			patch: `--- f.txt
++++ f.txt
+@@ -1,2 +1,3 @@
++zero
+ one
+ two
+@@ -5 +6,2 @@
+ five
++six
+`,
+			content:  original,
+			expected: "zero\none\ntwo\nthree\nfour\nfive\nsix\n",
+		},
+		"Insertion": {
+			patch: `--- a/f.txt
++++ b/f.txt
+@@ -2,0 +3 @@
++two and a half
+`,
+			content:  original,
+			expected: "one\ntwo\ntwo and a half\nthree\nfour\nfive\n",
+		},
+		"NoNewlineAtEnd": {
+			patch: `--- a/f.txt
++++ b/f.txt
+@@ -5 +5 @@
+-five
++5
+\ No newline at end of file
+`,
+			content:  original,
+			expected: "one\ntwo\nthree\nfour\n5",
+		},
+		"NewFile": {
+			patch: `diff --git a/g.txt b/g.txt
+new file mode 100644
+--- /dev/null
++++ b/g.txt
+@@ -0,0 +1,2 @@
++hello
++world
+`,
+			expected: "hello\nworld\n",
+		},
+		"Mismatch": {
+			patch: `--- a/f.txt
++++ b/f.txt
+@@ -2,1 +2,1 @@
+-three
++drie
+`,
+			content: original,
+			err:     true,
+		},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			fps, err := parsePatch(tc.patch)
+			testlib.NoError(t, true, err)
+			testlib.Equal(t, true, 1, len(fps))
+
+			res, err := fps[0].apply(tc.content)
+			if tc.err {
+				testlib.Error(t, false, err)
+				return
+			}
+			testlib.NoError(t, true, err)
+			testlib.Equal(t, false, tc.expected, res)
+		})
+	}
+}
+
+func TestParsePatch(t *testing.T) {
+	t.Parallel()
+
+	patch := `diff --git a/old.go b/new.go
+similarity index 100%
+rename from old.go
+rename to new.go
+diff --git a/gone.txt b/gone.txt
+deleted file mode 100644
+index 1111111..0000000
+--- a/gone.txt
++++ /dev/null
+@@ -1 +0,0 @@
+-bye
+diff --git a/lib/a.go b/lib/a.go
+--- a/lib/a.go
++++ b/lib/a.go
+@@ -1 +1 @@
+--- a
++++ b
+`
+
+	fps, err := parsePatch(patch)
+	testlib.NoError(t, true, err)
+	testlib.Equal(t, true, 3, len(fps))
+
+	testlib.Equal(t, false, "old.go", fps[0].oldPath)
+	testlib.Equal(t, false, "new.go", fps[0].newPath)
+	testlib.Equal(t, false, 0, len(fps[0].hunks))
+	testlib.Equal(t, false, "gone.txt", fps[1].oldPath)
+	testlib.Equal(t, false, "", fps[1].newPath)
+	// Hunk lines that look like file headers are part of the hunk.
+	testlib.Equal(t, false, "lib/a.go", fps[2].newPath)
+	testlib.Equal(t, false, []string{"--- a\n", "+++ b\n"}, fps[2].hunks[0].lines)
+
+	_, err = parsePatch("diff --git a/bin b/bin\nBinary files a/bin and b/bin differ\n")
+	testlib.Error(t, false, err)
+}
+
+func TestParsePatchPaths(t *testing.T) {
+	t.Parallel()
+
+	tcs := map[string]struct {
+		patch   string
+		oldPath string
+		newPath string
+		err     bool
+	}{
+		"Spaces": {
+			patch:   "diff --git a/mode file.txt b/mode file.txt\nold mode 100644\nnew mode 100755\n",
+			oldPath: "mode file.txt",
+			newPath: "mode file.txt",
+		},
+		"RenameWithSpaces": {
+			patch:   "diff --git a/old name.go b/new name.go\nsimilarity index 100%\nrename from old name.go\nrename to new name.go\n",
+			oldPath: "old name.go",
+			newPath: "new name.go",
+		},
+		"HeaderWithSpaces": {
+			patch:   "--- a/old name.go\t2020-05-17 13:04:05\n+++ b/old name.go\t\n@@ -1 +1 @@\n-x\n+y\n",
+			oldPath: "old name.go",
+			newPath: "old name.go",
+		},
+		"Quoted": {
+			patch:   "diff --git \"a/tab\\tfile.go\" \"b/tab\\tfile.go\"\nindex 975fbec..1a78173 100644\n--- \"a/tab\\tfile.go\"\n+++ \"b/tab\\tfile.go\"\n@@ -1 +1 @@\n-y\n+y2\n",
+			oldPath: "tab\tfile.go",
+			newPath: "tab\tfile.go",
+		},
+		"QuotedRename": {
+			patch:   "diff --git a/plain.go \"b/\\303\\244 \\\"q\\\".go\"\nsimilarity index 100%\nrename from plain.go\nrename to \"\\303\\244 \\\"q\\\".go\"\n",
+			oldPath: "plain.go",
+			newPath: "\u00e4 \"q\".go",
+		},
+		"UnterminatedQuote": {
+			patch: "diff --git \"a/file.go b/file.go\n",
+			err:   true,
+		},
+		"UnknownPaths": {
+			patch: "diff --git a/old name.go b/new name.go\nsimilarity index 100%\n",
+			err:   true,
+		},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			fps, err := parsePatch(tc.patch)
+			if tc.err {
+				testlib.Error(t, false, err)
+				return
+			}
+			testlib.NoError(t, true, err)
+			testlib.Equal(t, true, 1, len(fps))
+			testlib.Equal(t, false, tc.oldPath, fps[0].oldPath)
+			testlib.Equal(t, false, tc.newPath, fps[0].newPath)
+		})
+	}
+}
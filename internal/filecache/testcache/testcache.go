@@ -10,6 +10,8 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+
+	"golang.org/x/mod/modfile"
 )
 
 type FakeFileCacheEntry struct {
@@ -20,6 +22,7 @@ type FakeFileCache struct {
 	dir         string
 	path        string
 	fileEntries map[string]FakeFileCacheEntry
+	nested      map[string]string
 }
 
 func NewFakeFileCache(root string, files map[string]FakeFileCacheEntry) (*FakeFileCache, error) {
@@ -33,18 +36,35 @@ func NewFakeFileCache(root string, files map[string]FakeFileCacheEntry) (*FakeFi
 		return nil, errors.New("no module path found in go.mod")
 	}
 
+	nested := map[string]string{}
+	for f, e := range files {
+		if f != "go.mod" && filepath.Base(f) == "go.mod" {
+			nested[modfile.ModulePath(e.Data)] = filepath.Dir(f)
+		}
+	}
+
 	ifs := map[string]FakeFileCacheEntry{}
 	for f, e := range files {
-		if strings.HasPrefix(f, ".git"+string(os.PathSeparator)) {
+		if strings.HasPrefix(f, ".git"+string(os.PathSeparator)) || strings.HasPrefix(f, "vendor"+string(os.PathSeparator)) {
 			continue
 		}
-		ifs[f] = e
+		var inNested bool
+		for _, d := range nested {
+			if strings.HasPrefix(f, d+string(os.PathSeparator)) {
+				inNested = true
+				break
+			}
+		}
+		if !inNested {
+			ifs[f] = e
+		}
 	}
 
 	return &FakeFileCache{
 		dir:         root,
 		path:        string(m[1]),
 		fileEntries: ifs,
+		nested:      nested,
 	}, nil
 }
 
@@ -72,6 +92,10 @@ func (c FakeFileCache) Files() map[string]bool {
 	return fs
 }
 
+func (c FakeFileCache) NestedModules() map[string]string {
+	return c.nested
+}
+
 func (c FakeFileCache) FilesInPkg(pkg string) (map[string]bool, error) {
 	if !c.Pkgs()[pkg] {
 		return nil, fmt.Errorf("package %q is not part of module %q", pkg, c.path)
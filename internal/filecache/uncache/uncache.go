@@ -15,6 +15,7 @@ import (
 	"strings"
 
 	"go.uber.org/zap"
+	"golang.org/x/mod/modfile"
 )
 
 type ModuleInfo struct {
@@ -23,7 +24,11 @@ type ModuleInfo struct {
 }
 
 func NewUncache(log *zap.Logger, root string) (*Uncache, error) {
-	const nonModuleListErr = "go list -m: not using modules"
+	const (
+		nonModuleListErr = "go list -m: not using modules"
+		// Recent Go versions report the GOPATH mode that is selected outside of modules instead.
+		gopathModeListErr = "list -m cannot be used with GO111MODULE=off"
+	)
 
 	var err error
 	if root, err = filepath.Abs(root); err != nil {
@@ -43,7 +48,7 @@ func NewUncache(log *zap.Logger, root string) (*Uncache, error) {
 	cmd.Stderr = eb
 	cmd.Stdout = ob
 	if err = cmd.Run(); err != nil {
-		if !strings.Contains(eb.String(), nonModuleListErr) {
+		if !strings.Contains(eb.String(), nonModuleListErr) && !strings.Contains(eb.String(), gopathModeListErr) {
 			log.Error("Unable to run 'go list -m -json'", zap.String("output", eb.String()), zap.Error(err))
 			return nil, errors.New("go list error")
 		}
@@ -82,11 +87,12 @@ func NewUncache(log *zap.Logger, root string) (*Uncache, error) {
 }
 
 type Uncache struct {
-	log   *zap.Logger
-	root  string
-	path  string
-	files map[string]bool
-	pkgs  map[string]bool
+	log    *zap.Logger
+	root   string
+	path   string
+	files  map[string]bool
+	pkgs   map[string]bool
+	nested map[string]string
 }
 
 func (c Uncache) Root() string {
@@ -105,6 +111,10 @@ func (c *Uncache) Files() map[string]bool {
 	return c.files
 }
 
+func (c *Uncache) NestedModules() map[string]string {
+	return c.nested
+}
+
 func (c *Uncache) FilesInPkg(pkg string) (map[string]bool, error) {
 	if !c.pkgs[pkg] {
 		c.log.Error("Supplied package is not part of module abstracted by this filecache.", zap.String("package", pkg), zap.String("module", c.path))
@@ -152,6 +162,7 @@ func (c *Uncache) populateFilesAndPkgs() (err error) {
 
 	files := map[string]bool{}
 	pkgs := map[string]bool{}
+	nested := map[string]string{}
 	err = filepath.Walk(c.root, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			c.log.Error("Failed to walk sub-directories of uncache.", zap.Error(err))
@@ -163,8 +174,15 @@ func (c *Uncache) populateFilesAndPkgs() (err error) {
 				return nil
 			} else if filepath.Base(path) == ".git" {
 				return filepath.SkipDir
+			} else if path == filepath.Join(c.root, "vendor") {
+				// Vendored packages are not part of the module itself.
+				return filepath.SkipDir
 			}
-			if _, err = os.Stat(filepath.Join(path, "go.mod")); err == nil {
+			if b, err := ioutil.ReadFile(filepath.Join(path, "go.mod")); err == nil {
+				mp := modfile.ModulePath(b)
+				rel := strings.TrimPrefix(path, c.root+"/")
+				c.log.Info("Discovered nested module. Its packages are not part of the module and are treated as an external dependency.", zap.String("module", mp), zap.String("directory", rel))
+				nested[mp] = rel
 				return filepath.SkipDir
 			} else if !os.IsNotExist(err) {
 				c.log.Error("Could not gather information about a go.mod in uncache.", zap.Error(err))
@@ -185,5 +203,6 @@ func (c *Uncache) populateFilesAndPkgs() (err error) {
 
 	c.files = files
 	c.pkgs = pkgs
+	c.nested = nested
 	return nil
 }
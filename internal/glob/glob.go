@@ -0,0 +1,89 @@
+package glob
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// IsGlob determines whether the given path contains any glob meta-characters.
+func IsGlob(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+// Compile converts a doublestar glob pattern into a regular expression that matches entire paths.
+func Compile(glob string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile("^(?:" + ToRegexp(glob) + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %v", glob, err)
+	}
+	return re, nil
+}
+
+// LiteralDir returns the leading path elements of a glob pattern that do not contain any
+// meta-characters.
+func LiteralDir(glob string) string {
+	var d []string
+	for _, e := range strings.Split(glob, "/") {
+		if IsGlob(e) {
+			break
+		}
+		d = append(d, e)
+	}
+	if len(d) == len(strings.Split(glob, "/")) {
+		d = d[:len(d)-1]
+	}
+	return strings.Join(d, "/")
+}
+
+// ToRegexp converts a doublestar glob pattern into an equivalent unanchored regular expression. The
+// following syntax is supported:
+//  - '**' matches any number, including zero, of path elements.
+//  - '*' matches any sequence of characters within a single path element.
+//  - '?' matches a single character within a path element.
+//  - '[...]' matches a character class, a leading '!' negates the class.
+func ToRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				switch {
+				case i+2 < len(glob) && glob[i+2] == '/':
+					// Leading or intermediate '**/'.
+					sb.WriteString("(?:.*/)?")
+					i += 2
+				case i > 0 && glob[i-1] == '/' && i+2 == len(glob):
+					// Trailing '/**': the separator has already been written.
+					s := sb.String()
+					sb.Reset()
+					sb.WriteString(strings.TrimSuffix(s, "/"))
+					sb.WriteString("(?:/.*)?")
+					i++
+				default:
+					sb.WriteString(".*")
+					i++
+				}
+				continue
+			}
+			sb.WriteString("[^/]*")
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			j := strings.IndexByte(glob[i:], ']')
+			if j < 0 {
+				sb.WriteString(regexp.QuoteMeta(glob[i:]))
+				return sb.String()
+			}
+			class := glob[i+1 : i+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += j
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,60 @@
+package glob
+
+import (
+	"testing"
+
+	"github.com/modularise/modularise/internal/testlib"
+)
+
+func TestCompile(t *testing.T) {
+	t.Parallel()
+
+	tcs := map[string]struct {
+		glob     string
+		matches  []string
+		excludes []string
+	}{
+		"Literal":            {glob: "pkg/api", matches: []string{"pkg/api"}, excludes: []string{"pkg/api/v1", "pkg"}},
+		"Star":               {glob: "pkg/*", matches: []string{"pkg/api"}, excludes: []string{"pkg/api/v1", "pkg"}},
+		"LeadingDoubleStar":  {glob: "**/api", matches: []string{"api", "pkg/api", "a/b/api"}, excludes: []string{"pkg/api/v1"}},
+		"InnerDoubleStar":    {glob: "pkg/**/api", matches: []string{"pkg/api", "pkg/a/b/api"}, excludes: []string{"api"}},
+		"TrailingDoubleStar": {glob: "pkg/**", matches: []string{"pkg", "pkg/a", "pkg/a/b"}, excludes: []string{"pkgs"}},
+		"QuestionMark":       {glob: "v?", matches: []string{"v1", "v2"}, excludes: []string{"v10", "v/"}},
+		"CharClass":          {glob: "v[12]", matches: []string{"v1", "v2"}, excludes: []string{"v3"}},
+		"NegatedCharClass":   {glob: "v[!12]", matches: []string{"v3"}, excludes: []string{"v1"}},
+		"QuotedMeta":         {glob: "a.b", matches: []string{"a.b"}, excludes: []string{"axb"}},
+		"FileExtension":      {glob: "**/*.proto", matches: []string{"a.proto", "api/v1/a.proto"}, excludes: []string{"a.proto.bak"}},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			re, err := Compile(tc.glob)
+			testlib.NoError(t, true, err)
+			for _, m := range tc.matches {
+				testlib.True(t, false, re.MatchString(m))
+			}
+			for _, e := range tc.excludes {
+				testlib.False(t, false, re.MatchString(e))
+			}
+		})
+	}
+}
+
+func TestLiteralDir(t *testing.T) {
+	t.Parallel()
+
+	tcs := map[string]string{
+		"api/*.proto":        "api",
+		"api/v1/**/*.proto":  "api/v1",
+		"**/*.proto":         "",
+		"api/v1/schema.json": "api/v1",
+		"schema.json":        "",
+	}
+
+	for g, expected := range tcs {
+		testlib.Equal(t, false, expected, LiteralDir(g))
+	}
+}
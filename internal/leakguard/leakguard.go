@@ -0,0 +1,169 @@
+package leakguard
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"go.uber.org/zap"
+
+	"github.com/modularise/modularise/cmd/config"
+	"github.com/modularise/modularise/internal/glob"
+)
+
+// CheckSplits scans the work tree of each split against the configured LeakGuard rules. All
+// violations are reported before an error is returned so that they can be addressed at once.
+//
+// The prequisites on the fields of a config.Splits object for CheckSplits to be able to operate
+// are:
+//  - For each config.Split in Splits the Name and WorkDir fields are populated.
+func CheckSplits(log *zap.Logger, sp *config.Splits) error {
+	g, err := newGuard(sp.LeakGuard)
+	if err != nil {
+		log.Error("Invalid leak guard configuration.", zap.Error(err))
+		return err
+	} else if g.empty() {
+		return nil
+	}
+
+	var names []string
+	for n := range sp.Splits {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var found bool
+	for _, n := range names {
+		vs, err := g.checkSplit(log, sp.Splits[n])
+		if err != nil {
+			return err
+		}
+		for _, v := range vs {
+			log.Error("Split content violates the leak guard policy.", zap.String("split", n), zap.String("file", v.file), zap.String("reason", v.reason))
+		}
+		found = found || len(vs) > 0
+	}
+	if found {
+		return errors.New("split content violates the leak guard policy")
+	}
+	return nil
+}
+
+type violation struct {
+	file   string
+	reason string
+}
+
+type guard struct {
+	config.LeakGuard
+	denyPaths   []*regexp.Regexp
+	denyContent []*regexp.Regexp
+}
+
+func newGuard(lg config.LeakGuard) (*guard, error) {
+	g := &guard{LeakGuard: lg}
+	for _, p := range lg.DenyPaths {
+		re, err := glob.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		g.denyPaths = append(g.denyPaths, re)
+	}
+	for _, c := range lg.DenyContent {
+		re, err := regexp.Compile(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid content expression %q: %v", c, err)
+		}
+		g.denyContent = append(g.denyContent, re)
+	}
+	return g, nil
+}
+
+func (g *guard) empty() bool {
+	return len(g.denyPaths) == 0 && len(g.denyContent) == 0 && g.MaxFileSize <= 0
+}
+
+func (g *guard) checkSplit(log *zap.Logger, s *config.Split) ([]violation, error) {
+	var allow []*regexp.Regexp
+	for _, a := range s.LeakGuardAllow {
+		re, err := glob.Compile(a)
+		if err != nil {
+			log.Error("Invalid leak guard allow-list entry for split.", zap.String("split", s.Name), zap.Error(err))
+			return nil, err
+		}
+		allow = append(allow, re)
+	}
+
+	var vs []violation
+	err := filepath.Walk(s.WorkDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if fi.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.WorkDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		for _, re := range allow {
+			if re.MatchString(rel) {
+				log.Debug("File is exempt from leak guard.", zap.String("split", s.Name), zap.String("file", rel))
+				return nil
+			}
+		}
+
+		v, err := g.checkFile(path, rel, fi.Size())
+		if err != nil {
+			return err
+		}
+		for _, r := range v {
+			vs = append(vs, violation{file: rel, reason: r})
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("Failed to scan split content.", zap.String("split", s.Name), zap.Error(err))
+		return nil, err
+	}
+	return vs, nil
+}
+
+// checkFile returns the reasons for which the file at the given path, which is located at rel
+// relative to the split's root, violates the guard's rules.
+func (g *guard) checkFile(path string, rel string, size int64) ([]string, error) {
+	var rs []string
+
+	for i, re := range g.denyPaths {
+		if re.MatchString(rel) {
+			rs = append(rs, fmt.Sprintf("path matches denied pattern %q", g.DenyPaths[i]))
+		}
+	}
+	if g.MaxFileSize > 0 && size > g.MaxFileSize {
+		rs = append(rs, fmt.Sprintf("file size of %d bytes exceeds limit of %d bytes", size, g.MaxFileSize))
+	}
+	if len(g.denyContent) == 0 {
+		return rs, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, re := range g.denyContent {
+		if loc := re.FindIndex(b); loc != nil {
+			rs = append(rs, fmt.Sprintf("content matches denied expression %q on line %d", re.String(), bytes.Count(b[:loc[0]], []byte("\n"))+1))
+		}
+	}
+	return rs, nil
+}
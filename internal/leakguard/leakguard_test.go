@@ -0,0 +1,90 @@
+package leakguard
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/modularise/modularise/cmd/config"
+	"github.com/modularise/modularise/internal/splits"
+	"github.com/modularise/modularise/internal/testlib"
+)
+
+func TestCheckSplits(t *testing.T) {
+	t.Parallel()
+
+	files := map[string]string{
+		"lib.go":              "package lib\n",
+		"docs/design.md":      "# Design\n\nINTERNAL ONLY\n",
+		"notes/internal.txt":  "notes\n",
+		"testdata/key.txt":    "line\nAKIAABCDEFGHIJKLMNOP\n",
+		"testdata/large.json": "{\"data\": \"0123456789\"}\n",
+		".git/config":         "INTERNAL ONLY\n",
+	}
+
+	tcs := map[string]struct {
+		guard      config.LeakGuard
+		allow      []string
+		violations []string
+	}{
+		"NoRules": {},
+		"DenyPaths": {
+			guard:      config.LeakGuard{DenyPaths: []string{"notes/**", "**/*.md"}},
+			violations: []string{"docs/design.md", "notes/internal.txt"},
+		},
+		"DenyContent": {
+			guard:      config.LeakGuard{DenyContent: []string{"INTERNAL ONLY", "AKIA[0-9A-Z]{16}"}},
+			violations: []string{"docs/design.md", "testdata/key.txt"},
+		},
+		"MaxFileSize": {
+			guard:      config.LeakGuard{MaxFileSize: 20},
+			violations: []string{"docs/design.md", "testdata/large.json", "testdata/key.txt"},
+		},
+		"AllowList": {
+			guard:      config.LeakGuard{DenyContent: []string{"INTERNAL ONLY", "AKIA[0-9A-Z]{16}"}},
+			allow:      []string{"testdata/**"},
+			violations: []string{"docs/design.md"},
+		},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			td, err := ioutil.TempDir("", "modularise-leakguard-test")
+			testlib.NoError(t, true, err)
+			defer func() { testlib.NoError(t, false, os.RemoveAll(td)) }()
+
+			for f, c := range files {
+				p := filepath.Join(td, f)
+				testlib.NoError(t, true, os.MkdirAll(filepath.Dir(p), 0755))
+				testlib.NoError(t, true, ioutil.WriteFile(p, []byte(c), 0644))
+			}
+
+			s := &config.Split{LeakGuardAllow: tc.allow, DataSplit: splits.DataSplit{Name: "split", WorkDir: td}}
+			g, err := newGuard(tc.guard)
+			testlib.NoError(t, true, err)
+
+			vs, err := g.checkSplit(testlib.NewTestLogger(), s)
+			testlib.NoError(t, true, err)
+
+			violating := map[string]bool{}
+			for _, v := range vs {
+				violating[v.file] = true
+			}
+			var found []string
+			for f := range violating {
+				found = append(found, f)
+			}
+			sort.Strings(found)
+			sort.Strings(tc.violations)
+			testlib.Equal(t, false, tc.violations, found)
+
+			err = CheckSplits(testlib.NewTestLogger(), &config.Splits{LeakGuard: tc.guard, Splits: map[string]*config.Split{"split": s}})
+			testlib.Equal(t, false, len(tc.violations) > 0, err != nil)
+		})
+	}
+}
@@ -5,19 +5,30 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/go-git/go-git/v5"
 	"go.uber.org/zap"
 
 	"github.com/modularise/modularise/cmd/config"
+	"github.com/modularise/modularise/internal/repohandler"
 )
 
 func (r *resolver) resolveSplitDeps(s *config.Split) error {
 	if err := r.cleanupGoMod(s); err != nil {
 		return err
 	}
+	if err := r.vendorDeps(s); err != nil {
+		return err
+	}
+	if err := r.buildTests(s); err != nil {
+		return err
+	}
 	if err := r.commitChanges(s); err != nil {
 		return err
 	}
@@ -42,18 +53,25 @@ func (r *resolver) cleanupGoMod(s *config.Split) error {
 			continue
 		}
 
+		var pinned bool
 		for dn := range s.SplitDeps {
-			// We need to filter against the module-path suffixed with a space to deal with nested modules.
-			if strings.HasPrefix(strings.TrimSpace(l), r.sp.Splits[dn].ModulePath+" ") {
+			if l, pinned = pinRequirement(l, r.sp.Splits[dn].ModulePath, r.sp.Splits[dn].Version); pinned {
 				r.log.Debug(
 					"Adding dependency on version of split.",
 					zap.String("split-module", r.sp.Splits[dn].ModulePath),
 					zap.String("version", r.sp.Splits[dn].Version),
 				)
-				l = fmt.Sprintf("\t%s %s", r.sp.Splits[dn].ModulePath, r.sp.Splits[dn].Version)
 				break
 			}
 		}
+		for _, lm := range r.localMods {
+			if pinned {
+				break
+			}
+			if l, pinned = pinRequirement(l, lm.path, lm.version); pinned {
+				r.log.Debug("Adding dependency on version of local module.", zap.String("module", lm.path), zap.String("version", lm.version))
+			}
+		}
 		newMod = append(newMod, l)
 	}
 
@@ -69,30 +87,158 @@ func (r *resolver) cleanupGoMod(s *config.Split) error {
 		r.log.Error("Failed to determine current GORPOXY value via 'go env'.", zap.Error(err), zap.String("output", string(out)))
 		return err
 	}
+	r.upstreamProxy = strings.TrimSpace(string(out))
+
+	cmd = exec.Command("go", "mod", "tidy")
+	cmd.Dir = s.WorkDir
+	cmd.Env = r.goEnv(s, "mod")
+
+	r.log.Debug("Running 'go mod tidy' using definitive versions.", zap.String("directory", s.WorkDir))
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		r.log.Error("Failed to clean up go.mod.", zap.String("file", modFile), zap.ByteString("output", out))
+		return err
+	}
+	return nil
+}
+
+// buildTests compiles the tests of a split that retains a subset of the source module's tests in
+// order to verify that the retained tests still build without the files that were dropped. The tests
+// are not run and no vet checks are performed, so that issues already present in the source module
+// do not prevent the split from being generated.
+func (r *resolver) buildTests(s *config.Split) error {
+	if s.Tests != config.TestPolicyPackage && s.Tests != config.TestPolicySeparate {
+		return nil
+	}
+
+	mod := "readonly"
+	if s.Vendor {
+		mod = "vendor"
+	}
+	cmd := exec.Command("go", "test", "-vet=off", "-run=^$", "./...")
+	cmd.Dir = s.WorkDir
+	cmd.Env = r.goEnv(s, mod)
+
+	r.log.Debug("Building the split's tests.", zap.String("directory", s.WorkDir))
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	r.log.Error("The tests retained in the split fail to build.", zap.String("split", s.Name), zap.ByteString("output", out))
+	for _, f := range droppedTestsOfFailures(s, out) {
+		r.log.Error("A test file was dropped from a package whose tests fail to build.", zap.String("split", s.Name), zap.String("file", f))
+	}
+	return fmt.Errorf("tests of split %q fail to build: %v", s.Name, err)
+}
+
+var failedPkgRE = regexp.MustCompile(`(?m)^# (\S+)`)
+
+// droppedTestsOfFailures returns the test files that were dropped from the split's packages whose
+// tests failed to build according to the given output of 'go test'.
+func droppedTestsOfFailures(s *config.Split, out []byte) []string {
+	failed := map[string]bool{}
+	for _, m := range failedPkgRE.FindAllSubmatch(out, -1) {
+		failed[strings.TrimSuffix(string(m[1]), "_test")] = true
+	}
+
+	root := filepath.ToSlash(s.Root)
+	var fs []string
+	for f := range s.DroppedTests {
+		rel := filepath.ToSlash(filepath.Dir(f))
+		if root != "" && root != "." {
+			rel = strings.TrimPrefix(strings.TrimPrefix(rel, root), "/")
+		}
+		if failed[path.Join(s.ModulePath, rel)] {
+			fs = append(fs, f)
+		}
+	}
+	sort.Strings(fs)
+	return fs
+}
+
+// vendorDeps runs 'go mod vendor' for splits that should be published as vendored modules.
+func (r *resolver) vendorDeps(s *config.Split) error {
+	if !s.Vendor {
+		return nil
+	}
+
+	cmd := exec.Command("go", "mod", "vendor")
+	cmd.Dir = s.WorkDir
+	cmd.Env = r.goEnv(s, "mod")
+
+	r.log.Debug("Running 'go mod vendor'.", zap.String("directory", s.WorkDir))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		r.log.Error("Failed to vendor the dependencies of the split.", zap.String("split", s.Name), zap.ByteString("output", out))
+		return err
+	}
+	return nil
+}
 
+// goEnv returns the environment for Go commands run in the split's working directory so that the
+// dependencies on other splits are resolved via the local proxy. The given value replaces any '-mod'
+// flag set via GOFLAGS as the vendoring setup of the source module does not apply to the split.
+func (r *resolver) goEnv(s *config.Split, mod string) []string {
 	var splitPaths []string
 	for sn := range r.transDeps[s.Name] {
 		splitPaths = append(splitPaths, r.sp.Splits[sn].ModulePath)
 	}
+	for mp := range r.localMods {
+		splitPaths = append(splitPaths, mp)
+	}
 
-	cmd = exec.Command("go", "mod", "tidy")
-	cmd.Dir = s.WorkDir
-	cmd.Env = append(
+	proxy := "file://" + r.localProxy
+	if r.vendorMode && r.upstreamProxy != "" && r.upstreamProxy != "off" {
+		// The dependencies of a vendored source module are not necessarily present in the module
+		// cache, hence they may need to be fetched.
+		proxy += "," + r.upstreamProxy
+	}
+	return append(
 		os.Environ(),
 		"GODEBUG=", // Don't pass any debug options to the lower-level invocation.
+		fmt.Sprintf("GOFLAGS=%s", goFlags(os.Getenv("GOFLAGS"), mod)),
 		fmt.Sprintf("GONOSUMDB=%s", strings.Join(splitPaths, ",")),
-		fmt.Sprintf("GOPROXY=file://%s", r.localProxy),
+		fmt.Sprintf("GOPROXY=%s", proxy),
 	)
+}
 
-	r.log.Debug("Running 'go mod tidy' using definitive versions.", zap.String("directory", s.WorkDir))
-	out, err = cmd.CombinedOutput()
-	if err != nil {
-		r.log.Error("Failed to clean up go.mod.", zap.String("file", modFile), zap.ByteString("output", out))
-		return err
+// goFlags replaces the '-mod' flag in the given GOFLAGS value.
+func goFlags(flags string, mod string) string {
+	fs := []string{"-mod=" + mod}
+	for _, f := range strings.Fields(flags) {
+		if !strings.HasPrefix(f, "-mod=") {
+			fs = append(fs, f)
+		}
 	}
-	return nil
+	return strings.Join(fs, " ")
 }
 
+// sourceVendorMode determines whether the Go commands run in the source module use its vendored
+// dependencies, given the content of its go.mod file and the value of GOFLAGS.
+func sourceVendorMode(root string, goMod string, flags string) bool {
+	if _, err := os.Stat(filepath.Join(root, "vendor", "modules.txt")); err != nil {
+		return false
+	}
+	for _, f := range strings.Fields(flags) {
+		switch f {
+		case "-mod=vendor":
+			return true
+		case "-mod=mod", "-mod=readonly":
+			return false
+		}
+	}
+
+	// Since Go 1.14 vendored dependencies are used by default for modules that declare it or later.
+	m := goVersionRE.FindStringSubmatch(goMod)
+	if m == nil {
+		return false
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return major > 1 || minor >= 14
+}
+
+var goVersionRE = regexp.MustCompile(`(?m)^go (\d+)\.(\d+)`)
+
 func (r *resolver) commitChanges(s *config.Split) error {
 	if s.Repo == nil {
 		r.log.Error(
@@ -132,7 +278,10 @@ func (r *resolver) commitChanges(s *config.Split) error {
 	}
 
 	_, err = wt.Commit(
-		fmt.Sprintf("Splice from %s@%s", r.fc.ModulePath(), r.sourceVer),
+		repohandler.CommitMessage(
+			fmt.Sprintf("Splice from %s@%s", r.fc.ModulePath(), r.sourceVer),
+			fmt.Sprintf("%s@%s", r.fc.ModulePath(), r.sourceVer),
+		),
 		&git.CommitOptions{
 			All:    true,
 			Author: r.sp.Author.ExtractAuthor(),
@@ -131,6 +131,105 @@ func TestLocalProxy(t *testing.T) {
 // Cleaning up a testing directory might be complicated by the fact that the content of the module
 // cache is read-only by design. As a result we need to first ensure that the entirety of the
 // testing directory's content is writeable before deleting it.
+func TestGoFlags(t *testing.T) {
+	t.Parallel()
+
+	tcs := map[string]struct {
+		flags    string
+		mod      string
+		expected string
+	}{
+		"Empty":       {mod: "mod", expected: "-mod=mod"},
+		"OtherFlags":  {flags: "-trimpath  -tags=foo", mod: "readonly", expected: "-mod=readonly -trimpath -tags=foo"},
+		"ReplacesMod": {flags: "-mod=vendor -trimpath", mod: "mod", expected: "-mod=mod -trimpath"},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			testlib.Equal(t, false, tc.expected, goFlags(tc.flags, tc.mod))
+		})
+	}
+}
+
+func TestDroppedTestsOfFailures(t *testing.T) {
+	t.Parallel()
+
+	out := []byte(`# example.com/split/pkg [example.com/split/pkg.test]
+pkg/a_test.go:3:27: undefined: helper
+# example.com/split/other_test [example.com/split/other.test]
+other/b_test.go:3:27: undefined: x
+FAIL	example.com/split/pkg [build failed]
+FAIL	example.com/split/other [build failed]
+FAIL
+`)
+
+	tcs := map[string]struct {
+		root     string
+		dropped  map[string]bool
+		expected []string
+	}{
+		"NoDroppedTests": {root: "lib"},
+		"SplitRoot": {
+			root:     "lib",
+			dropped:  map[string]bool{"lib/pkg/helper_test.go": true, "lib/other/ext_test.go": true, "lib/ok/helper_test.go": true},
+			expected: []string{"lib/other/ext_test.go", "lib/pkg/helper_test.go"},
+		},
+		"ModuleRoot": {
+			root:     ".",
+			dropped:  map[string]bool{"pkg/helper_test.go": true, "helper_test.go": true},
+			expected: []string{"pkg/helper_test.go"},
+		},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			s := &config.Split{ModulePath: "example.com/split", DataSplit: splits.DataSplit{Root: tc.root, DroppedTests: tc.dropped}}
+			testlib.Equal(t, false, tc.expected, droppedTestsOfFailures(s, out))
+		})
+	}
+}
+
+func TestSourceVendorMode(t *testing.T) {
+	t.Parallel()
+
+	vendored, err := ioutil.TempDir("", "modularise-vendor-mode-test")
+	testlib.NoError(t, true, err)
+	defer cleanupTestDir(t, vendored)
+	testlib.NoError(t, true, os.MkdirAll(filepath.Join(vendored, "vendor"), 0755))
+	testlib.NoError(t, true, ioutil.WriteFile(filepath.Join(vendored, "vendor", "modules.txt"), []byte("# example.com/dep v1.0.0\n"), 0644))
+
+	plain, err := ioutil.TempDir("", "modularise-vendor-mode-test")
+	testlib.NoError(t, true, err)
+	defer cleanupTestDir(t, plain)
+
+	tcs := map[string]struct {
+		root     string
+		goMod    string
+		flags    string
+		expected bool
+	}{
+		"NoVendorDirectory":   {root: plain, goMod: "module example.com/mod\n\ngo 1.16\n", flags: "-mod=vendor"},
+		"DefaultBefore1.14":   {root: vendored, goMod: "module example.com/mod\n\ngo 1.13\n"},
+		"DefaultSince1.14":    {root: vendored, goMod: "module example.com/mod\n\ngo 1.14\n", expected: true},
+		"ExplicitVendor":      {root: vendored, goMod: "module example.com/mod\n\ngo 1.13\n", flags: "-mod=vendor", expected: true},
+		"ExplicitModOverride": {root: vendored, goMod: "module example.com/mod\n\ngo 1.16\n", flags: "-trimpath -mod=mod"},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		// Subtests are not run in parallel as the test directories are removed once this test returns.
+		t.Run(n, func(t *testing.T) {
+			testlib.Equal(t, false, tc.expected, sourceVendorMode(tc.root, tc.goMod, tc.flags))
+		})
+	}
+}
+
 func cleanupTestDir(t *testing.T, dir string) {
 	err := filepath.Walk(dir, func(path string, info os.FileInfo, wErr error) error {
 		if wErr != nil {
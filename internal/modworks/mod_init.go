@@ -9,11 +9,11 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/go-git/go-git/v5"
 	"go.uber.org/zap"
 
 	"github.com/modularise/modularise/cmd/config"
 	"github.com/modularise/modularise/internal/filecache"
+	"github.com/modularise/modularise/internal/repohandler"
 )
 
 // CreateSplitModules iterates over the configures splits and initialise a Go module in each split's
@@ -48,6 +48,9 @@ func CreateSplitModules(log *zap.Logger, fc filecache.FileCache, sp *config.Spli
 	if err != nil {
 		return err
 	}
+	if err = r.populateLocalModules(); err != nil {
+		return err
+	}
 
 	for sn := range sp.Splits {
 		if err = r.createSplitModule(sp.Splits[sn], []string{sn}); err != nil {
@@ -58,15 +61,18 @@ func CreateSplitModules(log *zap.Logger, fc filecache.FileCache, sp *config.Spli
 }
 
 type resolver struct {
-	log        *zap.Logger
-	fc         filecache.FileCache
-	sp         *config.Splits
-	mod        string
-	sourceVer  string
-	localProxy string
-	done       map[string]bool
-	todo       map[string]bool
-	transDeps  map[string]map[string]bool
+	log           *zap.Logger
+	fc            filecache.FileCache
+	sp            *config.Splits
+	mod           string
+	sourceVer     string
+	localProxy    string
+	upstreamProxy string
+	vendorMode    bool
+	localMods     map[string]localModule
+	done          map[string]bool
+	todo          map[string]bool
+	transDeps     map[string]map[string]bool
 }
 
 func setupResolver(log *zap.Logger, fc filecache.FileCache, sp *config.Splits) (*resolver, error) {
@@ -80,7 +86,7 @@ func setupResolver(log *zap.Logger, fc filecache.FileCache, sp *config.Splits) (
 		}
 	}
 
-	repo, err := git.PlainOpen(fc.Root())
+	repo, err := repohandler.OpenSource(fc, sp)
 	if err != nil {
 		log.Error("Could not open the source project's git repository.", zap.String("directory", fc.Root()), zap.Error(err))
 		return nil, err
@@ -98,6 +104,16 @@ func setupResolver(log *zap.Logger, fc filecache.FileCache, sp *config.Splits) (
 		return nil, err
 	}
 
+	lms, err := localModules(log, fc, repo, smc)
+	if err != nil {
+		return nil, err
+	}
+
+	vm := sourceVendorMode(fc.Root(), string(smc), os.Getenv("GOFLAGS"))
+	if vm {
+		log.Info("The source module uses vendored dependencies. Dependencies of splits may need to be fetched from the configured GOPROXY.")
+	}
+
 	return &resolver{
 		log:        log,
 		fc:         fc,
@@ -105,6 +121,8 @@ func setupResolver(log *zap.Logger, fc filecache.FileCache, sp *config.Splits) (
 		mod:        string(smc),
 		sourceVer:  h.Hash().String()[:12],
 		localProxy: lpp,
+		vendorMode: vm,
+		localMods:  lms,
 		done:       map[string]bool{},
 		todo:       map[string]bool{},
 		transDeps:  map[string]map[string]bool{},
@@ -166,6 +184,13 @@ func (r *resolver) initSplitModule(s *config.Split) error {
 			}
 
 			var skip bool
+			for mp := range r.localMods {
+				// Local replacements are substituted by temporary ones with absolute paths.
+				if isReplaceOf(l, mp) {
+					skip = true
+					break
+				}
+			}
 			for sn := range r.transDeps[s.Name] {
 				if strings.Contains(strings.SplitAfter(l, "//")[0], r.sp.Splits[sn].ModulePath) {
 					skip = true
@@ -212,6 +237,14 @@ func (r *resolver) initSplitModule(s *config.Split) error {
 			return err
 		}
 	}
+	for _, lm := range r.localMods {
+		r.log.Debug("Adding a temporary 'replace' statement for a local module.", zap.String("module", lm.path), zap.String("directory", lm.dir))
+		_, err = fd.WriteString(fmt.Sprintf("\nreplace %s => %s %s", lm.path, lm.dir, tempReplaceMarker))
+		if err != nil {
+			r.log.Error("Failed to append temporary 'replace' statement to go.mod.", zap.String("file", modFile), zap.Error(err))
+			return err
+		}
+	}
 	_ = fd.Close()
 
 	// Clean up the split's 'go.mod' to remove any unnecessary dependencies copied over from the
@@ -0,0 +1,192 @@
+package modworks
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.uber.org/zap"
+	"golang.org/x/mod/modfile"
+
+	"github.com/modularise/modularise/internal/filecache"
+	"github.com/modularise/modularise/internal/modworks/pseudo"
+)
+
+// A localModule is a Go module whose path lies below the source module's path and to which the
+// source module refers via a 'replace' directive with a filesystem path within the same repository,
+// such as a module nested within the source module. Such replacements can not be used by splits.
+// Instead splits depend on a pseudo-version of the local module that corresponds to the source
+// project's current commit.
+type localModule struct {
+	path    string
+	dir     string
+	version string
+	time    time.Time
+	// Directory of the module relative to the root of the source repository and the commit at which
+	// its content is taken.
+	rel    string
+	commit *object.Commit
+}
+
+// localModules determines the local modules of the source module from the content of its go.mod.
+func localModules(log *zap.Logger, fc filecache.FileCache, repo *git.Repository, goMod []byte) (map[string]localModule, error) {
+	lms := map[string]localModule{}
+	if len(goMod) == 0 {
+		return lms, nil
+	}
+
+	mf, err := modfile.Parse("go.mod", goMod, nil)
+	if err != nil {
+		log.Error("Failed to parse the source go.mod file.", zap.Error(err))
+		return nil, err
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		log.Error("Failed to load the source project's git working tree.", zap.Error(err))
+		return nil, err
+	}
+	h, err := repo.Head()
+	if err != nil {
+		log.Error("Could not determine the source project's HEAD commit.", zap.String("directory", fc.Root()), zap.Error(err))
+		return nil, err
+	}
+	c, err := repo.CommitObject(h.Hash())
+	if err != nil {
+		log.Error("Failed to retrieve HEAD commit info for the source project.", zap.Error(err))
+		return nil, err
+	}
+
+	for _, r := range mf.Replace {
+		if r.New.Version != "" {
+			continue
+		}
+		if !strings.HasPrefix(r.Old.Path, fc.ModulePath()+"/") {
+			log.Debug("Local replacement of a module outside of the source module's path is not a local module.", zap.String("module", r.Old.Path))
+			continue
+		}
+
+		dir := filepath.FromSlash(r.New.Path)
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(fc.Root(), dir)
+		}
+		rel, err := filepath.Rel(wt.Filesystem.Root(), dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			log.Warn("Local replacement outside of the source repository can not be used by splits.", zap.String("module", r.Old.Path), zap.String("directory", dir))
+			continue
+		}
+
+		info, err := pseudo.LocalVersion(log, repo, r.Old.Path, filepath.ToSlash(rel), c)
+		if err != nil {
+			return nil, err
+		}
+		lm := localModule{
+			path:    r.Old.Path,
+			dir:     dir,
+			version: info.Version,
+			time:    info.Time,
+			rel:     filepath.ToSlash(rel),
+			commit:  c,
+		}
+		log.Info("Splits depending on local module will require its pseudo-version for the current commit.", zap.String("module", lm.path), zap.String("version", lm.version))
+		lms[lm.path] = lm
+	}
+	return lms, nil
+}
+
+// populateLocalModules stores the content of the local modules at the source project's HEAD commit
+// in the local proxy. Uncommitted changes are not part of a local module's pseudo-version, hence the
+// committed content is exported to a temporary directory which is used as the module's directory
+// from then on.
+func (r *resolver) populateLocalModules() error {
+	for p, lm := range r.localMods {
+		dir, err := exportLocalModule(r.log, lm)
+		if err != nil {
+			return err
+		}
+		lm.dir = dir
+		r.localMods[p] = lm
+
+		r.log.Debug("Adding local module to local proxy.", zap.String("module", lm.path), zap.String("directory", lm.dir))
+		info := &pseudo.ProxyModuleInfo{Version: lm.version, Time: lm.time}
+		if err = r.writeToLocalProxy(lm.path, info, lm.version, lm.dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportLocalModule writes the content of a local module at its commit to a new temporary directory.
+// Symbolic links are skipped as they are not part of module archives.
+func exportLocalModule(log *zap.Logger, lm localModule) (string, error) {
+	t, err := lm.commit.Tree()
+	if err == nil && lm.rel != "." {
+		t, err = t.Tree(lm.rel)
+	}
+	if err != nil {
+		log.Error("Failed to retrieve the committed content of local module.", zap.String("module", lm.path), zap.String("directory", lm.rel), zap.Error(err))
+		return "", err
+	}
+
+	td, err := ioutil.TempDir("", "modularise-local-module")
+	if err != nil {
+		log.Error("Could not create temporary directory for local module.", zap.Error(err))
+		return "", err
+	}
+	err = t.Files().ForEach(func(f *object.File) error {
+		if f.Mode == filemode.Symlink {
+			return nil
+		}
+		p := filepath.Join(td, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		rc, err := f.Reader()
+		if err != nil {
+			return err
+		}
+		defer func() { _ = rc.Close() }()
+		w, err := os.Create(p)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = w.Close() }()
+		_, err = io.Copy(w, rc)
+		return err
+	})
+	if err != nil {
+		log.Error("Failed to export the committed content of local module.", zap.String("module", lm.path), zap.String("directory", td), zap.Error(err))
+		return "", err
+	}
+	return td, nil
+}
+
+// isReplaceOf determines whether a line of a go.mod file is a 'replace' directive, or an entry of a
+// 'replace' block, for the given module path.
+func isReplaceOf(l string, modPath string) bool {
+	fs := strings.Fields(strings.SplitN(l, "//", 2)[0])
+	if len(fs) > 0 && fs[0] == "replace" {
+		fs = fs[1:]
+	}
+	return len(fs) >= 2 && fs[0] == modPath && (fs[1] == "=>" || (len(fs) >= 3 && fs[2] == "=>"))
+}
+
+// pinRequirement rewrites a line of a go.mod file that requires the given module so that it requires
+// the given version instead. The returned boolean indicates whether the line was rewritten.
+func pinRequirement(l string, modPath string, version string) (string, bool) {
+	t := strings.TrimSpace(l)
+	// We need to filter against the module-path suffixed with a space to deal with nested modules.
+	if strings.HasPrefix(t, modPath+" ") {
+		return fmt.Sprintf("\t%s %s", modPath, version), true
+	} else if strings.HasPrefix(t, "require "+modPath+" ") {
+		return fmt.Sprintf("require %s %s", modPath, version), true
+	}
+	return l, false
+}
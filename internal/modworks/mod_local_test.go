@@ -0,0 +1,105 @@
+package modworks
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/modularise/modularise/internal/testlib"
+	"github.com/modularise/modularise/internal/testrepo"
+)
+
+func TestIsReplaceOf(t *testing.T) {
+	t.Parallel()
+
+	tcs := map[string]struct {
+		line     string
+		expected bool
+	}{
+		"Directive":        {line: "replace example.com/repo/tools => ./tools", expected: true},
+		"VersionedOld":     {line: "replace example.com/repo/tools v1.0.0 => ./tools", expected: true},
+		"BlockEntry":       {line: "\texample.com/repo/tools => ../tools", expected: true},
+		"OtherModule":      {line: "replace example.com/repo/tools/v2 => ./tools", expected: false},
+		"Requirement":      {line: "\texample.com/repo/tools v0.1.0", expected: false},
+		"Comment":          {line: "// replace example.com/repo/tools => ./tools", expected: false},
+		"TrailingComment":  {line: "replace example.com/repo/tools => ./tools // local", expected: true},
+		"ReplaceBlockHead": {line: "replace (", expected: false},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			testlib.Equal(t, false, tc.expected, isReplaceOf(tc.line, "example.com/repo/tools"))
+		})
+	}
+}
+
+func TestPinRequirement(t *testing.T) {
+	t.Parallel()
+
+	tcs := map[string]struct {
+		line     string
+		expected string
+		pinned   bool
+	}{
+		"BlockEntry":  {line: "\texample.com/repo/tools v0.0.0-00010101000000-000000000000", expected: "\texample.com/repo/tools v1.2.3", pinned: true},
+		"Indirect":    {line: "\texample.com/repo/tools v0.1.0 // indirect", expected: "\texample.com/repo/tools v1.2.3", pinned: true},
+		"Directive":   {line: "require example.com/repo/tools v0.1.0", expected: "require example.com/repo/tools v1.2.3", pinned: true},
+		"OtherModule": {line: "\texample.com/repo/tools/v2 v2.0.0", expected: "\texample.com/repo/tools/v2 v2.0.0"},
+		"Unrelated":   {line: "go 1.13", expected: "go 1.13"},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			l, pinned := pinRequirement(tc.line, "example.com/repo/tools", "v1.2.3")
+			testlib.Equal(t, false, tc.expected, l)
+			testlib.Equal(t, false, tc.pinned, pinned)
+		})
+	}
+}
+
+func TestExportLocalModule(t *testing.T) {
+	t.Parallel()
+
+	file := func(p string) testrepo.RepoAction {
+		return testrepo.AddFile(testrepo.RepoFile{Path: p, Content: []byte(p)})
+	}
+	tr := testrepo.CreateTestRepo(t, []testrepo.RepoAction{
+		file("go.mod"),
+		file("tools/go.mod"),
+		file("tools/tool.go"),
+		file("tools/sub/sub.go"),
+		testrepo.Commit("Initial commit"),
+		file("tools/uncommitted.go"),
+	})
+
+	dir, err := exportLocalModule(testlib.NewTestLogger(), localModule{path: "example.com/repo/tools", rel: "tools", commit: tr.Head()})
+	testlib.NoError(t, true, err)
+	defer func() { testlib.NoError(t, false, os.RemoveAll(dir)) }()
+
+	found := map[string]string{}
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, wErr error) error {
+		if wErr != nil || info.IsDir() {
+			return wErr
+		}
+		c, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		found[filepath.ToSlash(rel)] = string(c)
+		return err
+	})
+	testlib.NoError(t, true, err)
+	testlib.Equal(t, false, map[string]string{
+		"go.mod":     "tools/go.mod",
+		"tool.go":    "tools/tool.go",
+		"sub/sub.go": "tools/sub/sub.go",
+	}, found)
+}
@@ -23,15 +23,21 @@ func (r *resolver) populateLocalProxy(s *config.Split) error {
 	}
 	s.Version = info.Version
 
+	return r.writeToLocalProxy(s.ModulePath, info, info.Hash, s.WorkDir)
+}
+
+// writeToLocalProxy stores the module with the given path and the content of the given directory in
+// the local proxy. The .info file is named after infoName to allow for hash redirections.
+func (r *resolver) writeToLocalProxy(modPath string, info *pseudo.ProxyModuleInfo, infoName string, dir string) error {
 	var moduleCachePath string
-	for _, r := range s.ModulePath {
+	for _, r := range modPath {
 		if unicode.IsUpper(r) {
 			moduleCachePath += "!"
 		}
 		moduleCachePath += string(unicode.ToLower(r))
 	}
 	proxyPath := filepath.Join(r.localProxy, filepath.FromSlash(moduleCachePath), "@v")
-	if err = os.MkdirAll(proxyPath, 0755); err != nil {
+	if err := os.MkdirAll(proxyPath, 0755); err != nil {
 		r.log.Error("Failed to create local proxy storage directory.", zap.String("directory", proxyPath), zap.Error(err))
 		return err
 	}
@@ -39,17 +45,17 @@ func (r *resolver) populateLocalProxy(s *config.Split) error {
 	// Info file for hash redirection.
 	ji, err := json.Marshal(&info)
 	if err != nil {
-		r.log.Error("Failed to marshal .info file.", zap.String("split", s.Name), zap.Any("content", info), zap.Error(err))
+		r.log.Error("Failed to marshal .info file.", zap.String("module", modPath), zap.Any("content", info), zap.Error(err))
 		return err
 	}
-	p := filepath.Join(proxyPath, fmt.Sprintf("%s.info", info.Hash))
+	p := filepath.Join(proxyPath, fmt.Sprintf("%s.info", infoName))
 	if err = ioutil.WriteFile(p, ji, 0644); err != nil {
 		r.log.Error("Failed to write .info file.", zap.String("path", p), zap.Error(err))
 		return err
 	}
 
 	// Mod files and zip archives.
-	mp := filepath.Join(s.WorkDir, "go.mod")
+	mp := filepath.Join(dir, "go.mod")
 	mc, err := ioutil.ReadFile(mp)
 	if err != nil {
 		r.log.Error("Failed to read file.", zap.String("file", mp), zap.Error(err))
@@ -59,7 +65,7 @@ func (r *resolver) populateLocalProxy(s *config.Split) error {
 	if err = ioutil.WriteFile(p, mc, 0644); err != nil {
 		r.log.Error(
 			"Failed to write mod file to temporary module proxy.",
-			zap.String("module", s.ModulePath),
+			zap.String("module", modPath),
 			zap.String("version", info.Version),
 			zap.Error(err),
 		)
@@ -74,10 +80,10 @@ func (r *resolver) populateLocalProxy(s *config.Split) error {
 	}
 	defer func() { _ = zf.Close() }()
 
-	if err = zip.CreateFromDir(zf, module.Version{Path: s.ModulePath, Version: info.Version}, s.WorkDir); err != nil {
+	if err = zip.CreateFromDir(zf, module.Version{Path: modPath, Version: info.Version}, dir); err != nil {
 		r.log.Error(
-			"Failed to zip content of split into cache archive.",
-			zap.String("directory", s.WorkDir),
+			"Failed to zip content of module into cache archive.",
+			zap.String("directory", dir),
 			zap.String("archive", p),
 			zap.Error(err),
 		)
@@ -2,15 +2,16 @@ package pseudo
 
 import (
 	"fmt"
-	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"go.uber.org/zap"
+	"golang.org/x/mod/module"
 	"golang.org/x/mod/semver"
 
 	"github.com/modularise/modularise/cmd/config"
@@ -33,30 +34,46 @@ func Version(l *zap.Logger, s *config.Split) (*ProxyModuleInfo, error) {
 			return nil, fmt.Errorf("split %q in %q has no initialised repository", s.Name, s.WorkDir)
 		}
 	}
-	return versioner{log: l.With(zap.String("split", s.Name), zap.String("directory", s.WorkDir)), s: s}.pseudoVersion()
-}
-
-type versioner struct {
-	log *zap.Logger
-	s   *config.Split
-}
+	v := versioner{log: l.With(zap.String("split", s.Name), zap.String("directory", s.WorkDir)), repo: s.Repo, modulePath: s.ModulePath}
 
-func (v versioner) pseudoVersion() (*ProxyModuleInfo, error) {
-	href, err := v.s.Repo.Head()
+	href, err := v.repo.Head()
 	if err != nil {
 		v.log.Error("Failed to load the current HEAD in git repository.", zap.Error(err))
 		return nil, err
 	}
 
-	head, err := v.s.Repo.CommitObject(href.Hash())
+	head, err := v.repo.CommitObject(href.Hash())
 	if err != nil {
 		v.log.Error("Failed to retrieve HEAD commit info for git repository.", zap.Error(err))
 		return nil, err
 	}
+	return v.pseudoVersion(head)
+}
+
+// LocalVersion computes the pseudo-version at the given commit of a module that resides in the
+// specified directory, relative to the repository's root. As is the convention for modules that are
+// not located at the root of their repository, only tags prefixed with the module's directory are
+// considered to be releases of the module.
+func LocalVersion(l *zap.Logger, repo *git.Repository, modPath string, dir string, c *object.Commit) (*ProxyModuleInfo, error) {
+	v := versioner{log: l.With(zap.String("module", modPath)), repo: repo, modulePath: modPath}
+	if dir != "." && dir != "" {
+		v.tagPrefix = dir + "/"
+	}
+	return v.pseudoVersion(c)
+}
 
+type versioner struct {
+	log        *zap.Logger
+	repo       *git.Repository
+	modulePath string
+	// Prefix of the tags that correspond to releases of the module.
+	tagPrefix string
+}
+
+func (v versioner) pseudoVersion(head *object.Commit) (*ProxyModuleInfo, error) {
 	major := "v0"
-	if m := regexp.MustCompile(`^.*?(?:/(v[1-9][0-9]*))?$`).FindStringSubmatch(v.s.ModulePath); m[1] != "" {
-		major = m[1]
+	if _, pm, ok := module.SplitPathVersion(v.modulePath); ok && pm != "" {
+		major = strings.TrimLeft(pm, "/.")
 	}
 
 	baseVersion, err := v.baseVersionForCommit(major, head)
@@ -64,12 +81,12 @@ func (v versioner) pseudoVersion() (*ProxyModuleInfo, error) {
 		return nil, err
 	}
 
-	version := fmt.Sprintf("%s-%s-%s", baseVersion, head.Committer.When.UTC().Format("20060102150405"), href.Hash().String()[:12])
+	version := fmt.Sprintf("%s-%s-%s", baseVersion, head.Committer.When.UTC().Format("20060102150405"), head.Hash.String()[:12])
 	v.log.Debug("Determined pseudo-version.", zap.String("pseudo-version", version))
 	return &ProxyModuleInfo{
 		Version: version,
 		Time:    head.Committer.When,
-		Hash:    href.Hash().String(),
+		Hash:    head.Hash.String(),
 	}, nil
 }
 
@@ -80,16 +97,16 @@ func (v versioner) baseVersionForCommit(major string, c *object.Commit) (string,
 	}
 
 	for _, tag := range tags {
-		n := tag.Name().Short()
+		n := v.tagVersion(tag)
 
 		// Resolve tag.
 		var tc *object.Commit
-		to, err := v.s.Repo.TagObject(tag.Hash())
+		to, err := v.repo.TagObject(tag.Hash())
 		switch err {
 		case nil:
 			tc, err = to.Commit()
 		case plumbing.ErrObjectNotFound:
-			tc, err = v.s.Repo.CommitObject(tag.Hash())
+			tc, err = v.repo.CommitObject(tag.Hash())
 		default:
 			v.log.Error("Could not retrieve tag object.", zap.String("tag", n), zap.Error(err))
 			return "", err
@@ -126,7 +143,7 @@ func (v versioner) baseVersionForCommit(major string, c *object.Commit) (string,
 }
 
 func (v versioner) tagsForMajor(major string) ([]*plumbing.Reference, error) {
-	ti, err := v.s.Repo.Tags()
+	ti, err := v.repo.Tags()
 	if err != nil {
 		v.log.Error("Failed to retrieve iterator over tags.", zap.Error(err))
 		return nil, err
@@ -135,6 +152,11 @@ func (v versioner) tagsForMajor(major string) ([]*plumbing.Reference, error) {
 	var tags []*plumbing.Reference
 	err = ti.ForEach(func(tag *plumbing.Reference) error {
 		n := tag.Name().Short()
+		if !strings.HasPrefix(n, v.tagPrefix) {
+			v.log.Debug("Not selecting tag - it does not belong to the module.", zap.String("tag", n))
+			return nil
+		}
+		n = strings.TrimPrefix(n, v.tagPrefix)
 		if !semver.IsValid(n) {
 			v.log.Debug("Not selecting tag - it is not valid semver.", zap.String("tag", n))
 			return nil
@@ -159,6 +181,11 @@ func (v versioner) tagsForMajor(major string) ([]*plumbing.Reference, error) {
 		return nil, err
 	}
 
-	sort.Slice(tags, func(i int, j int) bool { return semver.Compare(tags[i].Name().Short(), tags[j].Name().Short()) > 0 })
+	sort.Slice(tags, func(i int, j int) bool { return semver.Compare(v.tagVersion(tags[i]), v.tagVersion(tags[j])) > 0 })
 	return tags, nil
 }
+
+// tagVersion returns the version designated by a tag of the module.
+func (v versioner) tagVersion(tag *plumbing.Reference) string {
+	return strings.TrimPrefix(tag.Name().Short(), v.tagPrefix)
+}
@@ -97,6 +97,48 @@ func TestPseudoVersion(t *testing.T) {
 	}
 }
 
+func TestLocalVersion(t *testing.T) {
+	t.Parallel()
+
+	actions := []testrepo.RepoAction{
+		testrepo.AddFile(testrepo.RepoFile{Path: "main.go", Content: []byte("foo")}),
+		testrepo.Commit("First commit"),
+		testrepo.LightTag("v1.3.0"),
+		testrepo.LightTag("tools/v0.2.0"),
+		testrepo.LightTag("tools/v2.0.0"),
+		testrepo.LightTag("legacy/v3.1.0"),
+		testrepo.AddFile(testrepo.RepoFile{Path: "tools/lib.go", Content: []byte("bar")}),
+		testrepo.Commit("Second commit"),
+	}
+
+	tcs := map[string]struct {
+		module string
+		dir    string
+		prefix string
+	}{
+		"Root":         {module: "example.com/repo", dir: ".", prefix: "v1.3.1"},
+		"Nested":       {module: "example.com/repo/tools", dir: "tools", prefix: "v0.2.1"},
+		"NestedMajor":  {module: "example.com/repo/tools/v2", dir: "tools", prefix: "v2.0.1"},
+		"Untagged":     {module: "example.com/repo/other", dir: "other", prefix: "v0.0.0"},
+		"Incompatible": {module: "example.com/repo/legacy", dir: "legacy", prefix: "v0.0.0"},
+		"GopkgIn":      {module: "gopkg.in/legacy.v3", dir: "legacy", prefix: "v3.1.1"},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			repo := testrepo.CreateTestRepo(t, actions)
+			info, err := LocalVersion(testlib.NewTestLogger(), repo.Repository(), tc.module, tc.dir, repo.Head())
+			testlib.NoError(t, true, err)
+
+			ev := fmt.Sprintf("%s-%s-%s", tc.prefix, repo.Head().Committer.When.UTC().Format("20060102150405"), repo.Head().Hash.String()[:12])
+			testlib.Equal(t, false, ev, info.Version)
+		})
+	}
+}
+
 func TestBaseVersionForCommit(t *testing.T) {
 	t.Parallel()
 
@@ -187,15 +229,7 @@ func TestBaseVersionForCommit(t *testing.T) {
 
 			repo := testrepo.CreateTestRepo(t, tc.actions)
 
-			bv, err := versioner{
-				log: testlib.NewTestLogger(),
-				s: &config.Split{
-					DataSplit: splits.DataSplit{
-						WorkDir: repo.Path(),
-						Repo:    repo.Repository(),
-					},
-				},
-			}.baseVersionForCommit(tc.major, repo.Head())
+			bv, err := versioner{log: testlib.NewTestLogger(), repo: repo.Repository()}.baseVersionForCommit(tc.major, repo.Head())
 			testlib.NoError(t, true, err)
 			testlib.Equal(t, false, tc.baseVersion, bv)
 		})
@@ -293,15 +327,7 @@ func TestTagsForMajor(t *testing.T) {
 
 			repo := testrepo.CreateTestRepo(t, tc.actions)
 
-			tags, err := versioner{
-				log: testlib.NewTestLogger(),
-				s: &config.Split{
-					DataSplit: splits.DataSplit{
-						WorkDir: repo.Path(),
-						Repo:    repo.Repository(),
-					},
-				},
-			}.tagsForMajor(tc.major)
+			tags, err := versioner{log: testlib.NewTestLogger(), repo: repo.Repository()}.tagsForMajor(tc.major)
 			testlib.NoError(t, true, err)
 
 			testlib.True(t, true, len(tc.tags) == len(tags))
@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -37,33 +38,81 @@ func Parse(l *zap.Logger, fc filecache.FileCache, sp *config.Splits) error {
 func parseFiles(l *zap.Logger, fc filecache.FileCache, sp *config.Splits) error {
 	sp.NonModuleSource = !fc.Files()["go.mod"]
 
-	var mapping prefixMappings
+	mapping := prefixMappings{}
+	conflicts := map[string][]string{}
+	var patterns []patternRule
 	for n, s := range sp.Splits {
 		s.Files = map[string]bool{}
 
 		for j := range s.Includes {
-			mapping = append(mapping, prefixMapping{
-				prefix: filepath.Clean(s.Includes[j]) + string(os.PathSeparator),
-				split:  n,
-			})
+			if isPattern(s.Includes[j]) {
+				r, err := newPatternRule(s.Includes[j], n)
+				if err != nil {
+					l.Error("Invalid include pattern for split.", zap.String("split", n), zap.Error(err))
+					return err
+				}
+				patterns = append(patterns, r)
+				continue
+			}
+			pm := prefixMapping{prefix: filepath.Clean(s.Includes[j]) + string(os.PathSeparator), split: n}
+			if !mapping.add(pm) {
+				conflicts[pm.prefix] = append(conflicts[pm.prefix], n)
+			}
 		}
 		for j := range s.Excludes {
-			mapping = append(mapping, prefixMapping{
-				prefix: filepath.Clean(s.Excludes[j]),
-			})
+			if isPattern(s.Excludes[j]) {
+				r, err := newPatternRule(strings.TrimPrefix(s.Excludes[j], negationPrefix), "")
+				if err != nil {
+					l.Error("Invalid exclude pattern for split.", zap.String("split", n), zap.Error(err))
+					return err
+				}
+				patterns = append(patterns, r)
+				continue
+			}
+			pm := prefixMapping{prefix: filepath.Clean(s.Excludes[j]) + string(os.PathSeparator)}
+			if !mapping.add(pm) {
+				conflicts[pm.prefix] = append(conflicts[pm.prefix], "<excluded>")
+			}
 		}
 	}
-	sort.Sort(mapping)
+	if len(conflicts) > 0 {
+		var prefixes []string
+		for p := range conflicts {
+			prefixes = append(prefixes, p)
+		}
+		sort.Strings(prefixes)
+		l.Error("Some paths are both included and excluded, or included by several splits:")
+		for _, p := range prefixes {
+			l.Error(fmt.Sprintf(" - %s: %s", p, strings.Join(append(conflicts[p], outcome(mapping[p].split)), ", ")))
+		}
+		return errors.New("ambiguous split configuration")
+	}
 
+	reportNestedModules(l, fc, sp)
+
+	m := matcher{prefixes: mapping, patterns: patterns, ambiguous: map[string][]string{}}
 	var nonMatched []string
 	for f := range fc.Files() {
-		if s := mapping.matchedSplit(filepath.Dir(f) + string(os.PathSeparator)); s != "" {
+		if s := m.matchedSplit(filepath.Dir(f)); s != "" {
 			sp.Splits[s].Files[f] = true
 		} else {
 			nonMatched = append(nonMatched, f)
 		}
 	}
 
+	if len(m.ambiguous) > 0 {
+		var dirs []string
+		for d := range m.ambiguous {
+			dirs = append(dirs, d)
+		}
+		sort.Strings(dirs)
+		l.Error("Some directories are matched with equal precedence by the includes or excludes of different splits:")
+		for _, d := range dirs {
+			l.Error(fmt.Sprintf(" - %s: %s", d, strings.Join(m.ambiguous[d], ", ")))
+		}
+		return errors.New("ambiguous split configuration")
+	}
+
 	// This computation and logging sequence might be expensive for large projects hence we guard
 	// this with an explicit logger-level check.
 	if l.Core().Enabled(zapcore.DebugLevel) {
@@ -71,6 +120,10 @@ func parseFiles(l *zap.Logger, fc filecache.FileCache, sp *config.Splits) error
 		for _, m := range mapping {
 			matchDebug = append(matchDebug, fmt.Sprintf("%s => %s", m.prefix, m.split))
 		}
+		sort.Strings(matchDebug)
+		for _, p := range patterns {
+			matchDebug = append(matchDebug, fmt.Sprintf("%s => %s", p.entry, p.split))
+		}
 		l.Debug("Split path matches.", zap.Strings("mapping", matchDebug))
 		sort.Strings(nonMatched)
 		l.Debug("Non-matched files.", zap.Strings("files", nonMatched))
@@ -81,54 +134,120 @@ func parseFiles(l *zap.Logger, fc filecache.FileCache, sp *config.Splits) error
 	return nil
 }
 
-func prefixLessThan(rhs, lhs string) int {
-	if strings.HasPrefix(rhs, lhs) || strings.HasPrefix(lhs, rhs) {
-		if len(rhs) > len(lhs) {
-			return -1
-		} else if len(rhs) < len(lhs) {
-			return 1
+// reportNestedModules warns about includes that point into a nested module of the source module.
+// Such includes will not match any files as the content of nested modules is not part of the source
+// module.
+func reportNestedModules(l *zap.Logger, fc filecache.FileCache, sp *config.Splits) {
+	for mp, d := range fc.NestedModules() {
+		for n, s := range sp.Splits {
+			for _, i := range s.Includes {
+				if isPattern(i) {
+					continue
+				}
+				if i = filepath.Clean(i); i == d || strings.HasPrefix(i, d+string(os.PathSeparator)) {
+					l.Warn(
+						"Split includes content of a nested module. Nested modules can only be split from a configuration located within them.",
+						zap.String("split", n),
+						zap.String("include", i),
+						zap.String("module", mp),
+					)
+				}
+			}
 		}
-		return 0
 	}
-	return strings.Compare(rhs, lhs)
 }
 
-// We use this custom prefixMapping datastructure to infer the appropriate mapping from a given
+// matcher combines prefixMappings and patternRules to determine the split to which a directory
+// belongs. The most specific of all matching prefixes and patterns applies. Directories for which
+// several rules with different outcomes share the highest specificity are recorded as ambiguous.
+type matcher struct {
+	prefixes  prefixMappings
+	patterns  []patternRule
+	ambiguous map[string][]string
+}
+
+func (m *matcher) matchedSplit(dir string) string {
+	best, found := -1, map[string]bool{}
+	consider := func(split string, specificity int) {
+		if specificity > best {
+			best = specificity
+			found = map[string]bool{}
+		}
+		if specificity == best {
+			found[split] = true
+		}
+	}
+
+	if pm, ok := m.prefixes.matchedPrefix(dir + string(os.PathSeparator)); ok {
+		consider(pm.split, len(strings.TrimSuffix(pm.prefix, string(os.PathSeparator))))
+	}
+	for _, p := range m.patterns {
+		if !p.negated && p.match(dir) {
+			consider(p.split, p.specificity)
+		}
+	}
+
+	if len(found) > 1 {
+		var outcomes []string
+		for s := range found {
+			outcomes = append(outcomes, outcome(s))
+		}
+		sort.Strings(outcomes)
+		m.ambiguous[dir] = outcomes
+		return ""
+	}
+
+	var split string
+	for s := range found {
+		split = s
+	}
+	for _, p := range m.patterns {
+		if p.negated && p.split == split && p.match(dir) {
+			return ""
+		}
+	}
+	return split
+}
+
+func outcome(split string) string {
+	if split == "" {
+		return "<excluded>"
+	}
+	return split
+}
+
+// We use this custom prefixMappings datastructure to infer the appropriate mapping from a given
 // filepath to the corresponding split, if such a split exists. The algorithm that is used is:
 //  - For each 'include' create a prefixMapping to the including split's name.
 //  - For each 'exclude' create a prefixMapping to an empty string.
-//  - Sort the obtained slice of prefixMapping structs in alphabetical order, in the case of one
-//    string being a prefix of another, the longer string is sorted first.
-//  - In order to match a filepath to a split compute the theoretical index in the list where the
-//    filepath would be inserted. The current prefixMapping at that index indicates the split to
+//  - Index the prefixMapping structs by their prefix, each of which ends with a path separator.
+//  - In order to match a filepath to a split look up each of the filepath's parent directories,
+//    starting with the deepest one. The first prefixMapping that is found indicates the split to
 //    which the filepath should be mapped. If the prefixMapping indicates an empty string the
-//    filepath does not belong to any string.
+//    filepath does not belong to any split.
 type prefixMapping struct {
 	prefix string
 	split  string
 }
 
-type prefixMappings []prefixMapping
+type prefixMappings map[string]prefixMapping
 
-func (m prefixMappings) matchedSplit(p string) string {
-	l, t, h := 0, 0, len(m)
-	for l != h && l < len(m) {
-		t = (l + h) / 2
-		switch prefixLessThan(p, m[t].prefix) {
-		case -1:
-			h = t
-		case 0:
-			return m[t].split
-		case 1:
-			l = t + 1
-		}
+// add registers a prefixMapping. It returns false if the prefix is already mapped to a different
+// outcome.
+func (m prefixMappings) add(pm prefixMapping) bool {
+	if e, ok := m[pm.prefix]; ok && e.split != pm.split {
+		return false
 	}
-	if h < len(m) && strings.HasPrefix(p, m[h].prefix) {
-		return m[h].split
-	}
-	return ""
+	m[pm.prefix] = pm
+	return true
 }
 
-func (m prefixMappings) Len() int           { return len(m) }
-func (m prefixMappings) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
-func (m prefixMappings) Less(i, j int) bool { return prefixLessThan(m[i].prefix, m[j].prefix) < 0 }
+func (m prefixMappings) matchedPrefix(p string) (prefixMapping, bool) {
+	for p != "" {
+		if pm, ok := m[p]; ok {
+			return pm, true
+		}
+		p = p[:strings.LastIndex(strings.TrimSuffix(p, string(os.PathSeparator)), string(os.PathSeparator))+1]
+	}
+	return prefixMapping{}, false
+}
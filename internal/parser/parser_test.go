@@ -50,6 +50,20 @@ func TestUnit_ParseUnit(t *testing.T) {
 				"one": {"one/nested/one.go": true},
 			},
 		},
+		"OneSplitWithNestedModule": {
+			files: map[string]testcache.FakeFileCacheEntry{
+				"go.mod":               goMod,
+				"one/one.go":           {},
+				"one/nested/go.mod":    {Data: []byte("module example.com/mod/one/nested")},
+				"one/nested/nested.go": {},
+			},
+			splits: config.Splits{Splits: map[string]*config.Split{
+				"one": {Includes: []string{"one"}},
+			}},
+			expected: map[string]map[string]bool{
+				"one": {"one/one.go": true},
+			},
+		},
 		"OneSplitOneIdenticallyNamedFile": {
 			files: map[string]testcache.FakeFileCacheEntry{
 				"go.mod": goMod,
@@ -132,6 +146,72 @@ func TestUnit_ParseUnit(t *testing.T) {
 				"two": {"onetwo/lib/two.go": true},
 			},
 		},
+		"GlobInclude": {
+			files: map[string]testcache.FakeFileCacheEntry{
+				"go.mod":                   goMod,
+				"pkg/a/client/client.go":   {},
+				"pkg/b/c/client/client.go": {},
+				"pkg/b/server/server.go":   {},
+			},
+			splits: config.Splits{Splits: map[string]*config.Split{
+				"clients": {Includes: []string{"pkg/**/client"}},
+			}},
+			expected: map[string]map[string]bool{
+				"clients": {
+					"pkg/a/client/client.go":   true,
+					"pkg/b/c/client/client.go": true,
+				},
+			},
+		},
+		"GlobNegation": {
+			files: map[string]testcache.FakeFileCacheEntry{
+				"go.mod":                         goMod,
+				"api/api.go":                     {},
+				"api/v1/v1.go":                   {},
+				"api/v1/testdata/fixture.go":     {},
+				"api/testdata/nested/fixture.go": {},
+			},
+			splits: config.Splits{Splits: map[string]*config.Split{
+				"api": {Includes: []string{"api", "!**/testdata/**"}},
+			}},
+			expected: map[string]map[string]bool{
+				"api": {
+					"api/api.go":   true,
+					"api/v1/v1.go": true,
+				},
+			},
+		},
+		"GlobExcludeAndPrefixPrecedence": {
+			files: map[string]testcache.FakeFileCacheEntry{
+				"go.mod":               goMod,
+				"one/one.go":           {},
+				"one/gen/gen.go":       {},
+				"one/two/two.go":       {},
+				"one/two/gen/gen.go":   {},
+				"one/three/three.go":   {},
+				"one/three/api/api.go": {},
+			},
+			splits: config.Splits{Splits: map[string]*config.Split{
+				"one": {
+					Includes: []string{"one"},
+					Excludes: []string{"one/*/gen"},
+				},
+				"two":  {Includes: []string{"one/two"}},
+				"apis": {Includes: []string{"regexp:one/[a-z]+/api"}},
+			}},
+			expected: map[string]map[string]bool{
+				"one": {
+					"one/one.go":         true,
+					"one/gen/gen.go":     true,
+					"one/three/three.go": true,
+				},
+				"two": {
+					"one/two/two.go":     true,
+					"one/two/gen/gen.go": true,
+				},
+				"apis": {"one/three/api/api.go": true},
+			},
+		},
 	}
 
 	for n := range tcs {
@@ -152,3 +232,74 @@ func TestUnit_ParseUnit(t *testing.T) {
 		})
 	}
 }
+
+func TestUnit_ParseAmbiguous(t *testing.T) {
+	t.Parallel()
+
+	tcs := map[string]map[string]*config.Split{
+		"EqualSpecificityPatterns": {
+			"one": {Includes: []string{"one/*"}},
+			"two": {Includes: []string{"one/[a-z]*"}},
+		},
+		"PatternAndPrefix": {
+			"one": {Includes: []string{"one/api"}},
+			"two": {Includes: []string{"regexp:one/api"}},
+		},
+		"IncludedAndExcluded": {
+			"one": {Includes: []string{"one"}, Excludes: []string{"one/api"}},
+			"two": {Includes: []string{"one/api/"}},
+		},
+	}
+
+	for n := range tcs {
+		splits := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			fc, err := testcache.NewFakeFileCache("fake-cache-dir", map[string]testcache.FakeFileCacheEntry{
+				"go.mod":         {Data: []byte("module example.com/mod")},
+				"one/api/api.go": {},
+			})
+			testlib.NoError(t, true, err)
+
+			err = Parse(testlib.NewTestLogger(), fc, &config.Splits{Splits: splits})
+			testlib.Error(t, false, err)
+		})
+	}
+}
+
+func TestUnit_GlobToRegexp(t *testing.T) {
+	t.Parallel()
+
+	tcs := map[string]struct {
+		glob     string
+		matches  []string
+		excludes []string
+	}{
+		"Literal":            {glob: "pkg/api", matches: []string{"pkg/api"}, excludes: []string{"pkg/api/v1", "pkg"}},
+		"Star":               {glob: "pkg/*", matches: []string{"pkg/api"}, excludes: []string{"pkg/api/v1", "pkg"}},
+		"LeadingDoubleStar":  {glob: "**/api", matches: []string{"api", "pkg/api", "a/b/api"}, excludes: []string{"pkg/api/v1"}},
+		"InnerDoubleStar":    {glob: "pkg/**/api", matches: []string{"pkg/api", "pkg/a/b/api"}, excludes: []string{"api"}},
+		"TrailingDoubleStar": {glob: "pkg/**", matches: []string{"pkg", "pkg/a", "pkg/a/b"}, excludes: []string{"pkgs"}},
+		"QuestionMark":       {glob: "v?", matches: []string{"v1", "v2"}, excludes: []string{"v10", "v/"}},
+		"CharClass":          {glob: "v[12]", matches: []string{"v1", "v2"}, excludes: []string{"v3"}},
+		"NegatedCharClass":   {glob: "v[!12]", matches: []string{"v3"}, excludes: []string{"v1"}},
+		"QuotedMeta":         {glob: "a.b", matches: []string{"a.b"}, excludes: []string{"axb"}},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			r, err := newPatternRule(tc.glob, "split")
+			testlib.NoError(t, true, err)
+			for _, m := range tc.matches {
+				testlib.True(t, false, r.match(m))
+			}
+			for _, e := range tc.excludes {
+				testlib.False(t, false, r.match(e))
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/modularise/modularise/internal/glob"
+)
+
+const (
+	negationPrefix = "!"
+	regexpPrefix   = "regexp:"
+)
+
+// isPattern determines whether an entry of a split's Includes or Excludes should be interpreted as a
+// pattern instead of as a plain path prefix.
+func isPattern(entry string) bool {
+	return strings.HasPrefix(entry, negationPrefix) || strings.HasPrefix(entry, regexpPrefix) || glob.IsGlob(entry)
+}
+
+// A patternRule maps the directories matched by a glob or regular expression to a split. Unlike
+// prefixMapping a pattern only matches the directories that correspond to it exactly, subdirectories
+// need to be matched explicitly, e.g. via a trailing '/**' in a glob.
+//
+// Competing rules are resolved by their specificity, which is the length of the literal prefix of
+// the pattern. This allows them to be compared with the length of the prefixes of prefixMapping
+// entries so that the longest-prefix precedence is preserved. Negated rules only apply to the
+// directories that would otherwise be mapped to their split and take precedence over any other rule
+// of the split.
+type patternRule struct {
+	entry       string
+	split       string
+	negated     bool
+	re          *regexp.Regexp
+	specificity int
+}
+
+func newPatternRule(entry string, split string) (patternRule, error) {
+	r := patternRule{entry: entry, split: split}
+
+	p := entry
+	if strings.HasPrefix(p, negationPrefix) {
+		r.negated = true
+		p = strings.TrimPrefix(p, negationPrefix)
+	}
+
+	var expr string
+	if strings.HasPrefix(p, regexpPrefix) {
+		expr = strings.TrimPrefix(p, regexpPrefix)
+	} else {
+		expr = glob.ToRegexp(strings.Trim(p, "/"))
+	}
+
+	// The literal prefix can only be determined on the unanchored expression.
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return patternRule{}, fmt.Errorf("invalid pattern %q: %v", entry, err)
+	}
+	lp, _ := re.LiteralPrefix()
+	r.specificity = len(lp)
+	r.re = regexp.MustCompile("^(?:" + expr + ")$")
+	return r, nil
+}
+
+// match reports whether the pattern matches the given directory. The directory should be relative to
+// the module's root and should not contain a trailing separator.
+func (r patternRule) match(dir string) bool {
+	return r.re.MatchString(dir)
+}
@@ -0,0 +1,112 @@
+package platforms
+
+import (
+	"bytes"
+	"go/build"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"github.com/modularise/modularise/cmd/config"
+	"github.com/modularise/modularise/internal/filecache"
+)
+
+// DefaultTargets are the build targets that are used if none are configured.
+var DefaultTargets = []config.BuildTarget{
+	{GOOS: "linux", GOARCH: "amd64"},
+	{GOOS: "linux", GOARCH: "arm64"},
+	{GOOS: "darwin", GOARCH: "amd64"},
+	{GOOS: "darwin", GOARCH: "arm64"},
+	{GOOS: "windows", GOARCH: "amd64"},
+}
+
+// A Matcher evaluates the build constraints of the files in a FileCache for a set of build targets.
+// This covers both build constraint comments and GOOS / GOARCH file name suffixes. Results are
+// cached so that a Matcher can be shared between analyses.
+type Matcher struct {
+	fc      filecache.FileCache
+	targets []config.BuildTarget
+	ctxts   []build.Context
+
+	lock  sync.Mutex
+	cache map[string][]bool
+}
+
+// NewMatcher returns a Matcher for the given build targets, or for the DefaultTargets if none are
+// specified.
+func NewMatcher(fc filecache.FileCache, targets []config.BuildTarget) *Matcher {
+	if len(targets) == 0 {
+		targets = DefaultTargets
+	}
+
+	m := &Matcher{fc: fc, targets: targets, cache: map[string][]bool{}}
+	for _, t := range targets {
+		ctxt := build.Default
+		ctxt.GOOS = t.GOOS
+		ctxt.GOARCH = t.GOARCH
+		ctxt.BuildTags = t.Tags
+		ctxt.CgoEnabled = t.Cgo == nil || *t.Cgo
+		ctxt.OpenFile = func(path string) (io.ReadCloser, error) {
+			b, err := fc.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.NopCloser(bytes.NewReader(b)), nil
+		}
+		m.ctxts = append(m.ctxts, ctxt)
+	}
+	return m
+}
+
+// Targets returns the build targets of the Matcher.
+func (m *Matcher) Targets() []config.BuildTarget {
+	return m.targets
+}
+
+// Match determines whether the file with the given path, relative to the FileCache's root, is
+// included in the build for any of the Matcher's targets.
+func (m *Matcher) Match(path string) (bool, error) {
+	ms, err := m.matches(path)
+	if err != nil {
+		return false, err
+	}
+	for _, ok := range ms {
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// MatchTarget determines whether the file with the given path, relative to the FileCache's root, is
+// included in the build for the i-th of the Matcher's targets.
+func (m *Matcher) MatchTarget(path string, i int) (bool, error) {
+	ms, err := m.matches(path)
+	if err != nil {
+		return false, err
+	}
+	return ms[i], nil
+}
+
+func (m *Matcher) matches(path string) ([]bool, error) {
+	m.lock.Lock()
+	ms, ok := m.cache[path]
+	m.lock.Unlock()
+	if ok {
+		return ms, nil
+	}
+
+	ms = make([]bool, len(m.ctxts))
+	for i := range m.ctxts {
+		var err error
+		if ms[i], err = m.ctxts[i].MatchFile(filepath.Dir(path), filepath.Base(path)); err != nil {
+			return nil, err
+		}
+	}
+
+	m.lock.Lock()
+	m.cache[path] = ms
+	m.lock.Unlock()
+	return ms, nil
+}
@@ -0,0 +1,80 @@
+package platforms
+
+import (
+	"testing"
+
+	"github.com/modularise/modularise/cmd/config"
+	"github.com/modularise/modularise/internal/filecache/testcache"
+	"github.com/modularise/modularise/internal/testlib"
+)
+
+func TestMatcher(t *testing.T) {
+	t.Parallel()
+
+	fc, err := testcache.NewFakeFileCache("invalid-root", map[string]testcache.FakeFileCacheEntry{
+		"go.mod":              {Data: []byte("module example.com/repo\n")},
+		"plain.go":            {Data: []byte("package repo\n")},
+		"file_windows.go":     {Data: []byte("package repo\n")},
+		"file_linux_arm64.go": {Data: []byte("package repo\n")},
+		"ignored.go":          {Data: []byte("// +build ignore\n\npackage main\n")},
+		"gobuild.go":          {Data: []byte("//go:build darwin && !arm64\n\npackage repo\n")},
+		"tagged.go":           {Data: []byte("// +build integration\n\npackage repo\n")},
+		"cgo.go":              {Data: []byte("// +build cgo\n\npackage repo\n")},
+		"nocgo.go":            {Data: []byte("// +build !cgo\n\npackage repo\n")},
+	})
+	testlib.NoError(t, true, err)
+
+	noCgo := false
+	tcs := map[string]struct {
+		targets  []config.BuildTarget
+		expected map[string][]bool
+	}{
+		"DefaultTargets": {
+			expected: map[string][]bool{
+				"plain.go":            {true, true, true, true, true},
+				"file_windows.go":     {false, false, false, false, true},
+				"file_linux_arm64.go": {false, true, false, false, false},
+				"ignored.go":          {false, false, false, false, false},
+				"gobuild.go":          {false, false, true, false, false},
+				"tagged.go":           {false, false, false, false, false},
+				"cgo.go":              {true, true, true, true, true},
+				"nocgo.go":            {false, false, false, false, false},
+			},
+		},
+		"CustomTargets": {
+			targets: []config.BuildTarget{
+				{GOOS: "linux", GOARCH: "amd64", Tags: []string{"integration"}},
+				{GOOS: "windows", GOARCH: "arm64", Cgo: &noCgo},
+			},
+			expected: map[string][]bool{
+				"plain.go":        {true, true},
+				"file_windows.go": {false, true},
+				"ignored.go":      {false, false},
+				"tagged.go":       {true, false},
+				"cgo.go":          {true, false},
+				"nocgo.go":        {false, true},
+			},
+		},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			m := NewMatcher(fc, tc.targets)
+			for f, expected := range tc.expected {
+				var any bool
+				for i := range expected {
+					ok, err := m.MatchTarget(f, i)
+					testlib.NoError(t, true, err)
+					testlib.Equal(t, false, expected[i], ok)
+					any = any || ok
+				}
+				ok, err := m.Match(f)
+				testlib.NoError(t, true, err)
+				testlib.Equal(t, false, any, ok)
+			}
+		})
+	}
+}
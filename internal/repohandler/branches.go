@@ -0,0 +1,132 @@
+package repohandler
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/go-git/go-git/v5"
+	"go.uber.org/zap"
+
+	"github.com/modularise/modularise/cmd/config"
+	"github.com/modularise/modularise/internal/filecache"
+)
+
+// MapBranches determines the branch of the split repositories that should be updated based on the
+// configured BranchMapping and the branch of the source project. If no SourceBranch was specified it
+// is detected from the HEAD of the source project's git repository. The Branch field of each
+// config.Split in Splits is updated with the mapped branch. A rule without target maps the source
+// branch to each split's configured Branch, while a rule with a target overrides it. If no rule
+// matches, the UnmatchedBranch policy applies. The returned boolean indicates that the source branch
+// is configured to be skipped, in which case no split should be updated.
+//
+// If no BranchMapping is configured MapBranches is a no-op.
+func MapBranches(log *zap.Logger, fc filecache.FileCache, sp *config.Splits) (bool, error) {
+	if len(sp.BranchMapping) == 0 {
+		return false, nil
+	}
+
+	if sp.SourceBranch == "" {
+		bn, err := sourceBranch(log, fc, sp)
+		if err != nil {
+			return false, err
+		}
+		sp.SourceBranch = bn
+	}
+
+	target, matched, err := mapBranch(sp.BranchMapping, sp.SourceBranch)
+	if err != nil {
+		log.Error("Invalid branch mapping.", zap.Error(err))
+		return false, err
+	} else if matched == nil {
+		switch sp.UnmatchedBranch {
+		case config.UnmatchedBranchSkip:
+			log.Warn("Source branch does not match any branch mapping rule. No splits will be updated.", zap.String("branch", sp.SourceBranch))
+			return true, nil
+		case config.UnmatchedBranchDefault:
+			log.Info("Source branch does not match any branch mapping rule. Each split's configured branch is used.", zap.String("branch", sp.SourceBranch))
+			return false, nil
+		default:
+			log.Error("Source branch does not match any branch mapping rule.", zap.String("branch", sp.SourceBranch))
+			return false, fmt.Errorf("source branch %q does not match any branch mapping rule", sp.SourceBranch)
+		}
+	} else if matched.Skip {
+		log.Info("Source branch is configured to not update any splits.", zap.String("branch", sp.SourceBranch))
+		return true, nil
+	} else if target == "" {
+		log.Info("Mapped source branch to the configured branch of each split.", zap.String("source-branch", sp.SourceBranch))
+		return false, nil
+	}
+
+	log.Info("Mapped source branch to split branch.", zap.String("source-branch", sp.SourceBranch), zap.String("split-branch", target))
+	for _, s := range sp.Splits {
+		if s.Branch != "" && s.Branch != target {
+			log.Info("Branch mapping overrides the configured branch of split.", zap.String("split", s.Name), zap.String("configured-branch", s.Branch), zap.String("split-branch", target))
+		}
+		s.Branch = target
+	}
+	return false, nil
+}
+
+// OpenSource returns the git repository containing the source module. The root of the module does
+// not need to be the root of the repository, as is the case when splitting a nested module. The
+// repository is only opened once and then shared via the SourceRepo field of the given Splits.
+func OpenSource(fc filecache.FileCache, sp *config.Splits) (*git.Repository, error) {
+	if sp.SourceRepo != nil {
+		return sp.SourceRepo, nil
+	}
+	repo, err := git.PlainOpenWithOptions(fc.Root(), &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return nil, err
+	}
+	sp.SourceRepo = repo
+	return repo, nil
+}
+
+func sourceBranch(log *zap.Logger, fc filecache.FileCache, sp *config.Splits) (string, error) {
+	repo, err := OpenSource(fc, sp)
+	if err != nil {
+		log.Error("Could not open the source project's git repository.", zap.String("directory", fc.Root()), zap.Error(err))
+		return "", err
+	}
+
+	h, err := repo.Head()
+	if err != nil {
+		log.Error("Could not determine the source project's HEAD.", zap.String("directory", fc.Root()), zap.Error(err))
+		return "", err
+	}
+	if !h.Name().IsBranch() {
+		log.Error("The source project's HEAD is detached. Please specify the source branch explicitly.", zap.String("directory", fc.Root()))
+		return "", errors.New("could not determine source branch from detached HEAD")
+	}
+
+	log.Debug("Detected source branch.", zap.String("branch", h.Name().Short()))
+	return h.Name().Short(), nil
+}
+
+// mapBranch applies the first of the rules that matches the source branch. It returns the resulting
+// split branch and the matching rule, which is nil if no rule matches. The resulting branch is empty
+// if the matching rule is a skip rule or has no target.
+func mapBranch(rules []config.BranchRule, source string) (string, *config.BranchRule, error) {
+	for i := range rules {
+		r := &rules[i]
+		re, err := regexp.Compile("^(?:" + r.Source + ")$")
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid source branch expression %q: %v", r.Source, err)
+		}
+
+		m := re.FindStringSubmatchIndex(source)
+		if m == nil {
+			continue
+		} else if r.Skip || r.Target == "" {
+			return "", r, nil
+		}
+
+		target := string(re.ExpandString(nil, r.Target, source, m))
+		if target == "" {
+			return "", nil, fmt.Errorf("branch mapping rule for %q results in an empty branch name", r.Source)
+		}
+		return target, r, nil
+	}
+	return "", nil, nil
+}
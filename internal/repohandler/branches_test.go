@@ -0,0 +1,107 @@
+package repohandler
+
+import (
+	"testing"
+
+	"github.com/modularise/modularise/cmd/config"
+	"github.com/modularise/modularise/internal/testlib"
+)
+
+func TestMapBranch(t *testing.T) {
+	t.Parallel()
+
+	rules := []config.BranchRule{
+		{Source: `release-(\d+)\.x`, Target: "release-$1.x"},
+		{Source: "main", Target: "master"},
+		{Source: "feature/(?P<name>.*)", Target: "modularise/${name}"},
+		{Source: "wip/.*", Skip: true},
+		{Source: "develop"},
+	}
+
+	tcs := map[string]struct {
+		source  string
+		target  string
+		skip    bool
+		matched bool
+	}{
+		"Release":     {source: "release-1.x", target: "release-1.x", matched: true},
+		"Main":        {source: "main", target: "master", matched: true},
+		"MainPrefix":  {source: "maintenance", target: ""},
+		"NamedGroup":  {source: "feature/foo", target: "modularise/foo", matched: true},
+		"Skipped":     {source: "wip/bar", skip: true, matched: true},
+		"NoTarget":    {source: "develop", target: "", matched: true},
+		"NoMatch":     {source: "other", target: ""},
+		"PartialOnly": {source: "prefix-release-1.x", target: ""},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			target, r, err := mapBranch(rules, tc.source)
+			testlib.NoError(t, true, err)
+			testlib.Equal(t, false, tc.target, target)
+			testlib.Equal(t, false, tc.matched, r != nil)
+			testlib.Equal(t, false, tc.skip, r != nil && r.Skip)
+		})
+	}
+
+	t.Run("InvalidExpression", func(t *testing.T) {
+		t.Parallel()
+
+		_, _, err := mapBranch([]config.BranchRule{{Source: "(", Target: "foo"}}, "foo")
+		testlib.Error(t, false, err)
+	})
+}
+
+func TestMapBranches(t *testing.T) {
+	t.Parallel()
+
+	rules := []config.BranchRule{
+		{Source: "release-(.*)", Target: "release-$1"},
+		{Source: "main"},
+	}
+
+	tcs := map[string]struct {
+		source   string
+		policy   config.UnmatchedBranchPolicy
+		expected map[string]string
+		skip     bool
+		err      bool
+	}{
+		"MappedTarget":     {source: "release-1", expected: map[string]string{"a": "release-1", "b": "release-1"}},
+		"ConfiguredBranch": {source: "main", expected: map[string]string{"a": "", "b": "stable"}},
+		"UnmatchedError":   {source: "feature", err: true},
+		"UnmatchedSkip":    {source: "feature", policy: config.UnmatchedBranchSkip, skip: true},
+		"UnmatchedDefault": {source: "feature", policy: config.UnmatchedBranchDefault, expected: map[string]string{"a": "", "b": "stable"}},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			sp := &config.Splits{
+				BranchMapping:   rules,
+				UnmatchedBranch: tc.policy,
+				Splits: map[string]*config.Split{
+					"a": {},
+					"b": {Branch: "stable"},
+				},
+			}
+			sp.SourceBranch = tc.source
+
+			skip, err := MapBranches(testlib.NewTestLogger(), nil, sp)
+			if tc.err {
+				testlib.Error(t, false, err)
+				return
+			}
+			testlib.NoError(t, true, err)
+			testlib.Equal(t, false, tc.skip, skip)
+			if tc.expected != nil {
+				testlib.Equal(t, false, tc.expected, map[string]string{"a": sp.Splits["a"].Branch, "b": sp.Splits["b"].Branch})
+			}
+		})
+	}
+}
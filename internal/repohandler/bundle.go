@@ -0,0 +1,247 @@
+package repohandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"go.uber.org/zap"
+
+	"github.com/modularise/modularise/cmd/config"
+)
+
+// BundleManifestFile is the name of the manifest file describing the bundles in a bundle directory.
+const BundleManifestFile = "manifest.json"
+
+// BundleManifest describes the content of a directory of split bundles.
+type BundleManifest struct {
+	Bundles []BundleEntry `json:"bundles"`
+}
+
+// BundleEntry describes the bundle of new commits for a single split.
+type BundleEntry struct {
+	// Name of the split.
+	Split string `json:"split"`
+	// URL of the split's remote repository.
+	URL string `json:"url"`
+	// Branch on the split's remote repository to which the bundle should be applied.
+	Branch string `json:"branch"`
+	// Head of the branch on the remote on which the bundle's content is based. It is empty if the
+	// bundle contains the entire history of the branch.
+	Basis string `json:"basis,omitempty"`
+	// Head of the branch contained in the bundle.
+	Head string `json:"head"`
+	// Name of the bundle file relative to the manifest. It is empty if there is no new content.
+	File string `json:"file,omitempty"`
+	// Additional remotes of the split to which the bundle's content is pushed as well.
+	Remotes []BundleRemote `json:"remotes,omitempty"`
+}
+
+// BundleRemote describes an additional remote of a split. Credentials are not part of the manifest
+// but are taken from the configuration used when applying the bundles.
+type BundleRemote struct {
+	URL    string            `json:"url"`
+	Branch string            `json:"branch,omitempty"`
+	Policy config.PushPolicy `json:"policy,omitempty"`
+}
+
+// WriteBundles writes, for each split with a remote repository, a git bundle containing the commits
+// and tags of the split's branch that are not yet known to its remote to the specified directory.
+// A manifest describing the bundles is written alongside them. The bundles can subsequently be
+// pushed to their remotes via ApplyBundles.
+//
+// The prequisites on the fields of a config.Splits object for WriteBundles to be able to operate
+// are:
+//  - For each config.Split in Splits the WorkDir, Repo and RemoteHead fields are populated.
+func WriteBundles(log *zap.Logger, sp *config.Splits, dir string) error {
+	if err := checkRepositories(log, sp); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Error("Failed to create bundle directory.", zap.String("directory", dir), zap.Error(err))
+		return err
+	}
+
+	var m BundleManifest
+	for _, s := range pushOrder(sp) {
+		if s.URL == "" {
+			continue
+		}
+
+		h, err := s.Repo.Head()
+		if err != nil {
+			log.Error("Failed to determine the HEAD of split repository.", zap.String("split", s.Name), zap.Error(err))
+			return err
+		}
+
+		e := BundleEntry{Split: s.Name, URL: s.URL, Branch: splitBranch(s), Head: h.Hash().String()}
+		for _, r := range s.Remotes {
+			e.Remotes = append(e.Remotes, BundleRemote{URL: r.URL, Branch: r.Branch, Policy: r.Policy})
+		}
+		if !s.RemoteHead.IsZero() {
+			e.Basis = s.RemoteHead.String()
+		}
+		if h.Hash() != s.RemoteHead {
+			e.File = s.Name + ".bundle"
+			args := []string{"bundle", "create", filepath.Join(dir, e.File), plumbing.NewBranchReferenceName(e.Branch).String(), "--tags"}
+			if e.Basis != "" {
+				args = append(args, "^"+e.Basis)
+			}
+			if err = runGit(log, s.WorkDir, args...); err != nil {
+				return err
+			}
+			log.Debug("Wrote bundle for split.", zap.String("split", s.Name), zap.String("file", e.File))
+		}
+		m.Bundles = append(m.Bundles, e)
+	}
+
+	mb, err := json.MarshalIndent(&m, "", "  ")
+	if err != nil {
+		log.Error("Failed to marshal bundle manifest.", zap.Error(err))
+		return err
+	}
+	p := filepath.Join(dir, BundleManifestFile)
+	if err = ioutil.WriteFile(p, mb, 0644); err != nil {
+		log.Error("Failed to write bundle manifest.", zap.String("file", p), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// ApplyBundles reads the manifest in the specified bundle directory and pushes the content of each
+// bundle to the associated split remotes. The bundle's tags are pushed together with the split's
+// branch. A bundle is only applied if the split's branch on the remote still points to the commit on
+// which the bundle is based. Only the credentials of the given
+// Splits are used: the global ones for each split's remote and, for additional remotes of a split,
+// those of the configured remote with the same URL if any.
+func ApplyBundles(log *zap.Logger, sp *config.Splits, dir string) error {
+	p := filepath.Join(dir, BundleManifestFile)
+	mb, err := ioutil.ReadFile(p)
+	if err != nil {
+		log.Error("Failed to read bundle manifest.", zap.String("file", p), zap.Error(err))
+		return err
+	}
+	var m BundleManifest
+	if err = json.Unmarshal(mb, &m); err != nil {
+		log.Error("Failed to parse bundle manifest.", zap.String("file", p), zap.Error(err))
+		return err
+	}
+
+	for _, e := range m.Bundles {
+		if e.File == "" {
+			log.Info("No new content for split.", zap.String("split", e.Split))
+			continue
+		}
+		if err = applyBundle(log, sp, e, dir); err != nil {
+			return err
+		}
+		log.Info("Applied bundle for split.", zap.String("split", e.Split), zap.String("url", e.URL), zap.String("branch", e.Branch))
+	}
+	return nil
+}
+
+func applyBundle(log *zap.Logger, sp *config.Splits, e BundleEntry, dir string) error {
+	auth, err := sp.Credentials.ExtractAuth()
+	if err != nil {
+		log.Error("Could not set up authentication for Git operations.", zap.Error(err))
+		return err
+	}
+
+	s := &config.Split{URL: e.URL, Branch: e.Branch}
+	s.Name = e.Split
+	if e.Basis != "" {
+		s.RemoteHead = plumbing.NewHash(e.Basis)
+	}
+	for _, br := range e.Remotes {
+		r := config.Remote{URL: br.URL, Branch: br.Branch, Policy: br.Policy}
+		if cs := sp.Splits[e.Split]; cs != nil {
+			for _, cr := range cs.Remotes {
+				if cr.URL == br.URL {
+					r.Credentials = cr.Credentials
+				}
+			}
+		}
+		s.Remotes = append(s.Remotes, r)
+	}
+
+	if err = checkLease(log, &pushTarget{split: s, remote: defaultRemoteName, url: e.URL, branch: e.Branch, auth: auth, lease: s.RemoteHead}); err != nil {
+		return err
+	}
+
+	td, err := ioutil.TempDir("", "modularise-bundle")
+	if err != nil {
+		log.Error("Could not create temporary directory to apply bundle.", zap.Error(err))
+		return err
+	}
+	defer func() { _ = os.RemoveAll(td) }()
+
+	// A bundle without basis contains the entire history of the branch, which does not exist on the
+	// remote as ensured by the lease check. There is hence no need to retrieve the remote's content.
+	bn := plumbing.NewBranchReferenceName(e.Branch)
+	var r *git.Repository
+	if e.Basis == "" {
+		if r, err = git.PlainInit(td, true); err == nil {
+			_, err = r.CreateRemote(&gitconfig.RemoteConfig{Name: defaultRemoteName, URLs: []string{e.URL}})
+		}
+	} else {
+		r, err = git.PlainClone(td, true, &git.CloneOptions{Auth: auth, URL: e.URL, ReferenceName: bn, SingleBranch: true})
+	}
+	if err != nil {
+		log.Error("Failed to retrieve remote repository of split.", zap.String("split", e.Split), zap.String("url", e.URL), zap.Error(err))
+		return err
+	}
+
+	bp, err := filepath.Abs(filepath.Join(dir, e.File))
+	if err != nil {
+		return err
+	}
+	if err = runGit(log, td, "bundle", "verify", bp); err != nil {
+		return err
+	}
+	if err = runGit(log, td, "fetch", "--tags", bp, fmt.Sprintf("+%s:%s", bn, bn)); err != nil {
+		return err
+	}
+
+	if r, err = git.PlainOpen(td); err != nil {
+		log.Error("Failed to open repository.", zap.String("directory", td), zap.Error(err))
+		return err
+	}
+	ref, err := r.Reference(bn, true)
+	if err != nil {
+		log.Error("Bundle does not contain the split's branch.", zap.String("split", e.Split), zap.String("branch", e.Branch), zap.Error(err))
+		return err
+	} else if ref.Hash().String() != e.Head {
+		log.Error("Bundle content does not match manifest.", zap.String("split", e.Split), zap.String("expected", e.Head), zap.String("actual", ref.Hash().String()))
+		return fmt.Errorf("bundle for split %q does not contain the expected head", e.Split)
+	}
+
+	s.Repo = r
+	p, err := newPublication(log, &config.Splits{Credentials: sp.Credentials, Splits: map[string]*config.Split{s.Name: s}})
+	if err != nil {
+		return err
+	}
+	p.tags = true
+	defer p.report()
+	for _, t := range p.targets {
+		if err = p.pushTarget(t); err != nil && t.required {
+			return err
+		}
+	}
+	return nil
+}
+
+func runGit(log *zap.Logger, dir string, args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Error("Failed to run git command.", zap.String("directory", dir), zap.Strings("args", args), zap.ByteString("output", out), zap.Error(err))
+		return err
+	}
+	return nil
+}
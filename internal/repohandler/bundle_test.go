@@ -0,0 +1,67 @@
+package repohandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+
+	"github.com/modularise/modularise/cmd/config"
+	"github.com/modularise/modularise/internal/testlib"
+)
+
+func TestBundles(t *testing.T) {
+	t.Parallel()
+
+	s, remote, cleanup := setupPushTest(t)
+	defer cleanup()
+
+	extra := filepath.Join(filepath.Dir(remote), "extra")
+	_, err := git.PlainInit(extra, true)
+	testlib.NoError(t, true, err)
+	s.Remotes = []config.Remote{{URL: fmt.Sprintf("file://%s", extra)}}
+
+	old := bareRepoHead(t, remote)
+	h := commitSplitChange(t, s)
+	_, err = s.Repo.CreateTag("v1.0.0", h, nil)
+	testlib.NoError(t, true, err)
+
+	bd := filepath.Join(filepath.Dir(remote), "bundles")
+	sp := &config.Splits{Splits: map[string]*config.Split{s.Name: s}}
+	err = WriteBundles(testlib.NewTestLogger(), sp, bd)
+	testlib.NoError(t, true, err)
+	testlib.Equal(t, true, old, bareRepoHead(t, remote))
+
+	mb, err := ioutil.ReadFile(filepath.Join(bd, BundleManifestFile))
+	testlib.NoError(t, true, err)
+	var m BundleManifest
+	testlib.NoError(t, true, json.Unmarshal(mb, &m))
+	testlib.Equal(t, false, BundleManifest{Bundles: []BundleEntry{{
+		Split:   s.Name,
+		URL:     s.URL,
+		Branch:  defaultBranchName,
+		Basis:   old.String(),
+		Head:    h.String(),
+		File:    s.Name + ".bundle",
+		Remotes: []BundleRemote{{URL: s.Remotes[0].URL}},
+	}}}, m)
+
+	err = ApplyBundles(testlib.NewTestLogger(), &config.Splits{}, bd)
+	testlib.NoError(t, true, err)
+	testlib.Equal(t, false, h, bareRepoHead(t, remote))
+	testlib.Equal(t, false, h, bareRepoHead(t, extra))
+	for _, d := range []string{remote, extra} {
+		r, err := git.PlainOpen(d)
+		testlib.NoError(t, true, err)
+		tag, err := r.Tag("v1.0.0")
+		testlib.NoError(t, true, err)
+		testlib.Equal(t, false, h, tag.Hash())
+	}
+
+	// Applying the same bundles a second time should fail as the remote's head moved on.
+	err = ApplyBundles(testlib.NewTestLogger(), &config.Splits{}, bd)
+	testlib.Error(t, false, err)
+}
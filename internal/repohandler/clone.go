@@ -1,10 +1,12 @@
 package repohandler
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/go-git/go-billy/v5/osfs"
 	"github.com/go-git/go-git/v5"
@@ -23,10 +25,18 @@ const (
 	defaultRemoteName = "origin"
 )
 
+// errBranchNotFound indicates that the split's branch does not exist on its remote repository yet.
+var errBranchNotFound = errors.New("split branch does not exist on remote")
+
 // InitSplits iterates over the configured splits and initialises a working directory for each one
 // of them in the configured WorkTree. If configured, the remote repository for each split is then
-// fetched into this working directory. If the remote repository is empty or no remote is configured
-// a new empty git repository is initialised instead.
+// fetched into this working directory. If the remote repository is empty, does not yet contain the
+// split's branch or no remote is configured a new empty git repository is initialised instead.
+//
+// If a MirrorDirectory is configured the remote repositories are not cloned directly. Instead a
+// persistent bare mirror of each remote is maintained in the MirrorDirectory and only updated with
+// new content before the split's working directory is created from it. The working directory shares
+// the mirror's objects instead of copying them.
 //
 // The prequisites on the fields of a config.Splits object for InitSplits to be able to operate are:
 //  - The WorkTree field is populated and corresponds to an existing directory.
@@ -54,6 +64,17 @@ func initWorkTree(log *zap.Logger, sp *config.Splits) error {
 		}
 		sp.WorkTree = td
 	} else {
+		if inside, err := isWithin(sp.MirrorDirectory, sp.WorkTree); err != nil {
+			log.Error("Failed to determine the absolute paths of the working tree and mirror directory.", zap.Error(err))
+			return err
+		} else if sp.MirrorDirectory != "" && inside {
+			log.Error(
+				"The mirror directory can not be located inside the working tree as its content would be removed.",
+				zap.String("directory", sp.WorkTree),
+				zap.String("mirror-directory", sp.MirrorDirectory),
+			)
+			return fmt.Errorf("mirror directory %q is inside working tree %q", sp.MirrorDirectory, sp.WorkTree)
+		}
 		if err := os.RemoveAll(sp.WorkTree); err != nil {
 			log.Error("Failed to clean out existing content of working tree.", zap.String("directory", sp.WorkTree), zap.Error(err))
 			return err
@@ -73,6 +94,18 @@ func initWorkTree(log *zap.Logger, sp *config.Splits) error {
 	return nil
 }
 
+// isWithin determines whether path is equal to, or located inside of, dir.
+func isWithin(path string, dir string) (bool, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return false, err
+	}
+	return strings.HasPrefix(path+string(filepath.Separator), dir+string(filepath.Separator)), nil
+}
+
 func initSplitDir(log *zap.Logger, s *config.Split) error {
 	if _, err := os.Stat(s.WorkDir); err == nil {
 		log.Error(
@@ -116,29 +149,50 @@ func cloneRepository(log *zap.Logger, s *config.Split, sp *config.Splits) error
 		return err
 	}
 
-	bn := s.Branch
-	if bn == "" {
-		bn = defaultBranchName
+	var r *git.Repository
+	if sp.MirrorDirectory != "" {
+		r, err = cloneFromMirror(log, s, sp, auth)
+	} else {
+		r, err = cloneBranch(log, s, auth)
 	}
-	log.Debug("Cloning remote repository.", zap.String("directory", s.WorkDir), zap.String("url", s.URL))
-	r, err := git.PlainClone(
-		s.WorkDir,
-		false,
-		&git.CloneOptions{
-			Auth:          auth,
-			URL:           s.URL,
-			ReferenceName: plumbing.NewBranchReferenceName(bn),
-			SingleBranch:  true,
-		},
-	)
 	if err == transport.ErrEmptyRemoteRepository {
 		return initRepository(log, s, sp)
+	} else if err == errBranchNotFound {
+		log.Info("Split branch does not exist on remote yet. Starting from an empty history.", zap.String("split", s.Name), zap.String("branch", splitBranch(s)))
+		return initRepository(log, s, sp)
 	} else if err != nil {
 		log.Error("Failed to clone repository.", zap.String("directory", s.WorkDir), zap.String("url", s.URL), zap.Error(err))
 		return err
 	}
 	s.Repo = r
 
+	h, err := s.Repo.Head()
+	if err != nil {
+		log.Error("Failed to determine the HEAD of a cloned git repository.", zap.String("directory", s.WorkDir), zap.Error(err))
+		return err
+	}
+	s.RemoteHead = h.Hash()
+	log.Debug("Recorded remote head of split branch.", zap.String("split", s.Name), zap.String("hash", s.RemoteHead.String()))
+
+	if err = detectDrift(log, s, s.RemoteHead); err != nil {
+		de, ok := err.(driftErr)
+		if !ok {
+			return err
+		}
+		log.Warn(
+			"Split repository contains commits that were not produced by modularise.",
+			zap.String("split", s.Name),
+			zap.String("url", s.URL),
+			zap.Strings("commits", de.Commits),
+			zap.Strings("files", de.Files),
+		)
+		if !sp.OverwriteManualChanges {
+			log.Error("Refusing to overwrite manual changes in split repository.", zap.String("split", s.Name))
+			return err
+		}
+		log.Warn("Manual changes in split repository will be overwritten.", zap.String("split", s.Name))
+	}
+
 	wt, err := s.Repo.Worktree()
 	if err != nil {
 		log.Error("Failed to open a git repository's working tree.", zap.String("directory", s.WorkDir), zap.Error(err))
@@ -172,6 +226,32 @@ func cloneRepository(log *zap.Logger, s *config.Split, sp *config.Splits) error
 	return nil
 }
 
+// cloneBranch clones the split's branch from its remote repository into the split's working
+// directory. If the remote repository does not yet contain the split's branch errBranchNotFound is
+// returned.
+func cloneBranch(log *zap.Logger, s *config.Split, auth transport.AuthMethod) (*git.Repository, error) {
+	h, err := remoteHead(&pushTarget{split: s, remote: defaultRemoteName, url: s.URL, branch: splitBranch(s), auth: auth})
+	if err != nil {
+		log.Error("Failed to query remote of split.", zap.String("split", s.Name), zap.String("url", s.URL), zap.Error(err))
+		return nil, err
+	}
+	if h.IsZero() {
+		return nil, errBranchNotFound
+	}
+
+	log.Debug("Cloning remote repository.", zap.String("directory", s.WorkDir), zap.String("url", s.URL))
+	return git.PlainClone(
+		s.WorkDir,
+		false,
+		&git.CloneOptions{
+			Auth:          auth,
+			URL:           s.URL,
+			ReferenceName: plumbing.NewBranchReferenceName(splitBranch(s)),
+			SingleBranch:  true,
+		},
+	)
+}
+
 func initRepository(log *zap.Logger, s *config.Split, sp *config.Splits) error {
 	r, err := git.Init(filesystem.NewStorage(osfs.New(filepath.Join(s.WorkDir, ".git")), cache.NewObjectLRUDefault()), osfs.New(s.WorkDir))
 	if err != nil {
@@ -186,7 +266,7 @@ func initRepository(log *zap.Logger, s *config.Split, sp *config.Splits) error {
 	}
 
 	// We need to create an initial commit for references to be populated.
-	h, err := wt.Commit("Initial commit", &git.CommitOptions{Author: sp.Author.ExtractAuthor()})
+	h, err := wt.Commit(CommitMessage("Initial commit", ""), &git.CommitOptions{Author: sp.Author.ExtractAuthor()})
 	if err != nil {
 		log.Error("Failed to create initial empty commit in git repository.", zap.String("directory", s.WorkDir), zap.Error(err))
 		return err
@@ -198,10 +278,7 @@ func initRepository(log *zap.Logger, s *config.Split, sp *config.Splits) error {
 		return err
 	}
 
-	bn := s.Branch
-	if bn == "" {
-		bn = defaultBranchName
-	}
+	bn := splitBranch(s)
 	br := &gitconfig.Branch{
 		Name:  bn,
 		Merge: plumbing.NewBranchReferenceName(bn),
@@ -249,3 +326,11 @@ func initRepository(log *zap.Logger, s *config.Split, sp *config.Splits) error {
 	s.Repo = r
 	return nil
 }
+
+// splitBranch returns the name of the branch that is used for a split's content on its remote.
+func splitBranch(s *config.Split) string {
+	if s.Branch == "" {
+		return defaultBranchName
+	}
+	return s.Branch
+}
@@ -8,6 +8,8 @@ import (
 	"testing"
 
 	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
 
 	"github.com/modularise/modularise/cmd/config"
 	"github.com/modularise/modularise/internal/splits"
@@ -69,7 +71,7 @@ func TestCloneRepository(t *testing.T) {
 			Path:    "file.txt",
 			Content: []byte("file"),
 		}),
-		testrepo.Commit("First commit"),
+		testrepo.Commit(CommitMessage("First commit", "")),
 	})
 	tr.WriteToDisk(filepath.Join(td, "source"))
 
@@ -92,6 +94,50 @@ func TestCloneRepository(t *testing.T) {
 	testlib.Equal(t, false, he.Hash, hc.Hash)
 }
 
+func TestCloneRepositoryNewBranch(t *testing.T) {
+	t.Parallel()
+
+	for name, mirror := range map[string]bool{"Direct": false, "Mirror": true} {
+		mirror := mirror
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			td, err := ioutil.TempDir("", "modularise-test-repository")
+			testlib.NoError(t, true, err)
+			defer func() { testlib.NoError(t, false, os.RemoveAll(td)) }()
+
+			tr := testrepo.CreateTestRepo(t, []testrepo.RepoAction{
+				testrepo.AddFile(testrepo.RepoFile{Path: "file.txt", Content: []byte("file")}),
+				testrepo.Commit(CommitMessage("First commit", "")),
+			})
+			tr.WriteToDisk(filepath.Join(td, "source"))
+
+			sp := &config.Splits{}
+			if mirror {
+				sp.MirrorDirectory = filepath.Join(td, "mirrors")
+			}
+			target := filepath.Join(td, "target")
+			testlib.NoError(t, true, os.Mkdir(target, 0755))
+
+			url := fmt.Sprintf("file://%s", tr.Path())
+			s := &config.Split{URL: url, Branch: "release-1.x", DataSplit: splits.DataSplit{Name: "test-split", WorkDir: target}}
+			testlib.NoError(t, true, cloneRepository(testlib.NewTestLogger(), s, sp))
+			testlib.True(t, false, s.RemoteHead.IsZero())
+
+			hr, err := s.Repo.Head()
+			testlib.NoError(t, true, err)
+			testlib.Equal(t, false, plumbing.NewBranchReferenceName("release-1.x"), hr.Name())
+			hc, err := s.Repo.CommitObject(hr.Hash())
+			testlib.NoError(t, true, err)
+			testlib.Equal(t, false, 0, hc.NumParents())
+
+			rc, err := s.Repo.Remote(defaultRemoteName)
+			testlib.NoError(t, true, err)
+			testlib.Equal(t, false, []string{url}, rc.Config().URLs)
+		})
+	}
+}
+
 func TestInitWorkTree(t *testing.T) {
 	t.Parallel()
 
@@ -145,3 +191,213 @@ func testInitWorkTree(t *testing.T, sp *config.Splits) {
 		defer func() { testlib.NoError(t, false, os.RemoveAll(s.WorkDir)) }()
 	}
 }
+
+func TestDetectDrift(t *testing.T) {
+	t.Parallel()
+
+	file := func(p string) testrepo.RepoAction {
+		return testrepo.AddFile(testrepo.RepoFile{Path: p, Content: []byte(p)})
+	}
+
+	tcs := map[string]struct {
+		actions []testrepo.RepoAction
+		files   []string
+	}{
+		"GeneratedOnly": {
+			actions: []testrepo.RepoAction{
+				file("a.txt"),
+				testrepo.Commit(CommitMessage("Initial commit", "")),
+				file("b.txt"),
+				testrepo.Commit(CommitMessage("Splice", "foo.com/bar@deadbeef")),
+			},
+		},
+		"LegacyHistory": {
+			actions: []testrepo.RepoAction{
+				file("a.txt"),
+				testrepo.Commit("Initial commit"),
+				file("b.txt"),
+				testrepo.Commit("Splice from foo.com/bar@deadbeef"),
+			},
+		},
+		"LegacyInitialCommitOnly": {
+			actions: []testrepo.RepoAction{
+				file("a.txt"),
+				testrepo.Commit("Initial commit"),
+			},
+		},
+		"ManualCommitOnLegacyHistory": {
+			actions: []testrepo.RepoAction{
+				file("a.txt"),
+				testrepo.Commit("Initial commit"),
+				file("b.txt"),
+				testrepo.Commit("Splice from foo.com/bar@deadbeef"),
+				file("c.txt"),
+				testrepo.Commit("Manual fix"),
+			},
+			files: []string{"c.txt"},
+		},
+		"LegacySubjectWithBody": {
+			actions: []testrepo.RepoAction{
+				file("a.txt"),
+				testrepo.Commit("Initial commit"),
+				file("b.txt"),
+				testrepo.Commit("Splice from foo.com/bar@deadbeef\n\nWith manual changes."),
+			},
+			files: []string{"b.txt"},
+		},
+		"LegacySubjectAfterTrailer": {
+			actions: []testrepo.RepoAction{
+				file("a.txt"),
+				testrepo.Commit(CommitMessage("Initial commit", "")),
+				file("b.txt"),
+				testrepo.Commit("Splice from foo.com/bar@deadbeef"),
+			},
+			files: []string{"b.txt"},
+		},
+		"TrailerOutsideOfLastParagraph": {
+			actions: []testrepo.RepoAction{
+				file("a.txt"),
+				testrepo.Commit(CommitMessage("Initial commit", "")),
+				file("b.txt"),
+				testrepo.Commit("Manual fix\n\nReverts the " + GeneratedTrailer + " commit.\n\nSigned-off-by: Someone"),
+			},
+			files: []string{"b.txt"},
+		},
+		"ManualCommits": {
+			actions: []testrepo.RepoAction{
+				file("a.txt"),
+				testrepo.Commit(CommitMessage("Initial commit", "")),
+				file("b.txt"),
+				testrepo.Commit("Manual fix"),
+				file("c.txt"),
+				testrepo.Commit("Another manual fix"),
+			},
+			files: []string{"b.txt", "c.txt"},
+		},
+		"NoGeneratedCommit": {
+			actions: []testrepo.RepoAction{
+				file("a.txt"),
+				testrepo.Commit("Manual commit"),
+			},
+			files: []string{"a.txt"},
+		},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			tr := testrepo.CreateTestRepo(t, tc.actions)
+			s := &config.Split{DataSplit: splits.DataSplit{Name: "test-split", Repo: tr.Repository()}}
+
+			err := detectDrift(testlib.NewTestLogger(), s, tr.Head().Hash)
+			if tc.files == nil {
+				testlib.NoError(t, false, err)
+				return
+			}
+			de, ok := err.(driftErr)
+			testlib.True(t, true, ok)
+			testlib.Equal(t, false, tc.files, de.Files)
+		})
+	}
+}
+
+func TestCloneRepositoryFromMirror(t *testing.T) {
+	t.Parallel()
+
+	td, err := ioutil.TempDir("", "modularise-test-repository")
+	testlib.NoError(t, true, err)
+	defer func() { testlib.NoError(t, false, os.RemoveAll(td)) }()
+
+	tr := testrepo.CreateTestRepo(t, []testrepo.RepoAction{
+		testrepo.AddFile(testrepo.RepoFile{Path: "file.txt", Content: []byte("file")}),
+		testrepo.Commit(CommitMessage("First commit", "")),
+		testrepo.LightTag("stale"),
+	})
+	tr.WriteToDisk(filepath.Join(td, "source"))
+
+	sp := &config.Splits{DataSplits: splits.DataSplits{MirrorDirectory: filepath.Join(td, "mirrors")}}
+	url := fmt.Sprintf("file://%s", tr.Path())
+
+	var s *config.Split
+	for i, actions := range [][]testrepo.RepoAction{
+		nil,
+		{
+			testrepo.AddFile(testrepo.RepoFile{Path: "other.txt", Content: []byte("other")}),
+			testrepo.Commit(CommitMessage("Second commit", "")),
+			func(r *testrepo.TestRepo) { testlib.NoError(t, true, r.Repository().DeleteTag("stale")) },
+		},
+	} {
+		tr.Apply(actions)
+		he := tr.Head()
+
+		target := filepath.Join(td, fmt.Sprintf("target-%d", i))
+		testlib.NoError(t, true, os.Mkdir(target, 0755))
+
+		s = &config.Split{URL: url, DataSplit: splits.DataSplit{Name: "test-split", WorkDir: target}}
+		testlib.NoError(t, true, cloneRepository(testlib.NewTestLogger(), s, sp))
+		testlib.Equal(t, false, he.Hash, s.RemoteHead)
+
+		rc, err := s.Repo.Remote(defaultRemoteName)
+		testlib.NoError(t, true, err)
+		testlib.Equal(t, false, []string{url}, rc.Config().URLs)
+
+		// Objects are shared with the mirror instead of being copied.
+		packs, err := ioutil.ReadDir(filepath.Join(target, ".git", "objects", "pack"))
+		if !os.IsNotExist(err) {
+			testlib.NoError(t, true, err)
+		}
+		testlib.Equal(t, false, 0, len(packs))
+		c, err := s.Repo.CommitObject(s.RemoteHead)
+		testlib.NoError(t, true, err)
+		_, err = c.File("file.txt")
+		testlib.NoError(t, false, err)
+	}
+
+	m, err := git.PlainOpen(mirrorPath(sp.MirrorDirectory, url))
+	testlib.NoError(t, true, err)
+	_, err = m.Tag("stale")
+	testlib.True(t, false, err == git.ErrTagNotFound)
+
+	// New content committed on top of the shared objects can be pushed.
+	h := commitSplitChange(t, s)
+	bare := filepath.Join(td, "bare")
+	_, err = git.PlainInit(bare, true)
+	testlib.NoError(t, true, err)
+	_, err = s.Repo.CreateRemote(&gitconfig.RemoteConfig{Name: "bare", URLs: []string{fmt.Sprintf("file://%s", bare)}})
+	testlib.NoError(t, true, err)
+	testlib.NoError(t, true, s.Repo.Push(&git.PushOptions{RemoteName: "bare", RefSpecs: []gitconfig.RefSpec{"refs/heads/master:refs/heads/master"}}))
+	testlib.Equal(t, false, h, bareRepoHead(t, bare))
+}
+
+func TestIsWithin(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	testlib.NoError(t, true, err)
+
+	tcs := map[string]struct {
+		path     string
+		dir      string
+		expected bool
+	}{
+		"Inside":         {path: "/work/mirrors", dir: "/work", expected: true},
+		"Equal":          {path: "/work/", dir: "/work", expected: true},
+		"SharedPrefix":   {path: "/work-mirrors", dir: "/work"},
+		"Unclean":        {path: "/other/../work/mirrors", dir: "/work/.", expected: true},
+		"RelativeInside": {path: filepath.Join(wd, "splits", "mirrors"), dir: "splits", expected: true},
+		"RelativeAside":  {path: "mirrors", dir: "splits"},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			inside, err := isWithin(tc.path, tc.dir)
+			testlib.NoError(t, true, err)
+			testlib.Equal(t, false, tc.expected, inside)
+		})
+	}
+}
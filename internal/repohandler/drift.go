@@ -0,0 +1,179 @@
+package repohandler
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.uber.org/zap"
+
+	"github.com/modularise/modularise/cmd/config"
+)
+
+const (
+	// GeneratedTrailer is the git trailer that marks commits in split repositories as having been
+	// produced by modularise.
+	GeneratedTrailer = "Generated-By: modularise"
+	// SourceTrailerKey is the key of the git trailer that records the module path and commit of the
+	// source project from which the content of a split commit was produced.
+	SourceTrailerKey = "Modularise-Source"
+)
+
+// CommitMessage returns the message to use for a commit generated by modularise in a split
+// repository. If non-empty the source argument is recorded via a dedicated trailer.
+func CommitMessage(subject string, source string) string {
+	msg := subject + "\n\n" + GeneratedTrailer
+	if source != "" {
+		msg += fmt.Sprintf("\n%s: %s", SourceTrailerKey, source)
+	}
+	return msg
+}
+
+// isGeneratedCommit determines whether a commit was produced by modularise, i.e. whether the trailers
+// in the last paragraph of its message include the GeneratedTrailer. Neither the subject nor the body
+// of a commit are taken into account so that a manual commit can not be mistaken for a generated one
+// by accident.
+func isGeneratedCommit(c *object.Commit) bool {
+	msg := strings.TrimRight(c.Message, "\n")
+	i := strings.LastIndex(msg, "\n\n")
+	if i < 0 {
+		// A message without a body has no trailers.
+		return false
+	}
+	for _, l := range strings.Split(msg[i+2:], "\n") {
+		if strings.TrimSpace(l) == GeneratedTrailer {
+			return true
+		}
+	}
+	return false
+}
+
+// legacySpliceRE matches the complete message of the commits generated by modularise before the
+// introduction of the GeneratedTrailer. The root commit of those split repositories had the message
+// legacyInitialCommit.
+var legacySpliceRE = regexp.MustCompile(`^Splice from [^\s@]+@\S+$`)
+
+const legacyInitialCommit = "Initial commit"
+
+// isLegacyGeneratedCommit determines whether a commit has the exact message of a commit generated by
+// modularise before trailers were introduced. Such a commit is only considered to be generated if no
+// trailer-marked commit precedes it, as modularise never produces legacy commits after that point.
+func isLegacyGeneratedCommit(c *object.Commit) (bool, error) {
+	msg := strings.TrimRight(c.Message, "\n")
+	if !legacySpliceRE.MatchString(msg) && (msg != legacyInitialCommit || c.NumParents() > 0) {
+		return false, nil
+	}
+	for c.NumParents() > 0 {
+		var err error
+		if c, err = c.Parent(0); err != nil {
+			return false, err
+		}
+		if isGeneratedCommit(c) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+type driftErr struct {
+	Split   string
+	Commits []string
+	Files   []string
+}
+
+func (e driftErr) Error() string {
+	return fmt.Sprintf(
+		"split %q contains %d commit(s) not produced by modularise which modify the following files: %s",
+		e.Split,
+		len(e.Commits),
+		strings.Join(e.Files, ", "),
+	)
+}
+
+// detectDrift walks the first-parent history of the split's branch starting from its current head
+// until it encounters a commit generated by modularise, including those generated by releases that
+// predate trailers. Any commit that is encountered before this
+// point was made directly to the split repository and would be overwritten by new split content.
+func detectDrift(log *zap.Logger, s *config.Split, head plumbing.Hash) error {
+	c, err := s.Repo.CommitObject(head)
+	if err != nil {
+		log.Error("Failed to retrieve head commit of split.", zap.String("split", s.Name), zap.String("hash", head.String()), zap.Error(err))
+		return err
+	}
+	headTree, err := c.Tree()
+	if err != nil {
+		log.Error("Failed to retrieve tree of commit.", zap.String("split", s.Name), zap.String("hash", c.Hash.String()), zap.Error(err))
+		return err
+	}
+
+	var foreign []string
+	var base *object.Commit
+	for {
+		legacy, err := isLegacyGeneratedCommit(c)
+		if err != nil {
+			log.Error("Failed to retrieve ancestors of commit.", zap.String("split", s.Name), zap.String("hash", c.Hash.String()), zap.Error(err))
+			return err
+		}
+		if legacy || isGeneratedCommit(c) {
+			base = c
+			break
+		}
+		foreign = append(foreign, c.Hash.String())
+		if c.NumParents() == 0 {
+			break
+		}
+		if c, err = c.Parent(0); err != nil {
+			log.Error("Failed to retrieve parent commit.", zap.String("split", s.Name), zap.Error(err))
+			return err
+		}
+	}
+	if len(foreign) == 0 {
+		return nil
+	}
+
+	files, err := changedFiles(base, headTree)
+	if err != nil {
+		log.Error("Failed to compute files modified outside of modularise.", zap.String("split", s.Name), zap.Error(err))
+		return err
+	}
+	return driftErr{Split: s.Name, Commits: foreign, Files: files}
+}
+
+func changedFiles(base *object.Commit, head *object.Tree) ([]string, error) {
+	fs := map[string]bool{}
+	if base == nil {
+		if err := head.Files().ForEach(func(f *object.File) error {
+			fs[f.Name] = true
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	} else {
+		bt, err := base.Tree()
+		if err != nil {
+			return nil, err
+		}
+		cs, err := bt.Diff(head)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range cs {
+			if c.From.Name != "" {
+				fs[c.From.Name] = true
+			}
+			if c.To.Name != "" {
+				fs[c.To.Name] = true
+			}
+		}
+	}
+
+	var files []string
+	for f := range fs {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files, nil
+}
@@ -0,0 +1,222 @@
+package repohandler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"go.uber.org/zap"
+
+	"github.com/modularise/modularise/cmd/config"
+)
+
+var mirrorNameRE = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// mirrorPath returns the location inside the mirror directory at which the bare mirror for the
+// repository at the given URL is stored.
+func mirrorPath(dir string, url string) string {
+	return filepath.Join(dir, mirrorNameRE.ReplaceAllString(url, "_")+".git")
+}
+
+// cloneFromMirror updates, or creates if it does not yet exist, a persistent bare mirror of the
+// split's remote repository and subsequently creates the split's working directory from this mirror.
+// Only the changes since the last run need to be fetched from the remote. The working directory's
+// repository does not hold a copy of the mirror's objects but references them as alternates, in
+// the same way as 'git clone --shared' would. Its 'origin' remote points at the split's actual remote.
+//
+// If the remote repository is empty transport.ErrEmptyRemoteRepository is returned. If it does not
+// contain the split's branch errBranchNotFound is returned.
+func cloneFromMirror(log *zap.Logger, s *config.Split, sp *config.Splits, auth transport.AuthMethod) (*git.Repository, error) {
+	mp := mirrorPath(sp.MirrorDirectory, s.URL)
+	log = log.With(zap.String("split", s.Name), zap.String("mirror", mp), zap.String("url", s.URL))
+
+	m, err := git.PlainOpen(mp)
+	switch err {
+	case nil:
+		log.Debug("Updating existing mirror of split repository.")
+	case git.ErrRepositoryNotExists:
+		log.Debug("Creating new mirror of split repository.")
+		if m, err = initMirror(log, mp, s.URL); err != nil {
+			return nil, err
+		}
+	default:
+		log.Error("Failed to open mirror of split repository.", zap.Error(err))
+		return nil, err
+	}
+
+	err = m.Fetch(&git.FetchOptions{RemoteName: defaultRemoteName, Auth: auth, Tags: git.AllTags, Force: true})
+	switch err {
+	case nil, git.NoErrAlreadyUpToDate:
+	case transport.ErrEmptyRemoteRepository:
+		return nil, err
+	default:
+		log.Error("Failed to update mirror of split repository.", zap.Error(err))
+		return nil, err
+	}
+	if err = pruneMirror(log, m, auth); err != nil {
+		return nil, err
+	}
+
+	log.Debug("Creating split repository from mirror.", zap.String("directory", s.WorkDir))
+	return sharedClone(log, m, mp, s)
+}
+
+// pruneMirror removes the branches and tags from the mirror that no longer exist on its remote.
+func pruneMirror(log *zap.Logger, m *git.Repository, auth transport.AuthMethod) error {
+	rm, err := m.Remote(defaultRemoteName)
+	if err != nil {
+		log.Error("Failed to retrieve remote of mirror.", zap.Error(err))
+		return err
+	}
+	rrs, err := rm.List(&git.ListOptions{Auth: auth})
+	if err != nil {
+		log.Error("Failed to list references of remote repository.", zap.Error(err))
+		return err
+	}
+	remote := map[plumbing.ReferenceName]bool{}
+	for _, ref := range rrs {
+		remote[ref.Name()] = true
+	}
+
+	refs, err := m.References()
+	if err != nil {
+		log.Error("Failed to list references of mirror.", zap.Error(err))
+		return err
+	}
+	var stale []plumbing.ReferenceName
+	_ = refs.ForEach(func(ref *plumbing.Reference) error {
+		if (ref.Name().IsBranch() || ref.Name().IsTag()) && !remote[ref.Name()] {
+			stale = append(stale, ref.Name())
+		}
+		return nil
+	})
+	for _, rn := range stale {
+		log.Debug("Pruning reference that was deleted on the remote from mirror.", zap.String("reference", rn.String()))
+		if err = m.Storer.RemoveReference(rn); err != nil {
+			log.Error("Failed to prune reference from mirror.", zap.String("reference", rn.String()), zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// sharedClone initialises a repository in the split's working directory that uses the mirror's
+// object store as alternate, and checks out the split's branch as found in the mirror. The mirror's
+// tags are made available in the new repository as well.
+func sharedClone(log *zap.Logger, m *git.Repository, mp string, s *config.Split) (*git.Repository, error) {
+	bn := plumbing.NewBranchReferenceName(splitBranch(s))
+	head, err := m.Reference(bn, true)
+	if err == plumbing.ErrReferenceNotFound {
+		return nil, errBranchNotFound
+	} else if err != nil {
+		log.Error("Split branch does not exist in mirror.", zap.String("branch", bn.String()), zap.Error(err))
+		return nil, err
+	}
+
+	st := sharedStorage{filesystem.NewStorage(osfs.New(filepath.Join(s.WorkDir, ".git")), cache.NewObjectLRUDefault())}
+	r, err := git.Init(st, osfs.New(s.WorkDir))
+	if err != nil {
+		log.Error("Failed to initialise git repository.", zap.String("directory", s.WorkDir), zap.Error(err))
+		return nil, err
+	}
+	info := filepath.Join(s.WorkDir, ".git", "objects", "info")
+	if err = os.MkdirAll(info, 0755); err != nil {
+		log.Error("Failed to create object store of git repository.", zap.String("directory", s.WorkDir), zap.Error(err))
+		return nil, err
+	}
+	if err = ioutil.WriteFile(filepath.Join(info, "alternates"), []byte(filepath.Join(mp, "objects")+"\n"), 0644); err != nil {
+		log.Error("Failed to configure mirror as alternate object store.", zap.String("directory", s.WorkDir), zap.Error(err))
+		return nil, err
+	}
+
+	if _, err = r.CreateRemote(&gitconfig.RemoteConfig{Name: defaultRemoteName, URLs: []string{s.URL}}); err != nil {
+		log.Error("Failed to point git repository at split remote.", zap.String("directory", s.WorkDir), zap.Error(err))
+		return nil, err
+	}
+	if err = r.CreateBranch(&gitconfig.Branch{Name: bn.Short(), Remote: defaultRemoteName, Merge: bn}); err != nil {
+		log.Error("Failed to configure split branch.", zap.String("directory", s.WorkDir), zap.Error(err))
+		return nil, err
+	}
+
+	refs := []*plumbing.Reference{
+		plumbing.NewHashReference(bn, head.Hash()),
+		plumbing.NewHashReference(plumbing.NewRemoteReferenceName(defaultRemoteName, bn.Short()), head.Hash()),
+		plumbing.NewSymbolicReference(plumbing.HEAD, bn),
+	}
+	tags, err := m.Tags()
+	if err != nil {
+		log.Error("Failed to list tags of mirror.", zap.Error(err))
+		return nil, err
+	}
+	_ = tags.ForEach(func(ref *plumbing.Reference) error {
+		refs = append(refs, ref)
+		return nil
+	})
+	for _, ref := range refs {
+		if err = r.Storer.SetReference(ref); err != nil {
+			log.Error("Failed to set reference in git repository.", zap.String("directory", s.WorkDir), zap.String("reference", ref.Name().String()), zap.Error(err))
+			return nil, err
+		}
+	}
+
+	wt, err := r.Worktree()
+	if err != nil {
+		log.Error("Failed to open a git repository's working tree.", zap.String("directory", s.WorkDir), zap.Error(err))
+		return nil, err
+	}
+	if err = wt.Reset(&git.ResetOptions{Commit: head.Hash(), Mode: git.HardReset}); err != nil {
+		log.Error("Failed to check out split branch from mirror.", zap.String("directory", s.WorkDir), zap.Error(err))
+		return nil, err
+	}
+	return r, nil
+}
+
+// sharedStorage is the storage of a repository whose objects are partly held by an alternate object
+// store. The delta selection that go-git performs when pushing does not look up objects in alternate
+// object stores, hence the objects that it can not find are retrieved via EncodedObject instead.
+type sharedStorage struct {
+	*filesystem.Storage
+}
+
+func (s sharedStorage) DeltaObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	o, err := s.Storage.DeltaObject(t, h)
+	if err == plumbing.ErrObjectNotFound {
+		return s.Storage.EncodedObject(t, h)
+	}
+	return o, err
+}
+
+func initMirror(log *zap.Logger, path string, url string) (*git.Repository, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		log.Error("Failed to create directory for mirror.", zap.Error(err))
+		return nil, err
+	}
+
+	m, err := git.PlainInit(path, true)
+	if err != nil {
+		log.Error("Failed to initialise bare repository for mirror.", zap.Error(err))
+		return nil, err
+	}
+
+	_, err = m.CreateRemote(&gitconfig.RemoteConfig{
+		Name: defaultRemoteName,
+		URLs: []string{url},
+		Fetch: []gitconfig.RefSpec{
+			"+refs/heads/*:refs/heads/*",
+			"+refs/tags/*:refs/tags/*",
+		},
+	})
+	if err != nil {
+		log.Error("Failed to configure remote of mirror.", zap.Error(err))
+		return nil, err
+	}
+	return m, nil
+}
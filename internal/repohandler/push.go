@@ -2,43 +2,421 @@ package repohandler
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
 	"go.uber.org/zap"
 
 	modularise_config "github.com/modularise/modularise/cmd/config"
 )
 
+const (
+	rollbackReferenceName = plumbing.ReferenceName("refs/modularise/rollback")
+	extraRemotePrefix     = "modularise-remote-"
+)
+
 // PushSplits iterates over the configured splits and, if they have a remote repository configured,
-// pushed any new local content to the target branch.
+// pushed any new local content to the target branch. Content is subsequently pushed to any
+// additional remotes configured for the split. A failure to push to a best-effort remote is
+// reported but does not fail the operation.
+//
+// Pushes are never forced. As the new content of a split is committed on top of the head that was
+// observed when the split was cloned, the remote rejects the push if any commit was added to the
+// split's branch in the meantime. This provides the same guarantee as a push with a lease on the
+// observed head.
 //
 // The prequisites on the fields of a config.Splits object for PushSplits to be able to operate are:
 //  - For each config.Split in Splits the WorkDir field is populated and corrresponds to an existing directory.
 //  - For each config.Split in Splits the Repo field is populated and corrresponds to an existing repository.
 func PushSplits(log *zap.Logger, sp *modularise_config.Splits) error {
+	if err := checkRepositories(log, sp); err != nil {
+		return err
+	}
+
+	p, err := newPublication(log, sp)
+	if err != nil {
+		return err
+	}
+	defer p.report()
+
+	for _, t := range p.targets {
+		if t.primary {
+			if err = checkLease(log, t); err != nil {
+				p.status[t] = statusPreflightError
+				return err
+			}
+		}
+		if err = p.pushTarget(t); err != nil && t.required {
+			return err
+		}
+	}
+	return nil
+}
+
+// PushSplitsAtomic pushes the new content of all configured splits in an all-or-nothing fashion.
+// Before anything is pushed each remote is checked for reachability and to ensure that the head of
+// the split's branch still corresponds to the one that was observed when the split was cloned.
+// Splits are then pushed in dependency order. If any push to a required remote fails, all remotes
+// that were already pushed to are reverted to their previous heads. A report of the outcome for
+// each remote is logged in all cases.
+//
+// The prequisites on the fields of a config.Splits object for PushSplitsAtomic to be able to
+// operate are the same as for PushSplits with the addition of:
+//  - For each config.Split in Splits the SplitDeps and RemoteHead fields are populated.
+func PushSplitsAtomic(log *zap.Logger, sp *modularise_config.Splits) error {
+	if err := checkRepositories(log, sp); err != nil {
+		return err
+	}
+
+	p, err := newPublication(log, sp)
+	if err != nil {
+		return err
+	}
+	defer p.report()
+
+	if err = p.preflight(); err != nil {
+		return err
+	}
+
+	var pushed []*pushTarget
+	for _, t := range p.targets {
+		if p.status[t] != statusPending {
+			continue
+		}
+		if err = p.pushTarget(t); err == nil {
+			if p.status[t] == statusPushed {
+				pushed = append(pushed, t)
+			}
+			continue
+		} else if !t.required {
+			continue
+		}
+
+		for i := len(pushed) - 1; i >= 0; i-- {
+			if rErr := rollbackTarget(log, pushed[i]); rErr != nil {
+				p.status[pushed[i]] = statusRollbackError
+				continue
+			}
+			p.status[pushed[i]] = statusRolledBack
+		}
+		return err
+	}
+	return nil
+}
+
+func checkRepositories(log *zap.Logger, sp *modularise_config.Splits) error {
 	for _, s := range sp.Splits {
 		if s.Repo == nil {
 			log.Error("Attempting to push new content without having initialised a repository.", zap.String("directory", s.WorkDir))
 			return fmt.Errorf("split %q in %q has no initialised repository", s.Name, s.WorkDir)
 		}
 	}
+	return nil
+}
+
+type pushStatus string
 
+const (
+	statusPreflightError pushStatus = "pre-flight check failed"
+	statusPending        pushStatus = "not pushed"
+	statusUpToDate       pushStatus = "already up-to-date"
+	statusPushed         pushStatus = "pushed"
+	statusPushError      pushStatus = "push failed"
+	statusRejected       pushStatus = "rejected as the remote branch changed"
+	statusRolledBack     pushStatus = "rolled back"
+	statusRollbackError  pushStatus = "rollback failed"
+)
+
+// pushTarget represents a single remote branch to which the content of a split is pushed.
+type pushTarget struct {
+	split    *modularise_config.Split
+	remote   string
+	url      string
+	branch   string
+	auth     transport.AuthMethod
+	primary  bool
+	required bool
+	// Expected head of the branch on the remote.
+	lease plumbing.Hash
+}
+
+type publication struct {
+	log     *zap.Logger
+	targets []*pushTarget
+	status  map[*pushTarget]pushStatus
+	// Whether the tags of the splits' repositories are pushed alongside their branches.
+	tags bool
+}
+
+func newPublication(log *zap.Logger, sp *modularise_config.Splits) (*publication, error) {
 	auth, err := sp.Credentials.ExtractAuth()
 	if err != nil {
 		log.Error("Could not set up authentication for Git operations.", zap.Error(err))
-		return err
+		return nil, err
 	}
 
-	for _, s := range sp.Splits {
+	p := &publication{log: log, status: map[*pushTarget]pushStatus{}}
+	for _, s := range pushOrder(sp) {
 		if s.URL == "" {
 			continue
 		}
+		p.targets = append(p.targets, &pushTarget{
+			split:    s,
+			remote:   defaultRemoteName,
+			url:      s.URL,
+			branch:   splitBranch(s),
+			auth:     auth,
+			primary:  true,
+			required: true,
+			lease:    s.RemoteHead,
+		})
+
+		for i, r := range s.Remotes {
+			t := &pushTarget{
+				split:    s,
+				remote:   fmt.Sprintf("%s%d", extraRemotePrefix, i),
+				url:      r.URL,
+				branch:   r.Branch,
+				auth:     auth,
+				required: r.Policy != modularise_config.PushPolicyBestEffort,
+			}
+			if t.branch == "" {
+				t.branch = splitBranch(s)
+			}
+			if r.Credentials != nil {
+				if t.auth, err = r.Credentials.ExtractAuth(); err != nil {
+					log.Error("Could not set up authentication for remote of split.", zap.String("split", s.Name), zap.String("url", r.URL), zap.Error(err))
+					return nil, err
+				}
+			}
+			if err = ensureRemote(log, t); err != nil {
+				return nil, err
+			}
+			p.targets = append(p.targets, t)
+		}
+	}
+	for _, t := range p.targets {
+		p.status[t] = statusPending
+	}
+	return p, nil
+}
+
+// ensureRemote configures the remote of a push target in the split's repository if it does not yet
+// exist.
+func ensureRemote(log *zap.Logger, t *pushTarget) error {
+	_, err := t.split.Repo.CreateRemote(&gitconfig.RemoteConfig{Name: t.remote, URLs: []string{t.url}})
+	if err != nil && err != git.ErrRemoteExists {
+		log.Error("Failed to configure additional remote for split.", zap.String("split", t.split.Name), zap.String("url", t.url), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+func (p *publication) preflight() error {
+	var failed bool
+	for _, t := range p.targets {
+		if t.primary {
+			if err := checkLease(p.log, t); err != nil {
+				p.status[t] = statusPreflightError
+				failed = true
+			}
+			continue
+		}
+
+		h, err := remoteHead(t)
+		if err != nil {
+			p.log.Error("Failed to query remote of split.", zap.String("split", t.split.Name), zap.String("url", t.url), zap.Error(err))
+			p.status[t] = statusPreflightError
+			failed = failed || t.required
+			continue
+		}
+		t.lease = h
+	}
+	if failed {
+		return fmt.Errorf("pre-flight checks failed for split remotes, nothing was pushed")
+	}
+	return nil
+}
+
+// pushTarget pushes the split's content to the target's branch. The refspec is deliberately not a
+// forced one: the update is only sent if the head advertised by the remote is an ancestor of the new
+// content, and the remote only applies it if its branch still references the advertised head. A
+// commit that lands on the remote after the split was cloned hence results in a rejected push
+// instead of being overwritten. If the publication includes tags they are sent as part of the same
+// push, again without forcing, such that an existing tag on the remote is never moved.
+func (p *publication) pushTarget(t *pushTarget) error {
+	lb := plumbing.NewBranchReferenceName(splitBranch(t.split))
+	rb := plumbing.NewBranchReferenceName(t.branch)
+	p.log.Debug("Pushing split content.", zap.String("split", t.split.Name), zap.String("url", t.url), zap.String("branch", t.branch))
+
+	rss := []gitconfig.RefSpec{gitconfig.RefSpec(fmt.Sprintf("%s:%s", lb, rb))}
+	if p.tags {
+		rss = append(rss, gitconfig.RefSpec("refs/tags/*:refs/tags/*"))
+	}
+	err := t.split.Repo.Push(&git.PushOptions{
+		RemoteName: t.remote,
+		Auth:       t.auth,
+		RefSpecs:   rss,
+	})
+	switch {
+	case err == nil:
+		p.status[t] = statusPushed
+		return nil
+	case err == git.NoErrAlreadyUpToDate:
+		p.status[t] = statusUpToDate
+		return nil
+	case strings.HasPrefix(err.Error(), "non-fast-forward update"):
+		fields := []zap.Field{zap.String("split", t.split.Name), zap.String("url", t.url), zap.String("branch", t.branch)}
+		if t.required {
+			p.log.Error("Remote branch of split contains commits that are not part of the new content.", fields...)
+		} else {
+			p.log.Warn("Remote branch of split contains commits that are not part of the new content.", fields...)
+		}
+		p.status[t] = statusRejected
+		return fmt.Errorf("remote branch of split %q at %q changed since it was cloned", t.split.Name, t.url)
+	default:
+		if t.required {
+			p.log.Error("Failed to push new split content to remote.", zap.String("split", t.split.Name), zap.String("url", t.url), zap.Error(err))
+		} else {
+			p.log.Warn("Failed to push new split content to best-effort remote.", zap.String("split", t.split.Name), zap.String("url", t.url), zap.Error(err))
+		}
+		p.status[t] = statusPushError
+		return fmt.Errorf("failed to push split %q to %q: %v", t.split.Name, t.url, err)
+	}
+}
+
+func (p *publication) report() {
+	p.log.Info("Publication report:")
+	for _, t := range p.targets {
+		policy := modularise_config.PushPolicyRequired
+		if !t.required {
+			policy = modularise_config.PushPolicyBestEffort
+		}
+		p.log.Info(fmt.Sprintf(" - %s: %s (%s, %s): %s", t.split.Name, t.url, t.branch, policy, p.status[t]))
+	}
+}
+
+// rollbackTarget reverts the branch on the target's remote to the head that was expected before
+// content was pushed. If the branch did not exist at that time it is deleted instead.
+//
+// Reverting requires a forced push. The branch is only reverted if it still references the content
+// that was pushed, but as this is checked before the push a commit that lands on the remote in
+// between the two operations is overwritten.
+func rollbackTarget(log *zap.Logger, t *pushTarget) error {
+	bn := plumbing.NewBranchReferenceName(t.branch)
+
+	lb, err := t.split.Repo.Reference(plumbing.NewBranchReferenceName(splitBranch(t.split)), true)
+	if err != nil {
+		log.Error("Failed to resolve local branch of split.", zap.String("split", t.split.Name), zap.Error(err))
+		return err
+	}
+	if h, err := remoteHead(t); err != nil {
+		log.Error("Failed to query remote of split.", zap.String("split", t.split.Name), zap.String("url", t.url), zap.Error(err))
+		return err
+	} else if h != lb.Hash() {
+		log.Error("Remote branch of split changed since it was pushed, refusing to roll it back.", zap.String("split", t.split.Name), zap.String("url", t.url), zap.String("actual", h.String()))
+		return fmt.Errorf("remote branch of split %q changed since it was pushed", t.split.Name)
+	}
 
-		err = s.Repo.Push(&git.PushOptions{Auth: auth})
-		if err != nil && err != git.NoErrAlreadyUpToDate {
-			log.Error("Failed to push new split content to remote.", zap.String("directory", s.WorkDir), zap.String("url", s.URL))
+	var rs gitconfig.RefSpec
+	if t.lease.IsZero() {
+		rs = gitconfig.RefSpec(":" + bn.String())
+	} else {
+		if err := t.split.Repo.Storer.SetReference(plumbing.NewHashReference(rollbackReferenceName, t.lease)); err != nil {
+			log.Error("Failed to set rollback reference.", zap.String("split", t.split.Name), zap.String("hash", t.lease.String()), zap.Error(err))
 			return err
 		}
+		rs = gitconfig.RefSpec(fmt.Sprintf("+%s:%s", rollbackReferenceName, bn))
+	}
+
+	log.Debug("Rolling back split branch on remote.", zap.String("split", t.split.Name), zap.String("url", t.url), zap.String("hash", t.lease.String()))
+	err = t.split.Repo.Push(&git.PushOptions{RemoteName: t.remote, Auth: t.auth, RefSpecs: []gitconfig.RefSpec{rs}})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		log.Error("Failed to roll back split branch on remote.", zap.String("split", t.split.Name), zap.String("url", t.url), zap.Error(err))
+		return err
 	}
 	return nil
 }
+
+// checkLease ensures that the head of the branch on the target's remote still corresponds to the
+// one that was expected. This allows a publication to be aborted before anything is pushed. It is
+// not what prevents content that was pushed to the remote in the meantime from being overwritten:
+// that is guaranteed by pushTarget.
+func checkLease(log *zap.Logger, t *pushTarget) error {
+	h, err := remoteHead(t)
+	if err != nil {
+		log.Error("Failed to query remote of split.", zap.String("split", t.split.Name), zap.String("url", t.url), zap.Error(err))
+		return err
+	}
+	if h != t.lease {
+		log.Error(
+			"Remote branch of split has changed since it was cloned.",
+			zap.String("split", t.split.Name),
+			zap.String("url", t.url),
+			zap.String("branch", t.branch),
+			zap.String("expected", t.lease.String()),
+			zap.String("actual", h.String()),
+		)
+		return fmt.Errorf("remote branch of split %q changed since it was cloned", t.split.Name)
+	}
+	return nil
+}
+
+// remoteHead retrieves the hash currently referenced by the target's branch on its remote. A zero
+// hash is returned if the branch or the repository are empty.
+func remoteHead(t *pushTarget) (plumbing.Hash, error) {
+	r := git.NewRemote(memory.NewStorage(), &gitconfig.RemoteConfig{Name: t.remote, URLs: []string{t.url}})
+	refs, err := r.List(&git.ListOptions{Auth: t.auth})
+	if err == transport.ErrEmptyRemoteRepository {
+		return plumbing.ZeroHash, nil
+	} else if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	bn := plumbing.NewBranchReferenceName(t.branch)
+	for _, ref := range refs {
+		if ref.Name() == bn {
+			return ref.Hash(), nil
+		}
+	}
+	return plumbing.ZeroHash, nil
+}
+
+// pushOrder returns the configured splits ordered such that each split appears after all of the
+// splits on which it depends. Splits without any ordering constraints are sorted by name.
+func pushOrder(sp *modularise_config.Splits) []*modularise_config.Split {
+	var sns []string
+	for sn := range sp.Splits {
+		sns = append(sns, sn)
+	}
+	sort.Strings(sns)
+
+	var order []*modularise_config.Split
+	done := map[string]bool{}
+	var visit func(string)
+	visit = func(sn string) {
+		if done[sn] {
+			return
+		}
+		done[sn] = true
+
+		var deps []string
+		for dn := range sp.Splits[sn].SplitDeps {
+			deps = append(deps, dn)
+		}
+		sort.Strings(deps)
+		for _, dn := range deps {
+			visit(dn)
+		}
+		order = append(order, sp.Splits[sn])
+	}
+	for _, sn := range sns {
+		visit(sn)
+	}
+	return order
+}
@@ -0,0 +1,195 @@
+package repohandler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/modularise/modularise/cmd/config"
+	"github.com/modularise/modularise/internal/splits"
+	"github.com/modularise/modularise/internal/testlib"
+	"github.com/modularise/modularise/internal/testrepo"
+)
+
+func TestPushOrder(t *testing.T) {
+	t.Parallel()
+
+	sp := &config.Splits{Splits: map[string]*config.Split{
+		"a": {DataSplit: splits.DataSplit{Name: "a", SplitDeps: map[string]bool{"c": true}}},
+		"b": {DataSplit: splits.DataSplit{Name: "b", SplitDeps: map[string]bool{"a": true, "c": true}}},
+		"c": {DataSplit: splits.DataSplit{Name: "c"}},
+		"d": {DataSplit: splits.DataSplit{Name: "d"}},
+	}}
+
+	var order []string
+	for _, s := range pushOrder(sp) {
+		order = append(order, s.Name)
+	}
+	testlib.Equal(t, false, []string{"c", "a", "b", "d"}, order)
+}
+
+func TestPushSplitsAtomic(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Success", func(t *testing.T) {
+		t.Parallel()
+
+		s, remote, cleanup := setupPushTest(t)
+		defer cleanup()
+
+		h := commitSplitChange(t, s)
+		err := PushSplitsAtomic(testlib.NewTestLogger(), &config.Splits{Splits: map[string]*config.Split{s.Name: s}})
+		testlib.NoError(t, true, err)
+		testlib.Equal(t, false, h, bareRepoHead(t, remote))
+	})
+
+	t.Run("LeaseViolation", func(t *testing.T) {
+		t.Parallel()
+
+		s, remote, cleanup := setupPushTest(t)
+		defer cleanup()
+
+		old := bareRepoHead(t, remote)
+		commitSplitChange(t, s)
+		s.RemoteHead = plumbing.NewHash("0123456789012345678901234567890123456789")
+		err := PushSplitsAtomic(testlib.NewTestLogger(), &config.Splits{Splits: map[string]*config.Split{s.Name: s}})
+		testlib.Error(t, true, err)
+		testlib.Equal(t, false, old, bareRepoHead(t, remote))
+	})
+}
+
+func TestPushRejectsConcurrentChanges(t *testing.T) {
+	t.Parallel()
+
+	s, remote, cleanup := setupPushTest(t)
+	defer cleanup()
+
+	// Simulate a commit that lands on the remote after the lease was checked.
+	other := filepath.Join(filepath.Dir(remote), "other")
+	r, err := git.PlainClone(other, false, &git.CloneOptions{URL: s.URL})
+	testlib.NoError(t, true, err)
+	testlib.NoError(t, true, ioutil.WriteFile(filepath.Join(other, "manual.txt"), []byte("manual"), 0644))
+	wt, err := r.Worktree()
+	testlib.NoError(t, true, err)
+	_, err = wt.Add("manual.txt")
+	testlib.NoError(t, true, err)
+	manual, err := wt.Commit("Manual commit", &git.CommitOptions{Author: &object.Signature{Name: testrepo.TestAuthor, Email: testrepo.TestEmail}})
+	testlib.NoError(t, true, err)
+	testlib.NoError(t, true, r.Push(&git.PushOptions{}))
+
+	commitSplitChange(t, s)
+	p, err := newPublication(testlib.NewTestLogger(), &config.Splits{Splits: map[string]*config.Split{s.Name: s}})
+	testlib.NoError(t, true, err)
+	testlib.Error(t, true, p.pushTarget(p.targets[0]))
+	testlib.Equal(t, false, statusRejected, p.status[p.targets[0]])
+	testlib.Equal(t, false, manual, bareRepoHead(t, remote))
+}
+
+func TestPushSplitsMultipleRemotes(t *testing.T) {
+	t.Parallel()
+
+	s, remote, cleanup := setupPushTest(t)
+	defer cleanup()
+
+	mirror := filepath.Join(filepath.Dir(remote), "mirror")
+	_, err := git.PlainInit(mirror, true)
+	testlib.NoError(t, true, err)
+
+	s.Remotes = []config.Remote{
+		{URL: fmt.Sprintf("file://%s", mirror), Branch: "published"},
+		{URL: fmt.Sprintf("file://%s", filepath.Join(filepath.Dir(remote), "missing")), Policy: config.PushPolicyBestEffort},
+	}
+
+	h := commitSplitChange(t, s)
+	err = PushSplits(testlib.NewTestLogger(), &config.Splits{Splits: map[string]*config.Split{s.Name: s}})
+	testlib.NoError(t, true, err)
+	testlib.Equal(t, false, h, bareRepoHead(t, remote))
+
+	r, err := git.PlainOpen(mirror)
+	testlib.NoError(t, true, err)
+	ref, err := r.Reference(plumbing.NewBranchReferenceName("published"), true)
+	testlib.NoError(t, true, err)
+	testlib.Equal(t, false, h, ref.Hash())
+
+	s.RemoteHead = h
+	s.Remotes[1].Policy = config.PushPolicyRequired
+	err = PushSplitsAtomic(testlib.NewTestLogger(), &config.Splits{Splits: map[string]*config.Split{s.Name: s}})
+	testlib.Error(t, false, err)
+}
+
+func TestRollbackTarget(t *testing.T) {
+	t.Parallel()
+
+	s, remote, cleanup := setupPushTest(t)
+	defer cleanup()
+
+	old := bareRepoHead(t, remote)
+	h := commitSplitChange(t, s)
+	err := PushSplits(testlib.NewTestLogger(), &config.Splits{Splits: map[string]*config.Split{s.Name: s}})
+	testlib.NoError(t, true, err)
+	testlib.Equal(t, true, h, bareRepoHead(t, remote))
+
+	err = rollbackTarget(testlib.NewTestLogger(), &pushTarget{
+		split:  s,
+		remote: defaultRemoteName,
+		url:    s.URL,
+		branch: defaultBranchName,
+		lease:  old,
+	})
+	testlib.NoError(t, true, err)
+	testlib.Equal(t, false, old, bareRepoHead(t, remote))
+}
+
+func setupPushTest(t *testing.T) (*config.Split, string, func()) {
+	td, err := ioutil.TempDir("", "modularise-test-push")
+	testlib.NoError(t, true, err)
+
+	tr := testrepo.CreateTestRepo(t, []testrepo.RepoAction{
+		testrepo.AddFile(testrepo.RepoFile{Path: "file.txt", Content: []byte("file")}),
+		testrepo.Commit(CommitMessage("First commit", "")),
+	})
+	tr.WriteToDisk(filepath.Join(td, "source"))
+
+	remote := filepath.Join(td, "remote")
+	_, err = git.PlainClone(remote, true, &git.CloneOptions{URL: fmt.Sprintf("file://%s", tr.Path())})
+	testlib.NoError(t, true, err)
+
+	testlib.NoError(t, true, os.Mkdir(filepath.Join(td, "target"), 0755))
+	s := &config.Split{
+		URL:       fmt.Sprintf("file://%s", remote),
+		DataSplit: splits.DataSplit{Name: "test-split", WorkDir: filepath.Join(td, "target")},
+	}
+	testlib.NoError(t, true, cloneRepository(testlib.NewTestLogger(), s, &config.Splits{}))
+
+	return s, remote, func() { testlib.NoError(t, false, os.RemoveAll(td)) }
+}
+
+func commitSplitChange(t *testing.T, s *config.Split) plumbing.Hash {
+	testlib.NoError(t, true, ioutil.WriteFile(filepath.Join(s.WorkDir, "new.txt"), []byte("new"), 0644))
+
+	wt, err := s.Repo.Worktree()
+	testlib.NoError(t, true, err)
+	_, err = wt.Add("new.txt")
+	testlib.NoError(t, true, err)
+
+	h, err := wt.Commit("Second commit", &git.CommitOptions{
+		All:    true,
+		Author: &object.Signature{Name: testrepo.TestAuthor, Email: testrepo.TestEmail},
+	})
+	testlib.NoError(t, true, err)
+	return h
+}
+
+func bareRepoHead(t *testing.T, path string) plumbing.Hash {
+	r, err := git.PlainOpen(path)
+	testlib.NoError(t, true, err)
+	ref, err := r.Reference(plumbing.NewBranchReferenceName(defaultBranchName), true)
+	testlib.NoError(t, true, err)
+	return ref.Hash()
+}
@@ -4,6 +4,7 @@ import (
 	"go/parser"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 
@@ -11,49 +12,276 @@ import (
 
 	"github.com/modularise/modularise/cmd/config"
 	"github.com/modularise/modularise/internal/filecache"
+	"github.com/modularise/modularise/internal/platforms"
 )
 
+// ComputeResiduals determines for each split the residual packages and the other splits on which it
+// depends. Only Go files that are included in the build for at least one of the configured build
+// targets are taken into account. Residual packages that are only required for some of the build
+// targets are reported. Files embedded via '//go:embed' directives are added to the split.
 func ComputeResiduals(log *zap.Logger, fc filecache.FileCache, sp *config.Splits) error {
+	m := platforms.NewMatcher(fc, sp.BuildTargets)
 	for _, s := range sp.Splits {
-		if err := computeSplitResiduals(log, fc, sp, s); err != nil {
+		if err := computeSplitResiduals(log, fc, sp, s, m.Match); err != nil {
 			return err
 		}
+		if err := reportPlatformResiduals(log, fc, sp, s, m); err != nil {
+			return err
+		}
+		if err := resolveEmbeds(log, fc, sp, s, m.Match); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportPlatformResiduals reports the residual packages of a split that are not required on all of
+// the build targets.
+func reportPlatformResiduals(log *zap.Logger, fc filecache.FileCache, sp *config.Splits, s *config.Split, m *platforms.Matcher) error {
+	if len(m.Targets()) < 2 || len(s.Residuals) == 0 {
+		return nil
+	}
+	if len(m.Targets()) > maxReportedTargets {
+		log.Debug("Too many build targets to report platform-specific residuals.", zap.String("split", s.Name), zap.Int("targets", len(m.Targets())))
+		return nil
+	}
+
+	required, err := platformResiduals(log, fc, s, m)
+	if err != nil {
+		return err
+	}
+
+	var rs []string
+	for r := range s.Residuals {
+		if len(required[r]) < len(m.Targets()) {
+			rs = append(rs, r)
+		}
+	}
+	sort.Strings(rs)
+	for _, r := range rs {
+		log.Info("Residual package is only required for some build targets.", zap.String("split", s.Name), zap.String("residual", r), zap.Strings("targets", required[r]))
 	}
 	return nil
 }
 
-func computeSplitResiduals(log *zap.Logger, fc filecache.FileCache, sp *config.Splits, s *config.Split) error {
+// maxReportedTargets is the number of build targets that fit in the bit set used by
+// platformResiduals.
+const maxReportedTargets = 64
+
+// platformResiduals determines for each of the split's residual packages the build targets for
+// which it is required. The split's import graph is traversed once, tracking for each file the bit
+// set of the build targets for which it is built and for which the file is reachable. A package is
+// revisited only when it becomes reachable for additional build targets.
+func platformResiduals(log *zap.Logger, fc filecache.FileCache, s *config.Split, m *platforms.Matcher) (map[string][]string, error) {
+	ts := m.Targets()
+
+	type entry struct {
+		file    string
+		targets uint64
+	}
+	var queue []entry
+	enqueue := func(fs map[string]bool, within uint64, tests bool) error {
+		for f := range fs {
+			if filepath.Ext(f) != ".go" || (!tests && isTestFile(f)) {
+				continue
+			}
+			var bits uint64
+			for i := range ts {
+				ok, err := m.MatchTarget(f, i)
+				if err != nil {
+					log.Error("Failed to evaluate build constraints.", zap.String("file", f), zap.Error(err))
+					return err
+				}
+				if ok {
+					bits |= 1 << uint(i)
+				}
+			}
+			if bits &= within; bits != 0 {
+				queue = append(queue, entry{file: f, targets: bits})
+			}
+		}
+		return nil
+	}
+
+	all := uint64(1)<<uint(len(ts)) - 1
+	if err := enqueue(s.Files, all, s.Tests.KeepsAllTests() || s.Tests == config.TestPolicySeparate); err != nil {
+		return nil, err
+	}
+
+	found := map[string]uint64{}
+	for len(queue) > 0 {
+		e := queue[0]
+		queue = queue[1:]
+
+		fa, _, err := fc.ReadGoFile(e.file, parser.ImportsOnly)
+		if err != nil {
+			return nil, err
+		}
+		for _, imp := range fa.Imports {
+			p := strings.Trim(imp.Path.Value, `"`)
+			if !s.Residuals[p] || found[p]|e.targets == found[p] {
+				continue
+			}
+			found[p] |= e.targets
+
+			fs, err := fc.FilesInPkg(p)
+			if err != nil {
+				return nil, err
+			}
+			if err = enqueue(fs, e.targets, s.Tests.KeepsAllTests()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	required := map[string][]string{}
+	for p, bits := range found {
+		for i, t := range ts {
+			if bits&(1<<uint(i)) != 0 {
+				required[p] = append(required[p], t.String())
+			}
+		}
+	}
+	return required, nil
+}
+
+func computeSplitResiduals(log *zap.Logger, fc filecache.FileCache, sp *config.Splits, s *config.Split, match func(string) (bool, error)) error {
 	log.Debug("Resolving split dependencies and residuals.", zap.String("split", s.Name))
 
-	r := &resolver{
-		log:   log,
-		fc:    fc,
-		sp:    sp,
-		s:     s,
-		limit: make(chan struct{}, runtime.NumCPU()),
+	r := newResolver(log, fc, sp, s, match, s.Tests.KeepsAllTests())
+	files, err := r.goFiles(s.Files)
+	if err != nil {
+		return err
 	}
 
-	var files []string
+	var tests []string
+	if !r.tests {
+		var code []string
+		for _, f := range files {
+			if isTestFile(f) {
+				tests = append(tests, f)
+			} else {
+				code = append(code, f)
+			}
+		}
+		files = code
+	}
+
+	if err = r.run(files); err != nil {
+		return err
+	}
+	if err = r.finalise(); err != nil {
+		return err
+	}
+	s.TestResiduals = map[string]bool{}
+
+	switch s.Tests {
+	case config.TestPolicyNone:
+		kept := map[string]bool{}
+		for f := range s.Files {
+			if !isTestFile(f) {
+				kept[f] = true
+			}
+		}
+		s.Files = kept
+	case config.TestPolicyPackage:
+		return filterPackageTests(log, fc, sp, s)
+	case config.TestPolicySeparate:
+		return resolveTestResiduals(log, fc, sp, s, match, tests)
+	}
+	return nil
+}
+
+// filterPackageTests removes all test files from the split that are either part of an external
+// '_test' package or that import packages that are neither part of a split nor a residual.
+func filterPackageTests(log *zap.Logger, fc filecache.FileCache, sp *config.Splits, s *config.Split) error {
+	files := map[string]bool{}
+	s.DroppedTests = map[string]bool{}
 	for f := range s.Files {
-		if filepath.Ext(f) == ".go" {
-			files = append(files, f)
+		if !isTestFile(f) {
+			files[f] = true
+			continue
+		}
+
+		fa, _, err := fc.ReadGoFile(f, parser.ImportsOnly)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(fa.Name.Name, "_test") {
+			log.Debug("Dropping test file of external test package.", zap.String("split", s.Name), zap.String("file", f))
+			s.DroppedTests[f] = true
+			continue
+		}
+
+		keep := true
+		deps := map[string]bool{}
+		for _, imp := range fa.Imports {
+			p := strings.Trim(imp.Path.Value, `"`)
+			if !fc.Pkgs()[p] || s.Residuals[p] {
+				continue
+			}
+			if ts := sp.PkgToSplit[p]; ts == "" {
+				log.Warn("Dropping test file that requires a test-only residual.", zap.String("split", s.Name), zap.String("file", f), zap.String("import", p))
+				keep = false
+				break
+			} else if ts != s.Name {
+				deps[ts] = true
+			}
+		}
+		if !keep {
+			s.DroppedTests[f] = true
+			continue
+		}
+		files[f] = true
+		for d := range deps {
+			s.SplitDeps[d] = true
 		}
 	}
-	r.enqueue(files...)
+	s.Files = files
+	return nil
+}
 
-	r.wait()
-	if r.err != nil {
-		return r.err
+// resolveTestResiduals computes the residual packages that are only required by the given test
+// files and adds them to the split's residuals, marking them as test residuals.
+func resolveTestResiduals(log *zap.Logger, fc filecache.FileCache, sp *config.Splits, s *config.Split, match func(string) (bool, error), tests []string) error {
+	r := newResolver(log, fc, sp, s, match, false)
+	for p := range s.Residuals {
+		r.residuals.Store(p, true)
+	}
+	for d := range s.SplitDeps {
+		r.splitDeps.Store(d, true)
+	}
+
+	if err := r.run(tests); err != nil {
+		return err
+	}
+	residuals := s.Residuals
+	if err := r.finalise(); err != nil {
+		return err
+	}
+
+	s.TestResiduals = map[string]bool{}
+	for p := range s.Residuals {
+		if !residuals[p] {
+			log.Debug("Test-only residual detected.", zap.String("split", s.Name), zap.String("residual", p))
+			s.TestResiduals[p] = true
+		}
 	}
+	return nil
+}
 
-	return r.finalise()
+func isTestFile(f string) bool {
+	return strings.HasSuffix(f, "_test.go")
 }
 
 type resolver struct {
-	log *zap.Logger
-	fc  filecache.FileCache
-	sp  *config.Splits
-	s   *config.Split
+	log   *zap.Logger
+	fc    filecache.FileCache
+	sp    *config.Splits
+	s     *config.Split
+	match func(string) (bool, error)
+	// Whether the test files of residual packages are taken into account.
+	tests bool
 
 	err       error
 	residuals sync.Map
@@ -65,6 +293,24 @@ type resolver struct {
 	limit chan struct{}
 }
 
+func newResolver(log *zap.Logger, fc filecache.FileCache, sp *config.Splits, s *config.Split, match func(string) (bool, error), tests bool) *resolver {
+	return &resolver{
+		log:   log,
+		fc:    fc,
+		sp:    sp,
+		s:     s,
+		match: match,
+		tests: tests,
+		limit: make(chan struct{}, runtime.NumCPU()),
+	}
+}
+
+func (r *resolver) run(files []string) error {
+	r.enqueue(files...)
+	r.wait()
+	return r.err
+}
+
 func (r *resolver) wait() {
 	r.wg.Wait()
 }
@@ -139,17 +385,50 @@ func (r *resolver) analyse() {
 				return
 			}
 
-			var files []string
-			for f := range pkgFiles {
-				if filepath.Ext(f) == ".go" {
-					files = append(files, f)
-				}
+			files, err := r.goFiles(r.filterTests(pkgFiles))
+			if err != nil {
+				r.err = err
+				return
 			}
 			r.enqueue(files...)
 		}
 	}
 }
 
+// goFiles returns the Go files of the given set that are included in the build for the resolver's
+// build targets.
+func (r *resolver) goFiles(fs map[string]bool) ([]string, error) {
+	var files []string
+	for f := range fs {
+		if filepath.Ext(f) != ".go" {
+			continue
+		}
+		if ok, err := r.match(f); err != nil {
+			r.log.Error("Failed to evaluate build constraints.", zap.String("file", f), zap.Error(err))
+			return nil, err
+		} else if !ok {
+			r.log.Debug("Skipping file excluded by build constraints.", zap.String("file", f))
+			continue
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// filterTests removes test files from the given set unless the resolver takes them into account.
+func (r *resolver) filterTests(fs map[string]bool) map[string]bool {
+	if r.tests {
+		return fs
+	}
+	filtered := map[string]bool{}
+	for f := range fs {
+		if !isTestFile(f) {
+			filtered[f] = true
+		}
+	}
+	return filtered
+}
+
 func (r *resolver) finalise() error {
 	r.s.SplitDeps = map[string]bool{}
 	r.splitDeps.Range(func(key interface{}, _ interface{}) bool {
@@ -170,7 +449,7 @@ func (r *resolver) finalise() error {
 		if err != nil {
 			return false
 		}
-		for f := range fs {
+		for f := range r.filterTests(fs) {
 			r.s.ResidualFiles[f] = true
 		}
 		return true
@@ -5,6 +5,7 @@ import (
 
 	"github.com/modularise/modularise/cmd/config"
 	"github.com/modularise/modularise/internal/filecache/testcache"
+	"github.com/modularise/modularise/internal/platforms"
 	"github.com/modularise/modularise/internal/splits"
 	"github.com/modularise/modularise/internal/testlib"
 )
@@ -115,6 +116,34 @@ func TestResolveImportsAndResiduals(t *testing.T) {
 				depSplitB: true,
 			},
 		},
+		"BuildConstraints": {
+			files: map[string]testcache.FakeFileCacheEntry{
+				"go.mod":              {Data: []byte("module example.com/repo\n")},
+				"file.go":             {Data: []byte("package repo\n\nimport \"example.com/repo/lib\"\n")},
+				"lib/file.go":         {Data: []byte("package lib\n")},
+				"lib/file_windows.go": {Data: []byte("package lib\n\nimport \"example.com/repo/win\"\n")},
+				"lib/file_plan9.go":   {Data: []byte("package lib\n\nimport \"example.com/repo/plan9\"\n")},
+				"lib/tool.go":         {Data: []byte("// +build ignore\n\npackage main\n\nimport \"example.com/repo/tool\"\n")},
+				"win/file.go":         {Data: []byte("package win\n")},
+				"plan9/file.go":       {Data: []byte("package plan9\n")},
+				"tool/file.go":        {Data: []byte("package tool\n")},
+			},
+			pkgToSplit: map[string]string{
+				"example.com/repo": depSplitA,
+			},
+			expectedResiduals: map[string]bool{
+				"example.com/repo/lib": true,
+				"example.com/repo/win": true,
+			},
+			expectedResidualFiles: map[string]bool{
+				"lib/file.go":         true,
+				"lib/file_windows.go": true,
+				"lib/file_plan9.go":   true,
+				"lib/tool.go":         true,
+				"win/file.go":         true,
+			},
+			expectedSplitDeps: map[string]bool{},
+		},
 	}
 
 	for n := range tcs {
@@ -131,7 +160,7 @@ func TestResolveImportsAndResiduals(t *testing.T) {
 				Files: map[string]bool{"file.go": true},
 			}}
 
-			err = computeSplitResiduals(testlib.NewTestLogger(), fc, sp, s)
+			err = computeSplitResiduals(testlib.NewTestLogger(), fc, sp, s, platforms.NewMatcher(fc, nil).Match)
 			testlib.NoError(t, true, err)
 			testlib.Equal(t, false, tc.expectedResidualFiles, s.ResidualFiles)
 			testlib.Equal(t, false, tc.expectedResiduals, s.Residuals)
@@ -139,3 +168,173 @@ func TestResolveImportsAndResiduals(t *testing.T) {
 		})
 	}
 }
+
+func TestTestPolicies(t *testing.T) {
+	t.Parallel()
+
+	fc, err := testcache.NewFakeFileCache("", map[string]testcache.FakeFileCacheEntry{
+		"go.mod":                {Data: []byte("module example.com/repo\n")},
+		"file.go":               {Data: []byte("package repo\n\nimport \"example.com/repo/lib\"\n")},
+		"file_test.go":          {Data: []byte("package repo\n\nimport \"example.com/repo/testutil\"\n")},
+		"self_test.go":          {Data: []byte("package repo\n\nimport \"example.com/repo/lib\"\n")},
+		"ext_test.go":           {Data: []byte("package repo_test\n\nimport (\n\t\"example.com/repo\"\n\t\"example.com/repo/b\"\n)\n")},
+		"lib/file.go":           {Data: []byte("package lib\n")},
+		"lib/file_test.go":      {Data: []byte("package lib\n\nimport \"example.com/repo/libtest\"\n")},
+		"libtest/file.go":       {Data: []byte("package libtest\n")},
+		"testutil/file.go":      {Data: []byte("package testutil\n")},
+		"testutil/file_test.go": {Data: []byte("package testutil\n")},
+		"b/file.go":             {Data: []byte("package b\n")},
+	})
+	testlib.NoError(t, true, err)
+
+	allFiles := map[string]bool{"file.go": true, "file_test.go": true, "self_test.go": true, "ext_test.go": true}
+
+	tcs := map[string]struct {
+		policy                config.TestPolicy
+		expectedFiles         map[string]bool
+		expectedDroppedTests  map[string]bool
+		expectedResiduals     map[string]bool
+		expectedResidualFiles map[string]bool
+		expectedTestResiduals map[string]bool
+		expectedSplitDeps     map[string]bool
+	}{
+		"All": {
+			policy:        config.TestPolicyAll,
+			expectedFiles: allFiles,
+			expectedResiduals: map[string]bool{
+				"example.com/repo/lib":      true,
+				"example.com/repo/libtest":  true,
+				"example.com/repo/testutil": true,
+			},
+			expectedResidualFiles: map[string]bool{
+				"lib/file.go":           true,
+				"lib/file_test.go":      true,
+				"libtest/file.go":       true,
+				"testutil/file.go":      true,
+				"testutil/file_test.go": true,
+			},
+			expectedTestResiduals: map[string]bool{},
+			expectedSplitDeps:     map[string]bool{"b": true},
+		},
+		"None": {
+			policy:                config.TestPolicyNone,
+			expectedFiles:         map[string]bool{"file.go": true},
+			expectedResiduals:     map[string]bool{"example.com/repo/lib": true},
+			expectedResidualFiles: map[string]bool{"lib/file.go": true},
+			expectedTestResiduals: map[string]bool{},
+			expectedSplitDeps:     map[string]bool{},
+		},
+		"Package": {
+			policy:                config.TestPolicyPackage,
+			expectedFiles:         map[string]bool{"file.go": true, "self_test.go": true},
+			expectedDroppedTests:  map[string]bool{"file_test.go": true, "ext_test.go": true},
+			expectedResiduals:     map[string]bool{"example.com/repo/lib": true},
+			expectedResidualFiles: map[string]bool{"lib/file.go": true},
+			expectedTestResiduals: map[string]bool{},
+			expectedSplitDeps:     map[string]bool{},
+		},
+		"Separate": {
+			policy:        config.TestPolicySeparate,
+			expectedFiles: allFiles,
+			expectedResiduals: map[string]bool{
+				"example.com/repo/lib":      true,
+				"example.com/repo/testutil": true,
+			},
+			expectedResidualFiles: map[string]bool{
+				"lib/file.go":      true,
+				"testutil/file.go": true,
+			},
+			expectedTestResiduals: map[string]bool{"example.com/repo/testutil": true},
+			expectedSplitDeps:     map[string]bool{"b": true},
+		},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			sp := &config.Splits{DataSplits: splits.DataSplits{PkgToSplit: map[string]string{
+				"example.com/repo":   "a",
+				"example.com/repo/b": "b",
+			}}}
+			s := &config.Split{Tests: tc.policy, DataSplit: splits.DataSplit{
+				Name:  "a",
+				Files: map[string]bool{"file.go": true, "file_test.go": true, "self_test.go": true, "ext_test.go": true},
+			}}
+
+			err := computeSplitResiduals(testlib.NewTestLogger(), fc, sp, s, platforms.NewMatcher(fc, nil).Match)
+			testlib.NoError(t, true, err)
+			testlib.Equal(t, false, tc.expectedFiles, s.Files)
+			testlib.Equal(t, false, tc.expectedDroppedTests, s.DroppedTests)
+			testlib.Equal(t, false, tc.expectedResiduals, s.Residuals)
+			testlib.Equal(t, false, tc.expectedResidualFiles, s.ResidualFiles)
+			testlib.Equal(t, false, tc.expectedTestResiduals, s.TestResiduals)
+			testlib.Equal(t, false, tc.expectedSplitDeps, s.SplitDeps)
+		})
+	}
+}
+
+func TestPlatformResiduals(t *testing.T) {
+	t.Parallel()
+
+	fc, err := testcache.NewFakeFileCache("", map[string]testcache.FakeFileCacheEntry{
+		"go.mod":               {Data: []byte("module example.com/repo\n")},
+		"file.go":              {Data: []byte("package repo\n\nimport \"example.com/repo/lib\"\n")},
+		"file_test.go":         {Data: []byte("package repo\n\nimport \"example.com/repo/testutil\"\n")},
+		"lib/file.go":          {Data: []byte("package lib\n\nimport \"example.com/repo/util\"\n")},
+		"lib/file_windows.go":  {Data: []byte("package lib\n\nimport \"example.com/repo/win\"\n")},
+		"util/file.go":         {Data: []byte("package util\n")},
+		"util/file_linux.go":   {Data: []byte("package util\n\nimport \"example.com/repo/unix\"\n")},
+		"win/file.go":          {Data: []byte("package win\n\nimport \"example.com/repo/unix\"\n")},
+		"unix/file.go":         {Data: []byte("package unix\n")},
+		"testutil/file.go":     {Data: []byte("package testutil\n")},
+		"testutil/file_arm.go": {Data: []byte("package testutil\n")},
+	})
+	testlib.NoError(t, true, err)
+
+	m := platforms.NewMatcher(fc, []config.BuildTarget{{GOOS: "linux", GOARCH: "amd64"}, {GOOS: "windows", GOARCH: "amd64"}})
+
+	tcs := map[string]struct {
+		policy   config.TestPolicy
+		expected map[string][]string
+	}{
+		"All": {
+			policy: config.TestPolicyAll,
+			expected: map[string][]string{
+				"example.com/repo/lib":      {"linux/amd64", "windows/amd64"},
+				"example.com/repo/util":     {"linux/amd64", "windows/amd64"},
+				"example.com/repo/win":      {"windows/amd64"},
+				"example.com/repo/unix":     {"linux/amd64", "windows/amd64"},
+				"example.com/repo/testutil": {"linux/amd64", "windows/amd64"},
+			},
+		},
+		"None": {
+			policy: config.TestPolicyNone,
+			expected: map[string][]string{
+				"example.com/repo/lib":  {"linux/amd64", "windows/amd64"},
+				"example.com/repo/util": {"linux/amd64", "windows/amd64"},
+				"example.com/repo/win":  {"windows/amd64"},
+				"example.com/repo/unix": {"linux/amd64", "windows/amd64"},
+			},
+		},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			sp := &config.Splits{DataSplits: splits.DataSplits{PkgToSplit: map[string]string{"example.com/repo": "a"}}}
+			s := &config.Split{Tests: tc.policy, DataSplit: splits.DataSplit{
+				Name:  "a",
+				Files: map[string]bool{"file.go": true, "file_test.go": true},
+			}}
+			testlib.NoError(t, true, computeSplitResiduals(testlib.NewTestLogger(), fc, sp, s, m.Match))
+
+			required, err := platformResiduals(testlib.NewTestLogger(), fc, s, m)
+			testlib.NoError(t, true, err)
+			testlib.Equal(t, false, tc.expected, required)
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package residuals
+
+import (
+	"errors"
+	"fmt"
+	"go/parser"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/modularise/modularise/cmd/config"
+	"github.com/modularise/modularise/internal/filecache"
+)
+
+const embedDirective = "//go:embed"
+
+// resolveEmbeds adds the files that are embedded via '//go:embed' directives in the Go files of a
+// split to the split's files and those embedded by residual packages to its residual files. Each
+// embedded file is recorded in the split's EmbedFiles together with the directory of the embedding
+// package so that both can be relocated consistently. An error is returned for embedded files that
+// would escape the split, i.e. that are part of another split or, for residual packages, of any
+// split.
+func resolveEmbeds(log *zap.Logger, fc filecache.FileCache, sp *config.Splits, s *config.Split, match func(string) (bool, error)) error {
+	s.EmbedFiles = map[string]string{}
+
+	for _, residual := range []bool{false, true} {
+		fs := s.Files
+		if residual {
+			fs = s.ResidualFiles
+		}
+		var files []string
+		for f := range fs {
+			if filepath.Ext(f) == ".go" {
+				files = append(files, f)
+			}
+		}
+		sort.Strings(files)
+
+		for _, f := range files {
+			if ok, err := match(f); err != nil {
+				log.Error("Failed to evaluate build constraints.", zap.String("file", f), zap.Error(err))
+				return err
+			} else if !ok {
+				continue
+			}
+
+			patterns, err := embedPatterns(log, fc, f)
+			if err != nil {
+				return err
+			}
+			for _, p := range patterns {
+				embedded, err := matchEmbedPattern(fc, filepath.Dir(f), p)
+				if err != nil {
+					log.Error("Invalid embed pattern.", zap.String("file", f), zap.Error(err))
+					return err
+				}
+				if len(embedded) == 0 {
+					log.Warn("Embed pattern does not match any file.", zap.String("file", f), zap.String("pattern", p))
+					continue
+				}
+				for _, e := range embedded {
+					if err = addEmbedFile(log, sp, s, filepath.Dir(f), e, residual); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func addEmbedFile(log *zap.Logger, sp *config.Splits, s *config.Split, dir string, f string, residual bool) error {
+	for _, ts := range sp.Splits {
+		if !ts.Files[f] || (ts.Name == s.Name && !residual) {
+			continue
+		}
+		log.Error(
+			"Embedded file escapes the split as it is part of another split.",
+			zap.String("split", s.Name),
+			zap.String("file", f),
+			zap.String("embedded-by", dir),
+			zap.String("part-of", ts.Name),
+		)
+		return fmt.Errorf("file %q embedded by %q in split %q is part of split %q", f, dir, s.Name, ts.Name)
+	}
+
+	s.EmbedFiles[f] = dir
+	if residual {
+		s.ResidualFiles[f] = true
+	} else if !s.Files[f] {
+		log.Info("Adding embedded file to split.", zap.String("split", s.Name), zap.String("file", f), zap.String("embedded-by", dir))
+		s.Files[f] = true
+	}
+	return nil
+}
+
+// embedPatterns returns the patterns of all '//go:embed' directives in the given Go file.
+func embedPatterns(log *zap.Logger, fc filecache.FileCache, f string) ([]string, error) {
+	fa, _, err := fc.ReadGoFile(f, parser.ImportsOnly)
+	if err != nil {
+		return nil, err
+	}
+	var usesEmbed bool
+	for _, imp := range fa.Imports {
+		if strings.Trim(imp.Path.Value, "\"`") == "embed" {
+			usesEmbed = true
+		}
+	}
+	if !usesEmbed {
+		return nil, nil
+	}
+
+	if fa, _, err = fc.ReadGoFile(f, parser.ParseComments); err != nil {
+		return nil, err
+	}
+	var patterns []string
+	for _, cg := range fa.Comments {
+		for _, c := range cg.List {
+			if !strings.HasPrefix(c.Text, embedDirective+" ") && !strings.HasPrefix(c.Text, embedDirective+"\t") {
+				continue
+			}
+			ps, err := parseEmbedArgs(strings.TrimPrefix(c.Text, embedDirective))
+			if err != nil {
+				log.Error("Failed to parse embed directive.", zap.String("file", f), zap.String("directive", c.Text), zap.Error(err))
+				return nil, err
+			}
+			patterns = append(patterns, ps...)
+		}
+	}
+	return patterns, nil
+}
+
+// parseEmbedArgs splits the arguments of an embed directive into patterns, which are separated by
+// whitespace and may be quoted as Go string literals.
+func parseEmbedArgs(args string) ([]string, error) {
+	var patterns []string
+	for args = strings.TrimSpace(args); args != ""; args = strings.TrimSpace(args) {
+		var p string
+		switch args[0] {
+		case '`':
+			i := strings.IndexByte(args[1:], '`')
+			if i < 0 {
+				return nil, fmt.Errorf("unterminated quoted pattern in %q", args)
+			}
+			p, args = args[1:i+1], args[i+2:]
+		case '"':
+			i := 1
+			for ; i < len(args) && args[i] != '"'; i++ {
+				if args[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(args) {
+				return nil, fmt.Errorf("unterminated quoted pattern in %q", args)
+			}
+			var err error
+			if p, err = strconv.Unquote(args[:i+1]); err != nil {
+				return nil, fmt.Errorf("invalid quoted pattern %s: %v", args[:i+1], err)
+			}
+			args = args[i+1:]
+		default:
+			i := strings.IndexAny(args, " \t")
+			if i < 0 {
+				i = len(args)
+			}
+			p, args = args[:i], args[i:]
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// matchEmbedPattern returns the files matched by an embed pattern of a package in the given
+// directory following the semantics of the 'embed' package: a pattern matching a directory embeds
+// all files below it except for those with a path element starting with '.' or '_', unless the
+// pattern is prefixed with 'all:'.
+func matchEmbedPattern(fc filecache.FileCache, dir string, pattern string) ([]string, error) {
+	p := strings.TrimPrefix(pattern, "all:")
+	all := p != pattern
+	if err := validateEmbedPattern(p); err != nil {
+		return nil, err
+	}
+
+	prefix := ""
+	if dir != "." {
+		prefix = filepath.ToSlash(dir) + "/"
+	}
+
+	var matched []string
+	for f := range fc.Files() {
+		sf := filepath.ToSlash(f)
+		if !strings.HasPrefix(sf, prefix) {
+			continue
+		}
+		elems := strings.Split(strings.TrimPrefix(sf, prefix), "/")
+		for i := range elems {
+			if ok, _ := path.Match(p, strings.Join(elems[:i+1], "/")); !ok {
+				continue
+			}
+			if all || !hasHiddenElement(elems[i+1:]) {
+				matched = append(matched, f)
+			}
+			break
+		}
+	}
+	sort.Strings(matched)
+	return matched, nil
+}
+
+func validateEmbedPattern(p string) error {
+	if _, err := path.Match(p, ""); err != nil {
+		return fmt.Errorf("invalid embed pattern %q: %v", p, err)
+	}
+	if p == "" {
+		return errors.New("empty embed pattern")
+	}
+	for _, e := range strings.Split(p, "/") {
+		if e == "" || e == "." || e == ".." {
+			return fmt.Errorf("invalid embed pattern %q: patterns must be relative paths within the package's directory", p)
+		}
+	}
+	return nil
+}
+
+func hasHiddenElement(elems []string) bool {
+	for _, e := range elems {
+		if strings.HasPrefix(e, ".") || strings.HasPrefix(e, "_") {
+			return true
+		}
+	}
+	return false
+}
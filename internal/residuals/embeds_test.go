@@ -0,0 +1,171 @@
+package residuals
+
+import (
+	"testing"
+
+	"github.com/modularise/modularise/cmd/config"
+	"github.com/modularise/modularise/internal/filecache/testcache"
+	"github.com/modularise/modularise/internal/platforms"
+	"github.com/modularise/modularise/internal/splits"
+	"github.com/modularise/modularise/internal/testlib"
+)
+
+func TestResolveEmbeds(t *testing.T) {
+	t.Parallel()
+
+	embedFile := func(pkg string, patterns string) testcache.FakeFileCacheEntry {
+		return testcache.FakeFileCacheEntry{Data: []byte("package " + pkg + "\n\nimport _ \"embed\"\n\n//go:embed " + patterns + "\nvar content string\n")}
+	}
+
+	tcs := map[string]struct {
+		files                 map[string]testcache.FakeFileCacheEntry
+		residualFiles         map[string]bool
+		expectedFiles         map[string]bool
+		expectedResidualFiles map[string]bool
+		expectedEmbedFiles    map[string]string
+		err                   bool
+	}{
+		"NoEmbeds": {
+			files: map[string]testcache.FakeFileCacheEntry{
+				"lib/file.go": {Data: []byte("package lib\n\n//go:embed static\nvar content string\n")},
+				"lib/static":  {Data: []byte("static")},
+			},
+			expectedFiles:         map[string]bool{"lib/file.go": true},
+			expectedResidualFiles: map[string]bool{},
+			expectedEmbedFiles:    map[string]string{},
+		},
+		"Directory": {
+			files: map[string]testcache.FakeFileCacheEntry{
+				"lib/file.go":             embedFile("lib", "static"),
+				"lib/static/a.txt":        {Data: []byte("a")},
+				"lib/static/.hidden":      {Data: []byte("hidden")},
+				"lib/static/_sub/b.txt":   {Data: []byte("b")},
+				"lib/static/sub/c.txt":    {Data: []byte("c")},
+				"lib/static-other/d.txt":  {Data: []byte("d")},
+				"lib/testdata/golden.txt": {Data: []byte("golden")},
+			},
+			expectedFiles: map[string]bool{
+				"lib/file.go":          true,
+				"lib/static/a.txt":     true,
+				"lib/static/sub/c.txt": true,
+			},
+			expectedResidualFiles: map[string]bool{},
+			expectedEmbedFiles: map[string]string{
+				"lib/static/a.txt":     "lib",
+				"lib/static/sub/c.txt": "lib",
+			},
+		},
+		"AllPrefixAndQuotedPatterns": {
+			files: map[string]testcache.FakeFileCacheEntry{
+				"lib/file.go":                  embedFile("lib", "all:static \"testdata/golden file.txt\" `*.tmpl`"),
+				"lib/static/.hidden":           {Data: []byte("hidden")},
+				"lib/testdata/golden file.txt": {Data: []byte("golden")},
+				"lib/index.tmpl":               {Data: []byte("index")},
+			},
+			expectedFiles: map[string]bool{
+				"lib/file.go":                  true,
+				"lib/static/.hidden":           true,
+				"lib/testdata/golden file.txt": true,
+				"lib/index.tmpl":               true,
+			},
+			expectedResidualFiles: map[string]bool{},
+			expectedEmbedFiles: map[string]string{
+				"lib/static/.hidden":           "lib",
+				"lib/testdata/golden file.txt": "lib",
+				"lib/index.tmpl":               "lib",
+			},
+		},
+		"Residual": {
+			files: map[string]testcache.FakeFileCacheEntry{
+				"lib/file.go":            {Data: []byte("package lib\n")},
+				"res/file.go":            embedFile("res", "testdata/*.json"),
+				"res/testdata/data.json": {Data: []byte("{}")},
+			},
+			residualFiles:         map[string]bool{"res/file.go": true},
+			expectedFiles:         map[string]bool{"lib/file.go": true},
+			expectedResidualFiles: map[string]bool{"res/file.go": true, "res/testdata/data.json": true},
+			expectedEmbedFiles:    map[string]string{"res/testdata/data.json": "res"},
+		},
+		"EscapesToOtherSplit": {
+			files: map[string]testcache.FakeFileCacheEntry{
+				"lib/file.go":      embedFile("lib", "other/*"),
+				"lib/other/a.txt":  {Data: []byte("a")},
+				"lib/other/doc.go": {Data: []byte("package other\n")},
+			},
+			err: true,
+		},
+		"InvalidPattern": {
+			files: map[string]testcache.FakeFileCacheEntry{
+				"lib/file.go":  embedFile("lib", "../static"),
+				"static/a.txt": {Data: []byte("a")},
+			},
+			err: true,
+		},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			tc.files["go.mod"] = testcache.FakeFileCacheEntry{Data: []byte("module example.com/repo\n")}
+			fc, err := testcache.NewFakeFileCache("", tc.files)
+			testlib.NoError(t, true, err)
+
+			s := &config.Split{DataSplit: splits.DataSplit{
+				Name:          "lib",
+				Files:         map[string]bool{"lib/file.go": true},
+				ResidualFiles: map[string]bool{},
+			}}
+			for f := range tc.residualFiles {
+				s.ResidualFiles[f] = true
+			}
+			other := &config.Split{DataSplit: splits.DataSplit{
+				Name:  "other",
+				Files: map[string]bool{"lib/other/a.txt": true, "lib/other/doc.go": true},
+			}}
+			sp := &config.Splits{Splits: map[string]*config.Split{"lib": s, "other": other}}
+
+			err = resolveEmbeds(testlib.NewTestLogger(), fc, sp, s, platforms.NewMatcher(fc, nil).Match)
+			if tc.err {
+				testlib.Error(t, true, err)
+				return
+			}
+			testlib.NoError(t, true, err)
+			testlib.Equal(t, false, tc.expectedFiles, s.Files)
+			testlib.Equal(t, false, tc.expectedResidualFiles, s.ResidualFiles)
+			testlib.Equal(t, false, tc.expectedEmbedFiles, s.EmbedFiles)
+		})
+	}
+}
+
+func TestParseEmbedArgs(t *testing.T) {
+	t.Parallel()
+
+	tcs := map[string]struct {
+		args     string
+		expected []string
+		err      bool
+	}{
+		"Single":       {args: " static", expected: []string{"static"}},
+		"Several":      {args: "\ta.txt  b/*.txt\t", expected: []string{"a.txt", "b/*.txt"}},
+		"DoubleQuoted": {args: ` "with space.txt" "esc\"aped"`, expected: []string{"with space.txt", `esc"aped`}},
+		"BackQuoted":   {args: " `with space.txt` plain", expected: []string{"with space.txt", "plain"}},
+		"Unterminated": {args: ` "static`, err: true},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			ps, err := parseEmbedArgs(tc.args)
+			if tc.err {
+				testlib.Error(t, true, err)
+				return
+			}
+			testlib.NoError(t, true, err)
+			testlib.Equal(t, false, tc.expected, ps)
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package residuals
+
+import (
+	"sort"
+
+	"go.uber.org/zap"
+
+	"github.com/modularise/modularise/cmd/config"
+	"github.com/modularise/modularise/internal/filecache"
+	"github.com/modularise/modularise/internal/platforms"
+)
+
+// ReportSharedResiduals reports the residual packages of which several splits have their own copy.
+// Types from such packages are incompatible across the splits that contain them. For each shared
+// residual package that is not already covered by the promotion of another one a suggestion is made
+// to promote it into a dedicated split, together with the impact that this has on the dependencies
+// between splits.
+//
+// The prequisites on the fields of a config.Splits object for ReportSharedResiduals to be able to
+// operate are:
+//   - PkgToSplit has been populated.
+//   - For each config.Split in Splits the Name, Residuals and SplitDeps fields have been populated.
+func ReportSharedResiduals(log *zap.Logger, fc filecache.FileCache, sp *config.Splits) error {
+	shared, err := findSharedResiduals(fc, sp)
+	if err != nil {
+		return err
+	}
+	if len(shared) == 0 {
+		log.Info("No residual packages are shared across splits.")
+		return nil
+	}
+
+	log.Warn("Some residual packages are copied into several splits. Their types are incompatible across these splits.")
+	for _, s := range shared {
+		log.Warn(
+			"Shared residual package.",
+			zap.String("package", s.Pkg),
+			zap.Strings("splits", s.Consumers),
+			zap.Int("files", s.Files),
+			zap.Int("bytes", s.Size),
+		)
+	}
+
+	ps, err := promotionCandidates(log, fc, sp, shared)
+	if err != nil {
+		return err
+	}
+	for _, p := range ps {
+		log.Info(
+			"Consider promoting the shared residual package into a dedicated split.",
+			zap.String("package", p.Pkg),
+			zap.Strings("including", p.Includes),
+			zap.Strings("dependent-splits", p.Consumers),
+			zap.Strings("split-dependencies", p.Deps),
+		)
+		if len(p.Cycles) > 0 {
+			log.Warn(
+				"Promoting the package on its own would create a dependency cycle with some splits. Their content that it depends on would need to be promoted as well.",
+				zap.String("package", p.Pkg),
+				zap.Strings("splits", p.Cycles),
+			)
+		}
+	}
+	return nil
+}
+
+type sharedResidual struct {
+	Pkg       string
+	Consumers []string
+	Files     int
+	Size      int
+}
+
+// findSharedResiduals returns the residual packages that are part of more than one split, sorted by
+// decreasing number of consumers and size.
+func findSharedResiduals(fc filecache.FileCache, sp *config.Splits) ([]sharedResidual, error) {
+	consumers := map[string][]string{}
+	for n, s := range sp.Splits {
+		for r := range s.Residuals {
+			consumers[r] = append(consumers[r], n)
+		}
+	}
+
+	var shared []sharedResidual
+	for pkg, cs := range consumers {
+		if len(cs) < 2 {
+			continue
+		}
+		sort.Strings(cs)
+
+		fs, err := fc.FilesInPkg(pkg)
+		if err != nil {
+			return nil, err
+		}
+		sr := sharedResidual{Pkg: pkg, Consumers: cs, Files: len(fs)}
+		for f := range fs {
+			b, err := fc.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			sr.Size += len(b)
+		}
+		shared = append(shared, sr)
+	}
+
+	sort.Slice(shared, func(i, j int) bool {
+		if len(shared[i].Consumers) != len(shared[j].Consumers) {
+			return len(shared[i].Consumers) > len(shared[j].Consumers)
+		} else if shared[i].Size != shared[j].Size {
+			return shared[i].Size > shared[j].Size
+		}
+		return shared[i].Pkg < shared[j].Pkg
+	})
+	return shared, nil
+}
+
+type promotion struct {
+	Pkg string
+	// Other residual packages that would be part of the promoted split.
+	Includes []string
+	// Splits that would depend on the promoted split.
+	Consumers []string
+	// Splits on which the promoted split would depend.
+	Deps []string
+	// Splits that would be part of a dependency cycle with the promoted split.
+	Cycles []string
+}
+
+func promotionCandidates(log *zap.Logger, fc filecache.FileCache, sp *config.Splits, shared []sharedResidual) ([]promotion, error) {
+	m := platforms.NewMatcher(fc, sp.BuildTargets)
+	ps := make([]promotion, 0, len(shared))
+	closures := map[string]map[string]bool{}
+	for _, s := range shared {
+		fs, err := fc.FilesInPkg(s.Pkg)
+		if err != nil {
+			return nil, err
+		}
+		// Compute the content and dependencies of the hypothetical split by resolving its residuals.
+		ns := &config.Split{}
+		ns.Name = "promoted " + s.Pkg
+		ns.Files = fs
+		if err = computeSplitResiduals(log, fc, sp, ns, m.Match); err != nil {
+			return nil, err
+		}
+		closures[s.Pkg] = ns.Residuals
+
+		p := promotion{Pkg: s.Pkg, Consumers: s.Consumers}
+		for r := range ns.Residuals {
+			p.Includes = append(p.Includes, r)
+		}
+		sort.Strings(p.Includes)
+		for d := range ns.SplitDeps {
+			p.Deps = append(p.Deps, d)
+		}
+		sort.Strings(p.Deps)
+
+		reachable := map[string]bool{}
+		for _, d := range p.Deps {
+			reachableSplits(sp, d, reachable)
+		}
+		for _, c := range s.Consumers {
+			if reachable[c] {
+				p.Cycles = append(p.Cycles, c)
+			}
+		}
+		ps = append(ps, p)
+	}
+
+	// Omit candidates that would already be promoted as part of another candidate that is shared by
+	// at least the same splits.
+	var res []promotion
+	for _, p := range ps {
+		var covered bool
+		for _, o := range ps {
+			if o.Pkg != p.Pkg && closures[o.Pkg][p.Pkg] && isSubset(p.Consumers, o.Consumers) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			res = append(res, p)
+		}
+	}
+	return res, nil
+}
+
+func reachableSplits(sp *config.Splits, name string, seen map[string]bool) {
+	if seen[name] {
+		return
+	}
+	seen[name] = true
+	for d := range sp.Splits[name].SplitDeps {
+		reachableSplits(sp, d, seen)
+	}
+}
+
+func isSubset(a []string, b []string) bool {
+	m := map[string]bool{}
+	for _, e := range b {
+		m[e] = true
+	}
+	for _, e := range a {
+		if !m[e] {
+			return false
+		}
+	}
+	return true
+}
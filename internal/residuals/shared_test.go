@@ -0,0 +1,122 @@
+package residuals
+
+import (
+	"testing"
+
+	"github.com/modularise/modularise/cmd/config"
+	"github.com/modularise/modularise/internal/filecache/testcache"
+	"github.com/modularise/modularise/internal/splits"
+	"github.com/modularise/modularise/internal/testlib"
+)
+
+func TestSharedResiduals(t *testing.T) {
+	t.Parallel()
+
+	tcs := map[string]struct {
+		files              map[string]testcache.FakeFileCacheEntry
+		pkgToSplit         map[string]string
+		expectedShared     map[string][]string
+		expectedPromotions []promotion
+	}{
+		"NoSharedResiduals": {
+			files: map[string]testcache.FakeFileCacheEntry{
+				"go.mod":      {Data: []byte("module example.com/repo\n")},
+				"a/a.go":      {Data: []byte("package a\n\nimport \"example.com/repo/util\"\n")},
+				"b/b.go":      {Data: []byte("package b\n")},
+				"util/lib.go": {Data: []byte("package util\n")},
+			},
+			pkgToSplit:     map[string]string{"example.com/repo/a": "a", "example.com/repo/b": "b"},
+			expectedShared: map[string][]string{},
+		},
+		"SharedResiduals": {
+			files: map[string]testcache.FakeFileCacheEntry{
+				"go.mod":           {Data: []byte("module example.com/repo\n")},
+				"a/a.go":           {Data: []byte("package a\n\nimport \"example.com/repo/util\"\n")},
+				"b/b.go":           {Data: []byte("package b\n\nimport \"example.com/repo/util\"\n")},
+				"util/lib.go":      {Data: []byte("package util\n\nimport \"example.com/repo/util/strs\"\n")},
+				"util/strs/lib.go": {Data: []byte("package strs\n")},
+			},
+			pkgToSplit: map[string]string{"example.com/repo/a": "a", "example.com/repo/b": "b"},
+			expectedShared: map[string][]string{
+				"example.com/repo/util":      {"a", "b"},
+				"example.com/repo/util/strs": {"a", "b"},
+			},
+			expectedPromotions: []promotion{
+				{Pkg: "example.com/repo/util", Includes: []string{"example.com/repo/util/strs"}, Consumers: []string{"a", "b"}},
+			},
+		},
+		"PartiallyCoveredResiduals": {
+			files: map[string]testcache.FakeFileCacheEntry{
+				"go.mod":           {Data: []byte("module example.com/repo\n")},
+				"a/a.go":           {Data: []byte("package a\n\nimport \"example.com/repo/util\"\n")},
+				"b/b.go":           {Data: []byte("package b\n\nimport \"example.com/repo/util\"\n")},
+				"c/c.go":           {Data: []byte("package c\n\nimport \"example.com/repo/util/strs\"\n")},
+				"util/lib.go":      {Data: []byte("package util\n\nimport \"example.com/repo/util/strs\"\n")},
+				"util/strs/lib.go": {Data: []byte("package strs\n")},
+			},
+			pkgToSplit: map[string]string{"example.com/repo/a": "a", "example.com/repo/b": "b", "example.com/repo/c": "c"},
+			expectedShared: map[string][]string{
+				"example.com/repo/util":      {"a", "b"},
+				"example.com/repo/util/strs": {"a", "b", "c"},
+			},
+			expectedPromotions: []promotion{
+				{Pkg: "example.com/repo/util/strs", Consumers: []string{"a", "b", "c"}},
+				{Pkg: "example.com/repo/util", Includes: []string{"example.com/repo/util/strs"}, Consumers: []string{"a", "b"}},
+			},
+		},
+		"PromotionCycle": {
+			files: map[string]testcache.FakeFileCacheEntry{
+				"go.mod":      {Data: []byte("module example.com/repo\n")},
+				"a/a.go":      {Data: []byte("package a\n\nimport \"example.com/repo/util\"\n")},
+				"b/b.go":      {Data: []byte("package b\n\nimport \"example.com/repo/util\"\n")},
+				"c/c.go":      {Data: []byte("package c\n\nimport \"example.com/repo/a\"\n")},
+				"util/lib.go": {Data: []byte("package util\n\nimport \"example.com/repo/c\"\n")},
+			},
+			pkgToSplit: map[string]string{"example.com/repo/a": "a", "example.com/repo/b": "b", "example.com/repo/c": "c"},
+			expectedShared: map[string][]string{
+				"example.com/repo/util": {"a", "b"},
+			},
+			expectedPromotions: []promotion{
+				{Pkg: "example.com/repo/util", Consumers: []string{"a", "b"}, Deps: []string{"c"}, Cycles: []string{"a"}},
+			},
+		},
+	}
+
+	for n := range tcs {
+		tc := tcs[n]
+		t.Run(n, func(t *testing.T) {
+			t.Parallel()
+
+			fc, err := testcache.NewFakeFileCache("invalid-root", tc.files)
+			testlib.NoError(t, true, err)
+
+			sp := &config.Splits{
+				Splits:     map[string]*config.Split{},
+				DataSplits: splits.DataSplits{PkgToSplit: tc.pkgToSplit},
+			}
+			for pkg, sn := range tc.pkgToSplit {
+				fs, err := fc.FilesInPkg(pkg)
+				testlib.NoError(t, true, err)
+				sp.Splits[sn] = &config.Split{DataSplit: splits.DataSplit{Name: sn, Files: fs}}
+			}
+
+			l := testlib.NewTestLogger()
+			testlib.NoError(t, true, ComputeResiduals(l, fc, sp))
+
+			shared, err := findSharedResiduals(fc, sp)
+			testlib.NoError(t, true, err)
+			found := map[string][]string{}
+			for _, s := range shared {
+				found[s.Pkg] = s.Consumers
+				testlib.True(t, false, s.Files > 0)
+			}
+			testlib.Equal(t, false, tc.expectedShared, found)
+
+			ps, err := promotionCandidates(l, fc, sp, shared)
+			testlib.NoError(t, true, err)
+			testlib.Equal(t, false, tc.expectedPromotions, ps)
+
+			testlib.NoError(t, false, ReportSharedResiduals(l, fc, sp))
+		})
+	}
+}
@@ -13,6 +13,7 @@ import (
 
 	"github.com/modularise/modularise/cmd/config"
 	"github.com/modularise/modularise/internal/filecache"
+	"github.com/modularise/modularise/internal/platforms"
 )
 
 // AnalyseAPI iterates over the configured splits and performs the residuals analysis for each one
@@ -24,9 +25,10 @@ import (
 //  - For each config.Split in Splits the Name and Files fields have been populated.
 func AnalyseAPI(log *zap.Logger, fc filecache.FileCache, sp *config.Splits) error {
 	a := analyser{
-		log: log,
-		fc:  fc,
-		sp:  sp,
+		log:     log,
+		fc:      fc,
+		sp:      sp,
+		matcher: platforms.NewMatcher(fc, sp.BuildTargets),
 	}
 
 	var fail bool
@@ -63,9 +65,10 @@ func AnalyseAPI(log *zap.Logger, fc filecache.FileCache, sp *config.Splits) erro
 }
 
 type analyser struct {
-	log *zap.Logger
-	fc  filecache.FileCache
-	sp  *config.Splits
+	log     *zap.Logger
+	fc      filecache.FileCache
+	sp      *config.Splits
+	matcher *platforms.Matcher
 }
 
 type analysis struct {
@@ -84,6 +87,19 @@ func (az *analyser) analyseSplitAPI(a *analysis) ([]residualError, error) {
 			az.log.Debug("Skipping analysis of non-Go file.", zap.String("file", f))
 			continue
 		}
+		// Test files do not contribute to the API of a split. Whether they are retained at all is
+		// determined by the split's test policy.
+		if filepath.Base(f) == "test.go" || strings.HasSuffix(f, "_test.go") {
+			az.log.Debug("Skipping API analysis of test file.", zap.String("file", f))
+			continue
+		}
+		if ok, err := az.matcher.Match(f); err != nil {
+			az.log.Error("Failed to evaluate build constraints.", zap.String("file", f), zap.Error(err))
+			return nil, err
+		} else if !ok {
+			az.log.Debug("Skipping analysis of file excluded by build constraints.", zap.String("file", f))
+			continue
+		}
 		az.log.Debug("Analysing file for residuals.", zap.String("file", f))
 
 		fa, fs, err := az.fc.ReadGoFile(f, parser.AllErrors)
@@ -101,10 +117,7 @@ func (az *analyser) analyseSplitAPI(a *analysis) ([]residualError, error) {
 			}
 			a.imports[n] = p
 		}
-
-		if filepath.Base(f) != "test.go" && !strings.HasSuffix(f, "_test.go") {
-			analysisErrs = append(analysisErrs, az.analyseFile(a, fa)...)
-		}
+		analysisErrs = append(analysisErrs, az.analyseFile(a, fa)...)
 	}
 	return analysisErrs, nil
 }
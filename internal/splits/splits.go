@@ -2,6 +2,7 @@ package splits
 
 import (
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
 )
 
 // DataSplits contains information that is not part of the configuration of the splits but which is
@@ -15,6 +16,17 @@ type DataSplits struct {
 	PkgToSplit map[string]string
 	// Directory under which all split work will be done and stored.
 	WorkTree string
+	// Directory in which bare mirrors of split repositories are persisted across runs. If empty split
+	// repositories are cloned from their remotes directly.
+	MirrorDirectory string
+	// Name of the source project's branch for which splits are generated. If empty it is detected
+	// from the source project's git repository.
+	SourceBranch string
+	// Indicates whether commits made directly to split repositories may be overwritten.
+	OverwriteManualChanges bool
+	// Git repository containing the source project. It is opened once and shared between all steps
+	// that require it.
+	SourceRepo *git.Repository
 }
 
 // splitData contains information that is not part of the configuration of a split but which is
@@ -32,6 +44,13 @@ type DataSplit struct {
 	Residuals map[string]bool
 	// Set of the paths of all files that are part of any residuals of the split.
 	ResidualFiles map[string]bool
+	// Subset of Residuals containing the packages that are only imported by the split's tests.
+	TestResiduals map[string]bool
+	// Set of the paths of the split's test files that were dropped by the 'package' test policy.
+	DroppedTests map[string]bool
+	// Files embedded via '//go:embed' directives by the split's or its residuals' Go files, mapped
+	// to the directory of the embedding package. These are also part of Files or ResidualFiles.
+	EmbedFiles map[string]string
 	// New virtual root relative to the root of the source module for packages part of the split's module.
 	Root string
 	// New virtual root relative to the root of the source module for residual packages of the split's module.
@@ -44,4 +63,7 @@ type DataSplit struct {
 	WorkDir string
 	// Git repository stored inside WorkDir.
 	Repo *git.Repository
+	// Hash of the head of the split's branch on its remote as observed when the repository was
+	// cloned. A zero hash indicates that the branch did not exist on the remote.
+	RemoteHead plumbing.Hash
 }
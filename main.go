@@ -24,6 +24,7 @@ func main() {
 	root.AddCommand(
 		checkCmd(&c),
 		splitCmd(&c),
+		applyBundlesCmd(&c),
 	)
 
 	if err := root.Execute(); err != nil {
@@ -38,6 +39,7 @@ func checkCmd(c *config.CLIConfig) *cobra.Command {
 			return cmd.RunCheck(c)
 		},
 	}
+	attachCheckFlags(check, c)
 
 	return check
 }
@@ -53,3 +55,20 @@ func splitCmd(c *config.CLIConfig) *cobra.Command {
 
 	return split
 }
+
+func applyBundlesCmd(c *config.CLIConfig) *cobra.Command {
+	applyBundles := &cobra.Command{
+		Use: "apply-bundles",
+		// Bundles are applied without access to the source project, so the full configuration check
+		// of the root command does not apply.
+		PersistentPreRunE: func(_ *cobra.Command, _ []string) error {
+			return c.CheckBundleConfig()
+		},
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return cmd.RunApplyBundles(c)
+		},
+	}
+	attachApplyBundlesFlags(applyBundles, c)
+
+	return applyBundles
+}